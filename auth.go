@@ -0,0 +1,564 @@
+package protonats
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// AuthMethod how connection authenticates
+type AuthMethod string
+
+const (
+	AuthNone     AuthMethod = "none"
+	AuthTLS      AuthMethod = "tls"
+	AuthCreds    AuthMethod = "creds"
+	AuthNKey     AuthMethod = "nkey"
+	AuthToken    AuthMethod = "token"
+	AuthUserPass AuthMethod = "user"
+)
+
+var ErrAuthConflict = errors.New("auth: only one of creds, nkey, token and token file can be used")
+
+// Auth typed NATS authentication: mTLS with one of creds file, NKey seed or token.
+// Files are validated on creation and checked for rotation on every (re)connect and Reload,
+// so renewed certificates and credentials are used without restart.
+// Broken rotated file doesn't replace the last valid one, its error is reported by Status.
+type Auth struct {
+	tls   *authFile
+	ca    *authFile
+	creds *authFile
+	nkey  *authFile
+	token *authFile
+
+	staticToken string
+
+	// loaded values guarded by mu
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+	userJWT   string
+	kp        nkeys.KeyPair
+	nkeyPub   string
+	tokenFile string
+}
+
+type AuthOption func(*Auth) error
+
+// WithTLSAuth client certificate and key, CA verifies server instead of system roots.
+// Either cert and key or CA can be empty.
+func WithTLSAuth(cert, key, ca string) AuthOption {
+	return func(a *Auth) error {
+		if (cert == "") != (key == "") {
+			return errors.New("auth: tls cert and key should be set together")
+		}
+
+		if cert != "" {
+			a.tls = &authFile{paths: []string{cert, key}, load: a.loadCert}
+		}
+
+		if ca != "" {
+			a.ca = &authFile{paths: []string{ca}, load: a.loadCA}
+		}
+
+		return nil
+	}
+}
+
+// WithCredsAuth user JWT and NKey seed from creds file
+func WithCredsAuth(file string) AuthOption {
+	return func(a *Auth) error {
+		a.creds = &authFile{paths: []string{file}, load: a.loadCreds}
+		return nil
+	}
+}
+
+// WithNKeyAuth user NKey seed file. Rotated seed should keep the same public key,
+// new key means new user and requires new connection.
+func WithNKeyAuth(seedFile string) AuthOption {
+	return func(a *Auth) error {
+		a.nkey = &authFile{paths: []string{seedFile}, load: a.loadNKey}
+		return nil
+	}
+}
+
+// WithTokenAuth static token
+func WithTokenAuth(token string) AuthOption {
+	return func(a *Auth) error {
+		if token == "" {
+			return errors.New("auth: empty token")
+		}
+
+		a.staticToken = token
+		return nil
+	}
+}
+
+// WithTokenFileAuth token read from file
+func WithTokenFileAuth(file string) AuthOption {
+	return func(a *Auth) error {
+		a.token = &authFile{paths: []string{file}, load: a.loadToken}
+		return nil
+	}
+}
+
+// NewAuth validates and loads auth files
+func NewAuth(opts ...AuthOption) (*Auth, error) {
+	a := &Auth{}
+
+	for _, fn := range opts {
+		if err := fn(a); err != nil {
+			return nil, err
+		}
+	}
+
+	n := 0
+	for _, set := range []bool{a.creds != nil, a.nkey != nil, a.token != nil, a.staticToken != ""} {
+		if set {
+			n++
+		}
+	}
+
+	if n > 1 {
+		return nil, ErrAuthConflict
+	}
+
+	for _, f := range a.files() {
+		if err := f.reload(true); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// Methods used by connection, e.g. [tls creds]
+func (a *Auth) Methods() []AuthMethod {
+	var res []AuthMethod
+
+	if a.tls != nil {
+		res = append(res, AuthTLS)
+	}
+
+	switch {
+	case a.creds != nil:
+		res = append(res, AuthCreds)
+	case a.nkey != nil:
+		res = append(res, AuthNKey)
+	case a.token != nil || a.staticToken != "":
+		res = append(res, AuthToken)
+	}
+
+	if len(res) == 0 {
+		return []AuthMethod{AuthNone}
+	}
+
+	return res
+}
+
+// Options connection options for NewProtocol, NewConsumer, NewSender or nats.Connect
+func (a *Auth) Options() []nats.Option {
+	var opts []nats.Option
+
+	if a.tls != nil || a.ca != nil {
+		opts = append(opts, nats.Secure(a.tlsConfig()))
+	}
+
+	switch {
+	case a.creds != nil:
+		opts = append(opts, nats.UserJWT(a.jwt, a.sign))
+	case a.nkey != nil:
+		opts = append(opts, nats.Nkey(a.nkeyPub, a.sign))
+	case a.staticToken != "":
+		opts = append(opts, nats.Token(a.staticToken))
+	case a.token != nil:
+		opts = append(opts, nats.TokenHandler(a.currentToken))
+	}
+
+	return opts
+}
+
+// Reload checks auth files for rotation, error of the first broken file is returned
+func (a *Auth) Reload() error {
+	var res error
+
+	for _, f := range a.files() {
+		if err := f.reload(false); err != nil && res == nil {
+			res = err
+		}
+	}
+
+	return res
+}
+
+// AuthStatus state of auth files
+type AuthStatus struct {
+	Methods []AuthMethod
+	// Reloaded time of the last successful load of any file
+	Reloaded time.Time
+	// Error of the last failed reload, empty when every file is valid
+	Error string
+}
+
+func (a *Auth) Status() AuthStatus {
+	res := AuthStatus{Methods: a.Methods()}
+
+	var errs []string
+	for _, f := range a.files() {
+		f.mu.Lock()
+		if f.loaded.After(res.Reloaded) {
+			res.Reloaded = f.loaded
+		}
+
+		if f.err != nil {
+			errs = append(errs, f.err.Error())
+		}
+		f.mu.Unlock()
+	}
+
+	res.Error = strings.Join(errs, "; ")
+
+	return res
+}
+
+func (a *Auth) files() []*authFile {
+	var res []*authFile
+
+	for _, f := range []*authFile{a.tls, a.ca, a.creds, a.nkey, a.token} {
+		if f != nil {
+			res = append(res, f)
+		}
+	}
+
+	return res
+}
+
+func (a *Auth) tlsConfig() *tls.Config {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if a.tls != nil {
+		c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			_ = a.tls.reload(false)
+
+			a.mu.RLock()
+			defer a.mu.RUnlock()
+
+			return a.cert, nil
+		}
+	}
+
+	if a.ca != nil {
+		// roots can't be replaced in tls.Config of connection, so chain and hostname are verified
+		// against reloaded pool here, nats.Conn sets ServerName from server URL
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			_ = a.ca.reload(false)
+
+			a.mu.RLock()
+			pool := a.pool
+			a.mu.RUnlock()
+
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("auth: server has no certificate")
+			}
+
+			// x509 skips hostname check for empty name, any certificate of CA would be accepted
+			if cs.ServerName == "" {
+				return errors.New("auth: server name is empty, server hostname can't be verified")
+			}
+
+			inter := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				inter.AddCert(cert)
+			}
+
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         pool,
+				Intermediates: inter,
+			})
+
+			return err
+		}
+	}
+
+	return c
+}
+
+func (a *Auth) jwt() (string, error) {
+	_ = a.creds.reload(false)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.userJWT, nil
+}
+
+func (a *Auth) sign(nonce []byte) ([]byte, error) {
+	// creds file is checked by jwt callback called before
+	if a.nkey != nil {
+		_ = a.nkey.reload(false)
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.kp.Sign(nonce)
+}
+
+func (a *Auth) currentToken() string {
+	_ = a.token.reload(false)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.tokenFile
+}
+
+func (a *Auth) loadCert(data [][]byte) error {
+	cert, err := tls.X509KeyPair(data[0], data[1])
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.cert = &cert
+	a.mu.Unlock()
+
+	return nil
+}
+
+func (a *Auth) loadCA(data [][]byte) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data[0]) {
+		return errors.New("no PEM certificates")
+	}
+
+	a.mu.Lock()
+	a.pool = pool
+	a.mu.Unlock()
+
+	return nil
+}
+
+func (a *Auth) loadCreds(data [][]byte) error {
+	token, err := jwt.ParseDecoratedJWT(data[0])
+	if err != nil {
+		return err
+	}
+
+	claims, err := jwt.DecodeUserClaims(token)
+	if err != nil {
+		return err
+	}
+
+	if claims.Expires > 0 && time.Now().Unix() > claims.Expires {
+		return fmt.Errorf("user jwt %s expired", claims.Subject)
+	}
+
+	kp, err := jwt.ParseDecoratedUserNKey(data[0])
+	if err != nil {
+		return err
+	}
+
+	if pub, _ := kp.PublicKey(); pub != claims.Subject {
+		return fmt.Errorf("seed doesn't belong to user jwt %s", claims.Subject)
+	}
+
+	a.mu.Lock()
+	a.userJWT, a.kp = token, kp
+	a.mu.Unlock()
+
+	return nil
+}
+
+func (a *Auth) loadNKey(data [][]byte) error {
+	kp, err := nkeys.ParseDecoratedNKey(data[0])
+	if err != nil {
+		return err
+	}
+
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	if !nkeys.IsValidPublicUserKey(pub) {
+		return errors.New("not a user nkey seed")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.nkeyPub != "" && a.nkeyPub != pub {
+		return fmt.Errorf("public key changed from %s to %s", a.nkeyPub, pub)
+	}
+
+	a.kp, a.nkeyPub = kp, pub
+
+	return nil
+}
+
+func (a *Auth) loadToken(data [][]byte) error {
+	token := string(bytes.TrimSpace(data[0]))
+	if token == "" {
+		return errors.New("empty token")
+	}
+
+	a.mu.Lock()
+	a.tokenFile = token
+	a.mu.Unlock()
+
+	return nil
+}
+
+// authFile files loaded together, reloaded when modification time or size of any of them changes
+type authFile struct {
+	paths []string
+	load  func(data [][]byte) error
+
+	mu      sync.Mutex
+	version string
+	loaded  time.Time
+	err     error
+}
+
+func (f *authFile) reload(force bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	version, err := f.stat()
+	if err == nil && version == f.version && !force {
+		return nil
+	}
+
+	if err == nil {
+		err = f.read()
+	}
+
+	if err != nil {
+		f.err = fmt.Errorf("auth %s: %w", strings.Join(f.paths, ", "), err)
+		return f.err
+	}
+
+	f.version, f.loaded, f.err = version, time.Now(), nil
+
+	return nil
+}
+
+func (f *authFile) stat() (string, error) {
+	var b strings.Builder
+
+	for _, p := range f.paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(&b, "%d:%d;", info.ModTime().UnixNano(), info.Size())
+	}
+
+	return b.String(), nil
+}
+
+func (f *authFile) read() error {
+	data := make([][]byte, len(f.paths))
+
+	for i, p := range f.paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		data[i] = b
+	}
+
+	return f.load(data)
+}
+
+// ConnHealth connection state for health checks
+type ConnHealth struct {
+	Status     string
+	Connected  bool
+	URL        string
+	ServerID   string
+	Reconnects uint64
+	LastError  string
+
+	// Auth methods of connection, with Auth its file state is reported as well
+	Auth AuthStatus
+}
+
+// Health reports conn state. Without auth methods are detected from connection options.
+func Health(conn *nats.Conn, auth *Auth) ConnHealth {
+	res := ConnHealth{
+		Status:     conn.Status().String(),
+		Connected:  conn.IsConnected(),
+		Reconnects: conn.Stats().Reconnects,
+	}
+
+	if res.Connected {
+		res.URL = redactURL(conn.ConnectedUrl())
+		res.ServerID = conn.ConnectedServerId()
+	}
+
+	if err := conn.LastError(); err != nil {
+		res.LastError = err.Error()
+	}
+
+	if auth != nil {
+		res.Auth = auth.Status()
+	} else {
+		res.Auth = AuthStatus{Methods: connAuthMethods(conn.Opts)}
+	}
+
+	return res
+}
+
+// redactURL strips user info which can hold password or token
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+
+	u.User = nil
+
+	return u.String()
+}
+
+func connAuthMethods(o nats.Options) []AuthMethod {
+	var res []AuthMethod
+
+	if o.TLSConfig != nil && (len(o.TLSConfig.Certificates) > 0 || o.TLSConfig.GetClientCertificate != nil) {
+		res = append(res, AuthTLS)
+	}
+
+	switch {
+	case o.UserJWT != nil:
+		res = append(res, AuthCreds)
+	case o.Nkey != "":
+		res = append(res, AuthNKey)
+	case o.Token != "" || o.TokenHandler != nil:
+		res = append(res, AuthToken)
+	case o.User != "":
+		res = append(res, AuthUserPass)
+	}
+
+	if len(res) == 0 {
+		return []AuthMethod{AuthNone}
+	}
+
+	return res
+}
@@ -0,0 +1,250 @@
+package protonats_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/d7561985/protonats"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func userCreds(t *testing.T, expires time.Time) []byte {
+	account, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	user, err := nkeys.CreateUser()
+	require.NoError(t, err)
+
+	userKey, _ := user.PublicKey()
+	claims := jwt.NewUserClaims(userKey)
+	claims.Expires = expires.Unix()
+
+	token, err := claims.Encode(account)
+	require.NoError(t, err)
+
+	seed, _ := user.Seed()
+	creds, err := jwt.FormatUserConfig(token, seed)
+	require.NoError(t, err)
+
+	return creds
+}
+
+func TestAuthCredsRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "user.creds")
+	require.NoError(t, os.WriteFile(path, userCreds(t, time.Now().Add(time.Hour)), 0o600))
+
+	auth, err := protonats.NewAuth(protonats.WithCredsAuth(path))
+	require.NoError(t, err)
+	assert.Equal(t, []protonats.AuthMethod{protonats.AuthCreds}, auth.Methods())
+	assert.Len(t, auth.Options(), 1)
+
+	loaded := auth.Status().Reloaded
+
+	// mtime resolution of some file systems is coarse
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, os.WriteFile(path, userCreds(t, time.Now().Add(2*time.Hour)), 0o600))
+	require.NoError(t, auth.Reload())
+	assert.True(t, auth.Status().Reloaded.After(loaded))
+
+	// broken rotation keeps the previous creds and is reported
+	require.NoError(t, os.WriteFile(path, []byte("garbage"), 0o600))
+	assert.Error(t, auth.Reload())
+	assert.Contains(t, auth.Status().Error, "user.creds")
+}
+
+func TestAuthValidation(t *testing.T) {
+	dir := t.TempDir()
+
+	expired := filepath.Join(dir, "expired.creds")
+	require.NoError(t, os.WriteFile(expired, userCreds(t, time.Now().Add(-time.Hour)), 0o600))
+
+	_, err := protonats.NewAuth(protonats.WithCredsAuth(expired))
+	assert.True(t, err != nil && strings.Contains(err.Error(), "expired"), err)
+
+	_, err = protonats.NewAuth(protonats.WithCredsAuth(filepath.Join(dir, "missing.creds")))
+	assert.Error(t, err)
+
+	_, err = protonats.NewAuth(protonats.WithTLSAuth(filepath.Join(dir, "cert.pem"), "", ""))
+	assert.Error(t, err)
+
+	account, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	seed, _ := account.Seed()
+
+	notUser := filepath.Join(dir, "account.nk")
+	require.NoError(t, os.WriteFile(notUser, seed, 0o600))
+
+	_, err = protonats.NewAuth(protonats.WithNKeyAuth(notUser))
+	assert.Error(t, err)
+
+	_, err = protonats.NewAuth(protonats.WithTokenAuth("s3cr3t"), protonats.WithCredsAuth(expired))
+	assert.True(t, errors.Is(err, protonats.ErrAuthConflict))
+
+	token := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(token, []byte("s3cr3t"), 0o600))
+
+	_, err = protonats.NewAuth(protonats.WithTokenAuth("s3cr3t"), protonats.WithTokenFileAuth(token))
+	assert.True(t, errors.Is(err, protonats.ErrAuthConflict))
+}
+
+func TestAuthNKey(t *testing.T) {
+	user, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	seed, _ := user.Seed()
+
+	path := filepath.Join(t.TempDir(), "user.nk")
+	require.NoError(t, os.WriteFile(path, seed, 0o600))
+
+	auth, err := protonats.NewAuth(protonats.WithNKeyAuth(path))
+	require.NoError(t, err)
+
+	// another user can't replace the key of connection
+	other, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	seed, _ = other.Seed()
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, os.WriteFile(path, seed, 0o600))
+	assert.Error(t, auth.Reload())
+	assert.Contains(t, auth.Status().Error, "public key changed")
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// server issues server certificate for host
+func (ca *testCA) server(t *testing.T, host string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsServer accepts TLS handshakes with the current certificate
+func tlsServer(t *testing.T, cert *atomic.Value) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	cfg := &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		c := cert.Load().(tls.Certificate)
+		return &c, nil
+	}}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_ = tls.Server(conn, cfg).Handshake()
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestAuthTLSVerify(t *testing.T) {
+	ca1, ca2 := newTestCA(t, "ca1"), newTestCA(t, "ca2")
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(path, ca1.pem, 0o600))
+
+	auth, err := protonats.NewAuth(protonats.WithTLSAuth("", "", path))
+	require.NoError(t, err)
+
+	opts := nats.GetDefaultOptions()
+	for _, fn := range auth.Options() {
+		require.NoError(t, fn(&opts))
+	}
+
+	var cert atomic.Value
+	cert.Store(ca1.server(t, "nats.local"))
+	addr := tlsServer(t, &cert)
+
+	handshake := func(serverName string) error {
+		cfg := opts.TLSConfig.Clone()
+		cfg.ServerName = serverName
+
+		conn, err := tls.Dial("tcp", addr, cfg)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+
+	require.NoError(t, handshake("nats.local"))
+	assert.Error(t, handshake("other.local"), "certificate of CA for another host")
+	assert.Error(t, handshake(""), "hostname isn't verified")
+
+	// server still presents certificate of the old CA
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, os.WriteFile(path, ca2.pem, 0o600))
+	assert.Error(t, handshake("nats.local"))
+
+	cert.Store(ca2.server(t, "nats.local"))
+	require.NoError(t, handshake("nats.local"))
+	assert.Error(t, handshake("other.local"))
+}
@@ -0,0 +1,243 @@
+package protonats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/observability"
+	"github.com/d7561985/tel"
+	"github.com/nats-io/nats.go"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrBatchFailed     = errors.New("batch: not all messages are sent")
+	ErrBatchAckTimeout = errors.New("batch: JetStream ack timeout")
+)
+
+type batchConfig struct {
+	flush time.Duration
+
+	jetStream bool
+	ackWait   time.Duration
+	jsOpts    []nats.JSOpt
+}
+
+type BatchOption func(*batchConfig)
+
+// WithBatchFlush makes single FlushTimeout after all publishes, so batch result means server received messages
+func WithBatchFlush(timeout time.Duration) BatchOption {
+	return func(c *batchConfig) {
+		c.flush = timeout
+	}
+}
+
+// WithBatchJetStream publishes batch asynchronously into JetStream and waits ackWait for all acks at once
+func WithBatchJetStream(ackWait time.Duration, opts ...nats.JSOpt) BatchOption {
+	return func(c *batchConfig) {
+		c.jetStream = true
+		c.ackWait = ackWait
+		c.jsOpts = opts
+	}
+}
+
+type batchIndexKey struct{}
+
+// SendBatch publishes messages one after another without waiting for each of them and returns per message results,
+// nil result means message is sent. Error is ErrBatchFailed when any result isn't nil.
+// Every message passes send middlewares, their spans are children of the batch span.
+// Middlewares and message Finish get the final result: flush result with WithBatchFlush, ack with WithBatchJetStream.
+// Batch bypasses spool, see WithSpool.
+func (s *Sender) SendBatch(ctx context.Context, msgs []binding.Message, opts ...BatchOption) ([]error, error) {
+	cfg := batchConfig{ackWait: 5 * time.Second}
+	for _, fn := range opts {
+		fn(&cfg)
+	}
+
+	span, ctx := tel.StartSpanFromContext(ctx, observability.ClientSpanName+" batch",
+		opentracing.Tags{"batch.size": len(msgs), "batch.jetstream": cfg.jetStream})
+	defer span.Finish()
+
+	ext.Component.Set(span, componentName)
+	ext.SpanKindProducer.Set(span)
+
+	results := s.sendBatch(ctx, msgs, cfg)
+
+	var failed int
+	for _, err := range results {
+		if err != nil {
+			failed++
+		}
+	}
+
+	if failed == 0 {
+		return results, nil
+	}
+
+	span.Error("batch send", zap.Int("failed", failed))
+
+	return results, fmt.Errorf("%w: %d of %d failed", ErrBatchFailed, failed, len(msgs))
+}
+
+// batch every message passes middlewares in own goroutine, the innermost handler publishes it in batch order
+// and waits until batch is settled by flush or JetStream acks
+type batch struct {
+	sender *Sender
+	cfg    batchConfig
+	js     nats.JetStreamContext
+
+	// published is closed when message is published or rejected by middleware
+	published []chan struct{}
+	once      []sync.Once
+	futures   []nats.PubAckFuture
+
+	settled chan struct{}
+	acks    []error
+}
+
+func (s *Sender) sendBatch(ctx context.Context, msgs []binding.Message, cfg batchConfig) []error {
+	results := make([]error, len(msgs))
+
+	b := &batch{
+		sender:    s,
+		cfg:       cfg,
+		published: make([]chan struct{}, len(msgs)),
+		once:      make([]sync.Once, len(msgs)),
+		futures:   make([]nats.PubAckFuture, len(msgs)),
+		settled:   make(chan struct{}),
+		acks:      make([]error, len(msgs)),
+	}
+
+	if cfg.jetStream {
+		js, err := s.Conn.JetStream(cfg.jsOpts...)
+		if err != nil {
+			for i, in := range msgs {
+				results[i] = err
+				_ = in.Finish(err)
+			}
+
+			return results
+		}
+
+		b.js = js
+	}
+
+	for i := range b.published {
+		b.published[i] = make(chan struct{})
+	}
+
+	h := ChainSend(b.publish, s.middlewares...)
+
+	wg := sync.WaitGroup{}
+
+	for i, in := range msgs {
+		wg.Add(1)
+
+		go func(i int, in binding.Message) {
+			defer wg.Done()
+			defer b.done(i)
+
+			results[i] = h(context.WithValue(ctx, batchIndexKey{}, i), in)
+		}(i, in)
+	}
+
+	for _, ch := range b.published {
+		<-ch
+	}
+
+	b.settle(ctx)
+	close(b.settled)
+
+	wg.Wait()
+
+	return results
+}
+
+// publish the innermost send handler, message is finished with its settled result
+func (b *batch) publish(ctx context.Context, in binding.Message, transformers ...binding.Transformer) (err error) {
+	i := ctx.Value(batchIndexKey{}).(int)
+
+	defer func() { _ = in.Finish(err) }()
+
+	// keep batch order
+	if i > 0 {
+		<-b.published[i-1]
+	}
+
+	err = b.send(ctx, i, in, transformers...)
+	b.done(i)
+
+	if err != nil {
+		return err
+	}
+
+	<-b.settled
+
+	return b.acks[i]
+}
+
+func (b *batch) send(ctx context.Context, i int, in binding.Message, transformers ...binding.Transformer) error {
+	msg, err := b.sender.natsMsg(ctx, in, transformers...)
+	if err != nil {
+		return err
+	}
+
+	if b.js == nil {
+		return b.sender.Conn.PublishMsg(msg)
+	}
+
+	b.futures[i], err = b.js.PublishMsgAsync(msg)
+
+	return err
+}
+
+func (b *batch) done(i int) {
+	b.once[i].Do(func() { close(b.published[i]) })
+}
+
+// settle resolves results of published messages by single flush or by JetStream acks
+func (b *batch) settle(ctx context.Context) {
+	if b.js == nil {
+		if b.cfg.flush == 0 {
+			return
+		}
+
+		if err := b.sender.Conn.FlushTimeout(b.cfg.flush); err != nil {
+			for i := range b.acks {
+				b.acks[i] = fmt.Errorf("batch flush: %w", err)
+			}
+		}
+
+		return
+	}
+
+	timer := time.NewTimer(b.cfg.ackWait)
+	defer timer.Stop()
+
+	select {
+	case <-b.js.PublishAsyncComplete():
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	for i, f := range b.futures {
+		// rejected before publish
+		if f == nil {
+			continue
+		}
+
+		select {
+		case <-f.Ok():
+		case err := <-f.Err():
+			b.acks[i] = err
+		default:
+			b.acks[i] = ErrBatchAckTimeout
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package protonats_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	cn "github.com/cloudevents/sdk-go/protocol/nats/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/d7561985/protonats"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// finishMsg remembers result message was finished with
+type finishMsg struct {
+	*binding.EventMessage
+
+	finished chan error
+}
+
+func (m *finishMsg) GetWrappedMessage() binding.Message { return m.EventMessage }
+
+func (m *finishMsg) Finish(err error) error {
+	m.finished <- err
+	return nil
+}
+
+// batchResults records results seen by send middleware by event id
+type batchResults struct {
+	mu  sync.Mutex
+	res map[string]error
+}
+
+func (r *batchResults) middleware(t *testing.T) protonats.SendMiddleware {
+	return func(next protonats.SendHandler) protonats.SendHandler {
+		return func(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+			e, err := binding.ToEvent(ctx, in)
+			require.NoError(t, err)
+
+			// events with "nostream" id are published outside of the stream
+			if e.ID() == "nostream" {
+				ctx = cecontext.WithTopic(ctx, "payments.created")
+			}
+
+			err = next(ctx, in, transformers...)
+
+			r.mu.Lock()
+			r.res[e.ID()] = err
+			r.mu.Unlock()
+
+			return err
+		}
+	}
+}
+
+func batchMsgs(t *testing.T, ids ...string) ([]binding.Message, []*finishMsg) {
+	msgs := make([]binding.Message, 0, len(ids))
+	finished := make([]*finishMsg, 0, len(ids))
+
+	for _, id := range ids {
+		e := newEvent(t, "orders.created", orderCreated{ID: id})
+		e.SetID(id)
+
+		m := &finishMsg{EventMessage: (*binding.EventMessage)(&e), finished: make(chan error, 1)}
+		msgs = append(msgs, m)
+		finished = append(finished, m)
+	}
+
+	return msgs, finished
+}
+
+func TestSendBatchJetStream(t *testing.T) {
+	conn := runServer(t)
+	js, err := conn.JetStream()
+	require.NoError(t, err)
+
+	rec := &batchResults{res: map[string]error{}}
+
+	s, err := protonats.NewSenderFromConnWithOptions(conn, "orders.created", protonats.WithSendMiddleware(rec.middleware(t)))
+	require.NoError(t, err)
+
+	ids := []string{"1", "2", "nostream", "3", "4", "5"}
+	msgs, finished := batchMsgs(t, ids...)
+
+	results, err := s.SendBatch(context.Background(), msgs, protonats.WithBatchJetStream(time.Second))
+	assert.True(t, errors.Is(err, protonats.ErrBatchFailed), err)
+
+	for i, id := range ids {
+		if id == "nostream" {
+			// publish itself succeeds, only ack fails
+			assert.Error(t, results[i])
+		} else {
+			assert.NoError(t, results[i], id)
+		}
+
+		// middleware and Finish see result of the ack
+		assert.Equal(t, results[i], rec.res[id], id)
+		assert.Equal(t, results[i], <-finished[i].finished, id)
+	}
+
+	// stream keeps batch order
+	var stored []string
+	for seq := uint64(1); seq <= 5; seq++ {
+		raw, err := js.GetMsg("ORDERS", seq)
+		require.NoError(t, err)
+
+		e, err := binding.ToEvent(context.Background(), cn.NewMessage(&nats.Msg{Data: raw.Data, Header: raw.Header}))
+		require.NoError(t, err)
+
+		stored = append(stored, e.ID())
+	}
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, stored)
+}
+
+func TestSendBatchFlush(t *testing.T) {
+	conn := runServer(t)
+
+	sub, err := conn.SubscribeSync("orders.created")
+	require.NoError(t, err)
+
+	errRejected := errors.New("rejected")
+	reject := func(next protonats.SendHandler) protonats.SendHandler {
+		return func(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+			e, err := binding.ToEvent(ctx, in)
+			require.NoError(t, err)
+
+			if e.ID() == "2" {
+				_ = in.Finish(errRejected)
+				return errRejected
+			}
+
+			return next(ctx, in, transformers...)
+		}
+	}
+
+	s, err := protonats.NewSenderFromConnWithOptions(conn, "orders.created", protonats.WithSendMiddleware(reject))
+	require.NoError(t, err)
+
+	ids := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		ids = append(ids, fmt.Sprint(i))
+	}
+
+	msgs, finished := batchMsgs(t, ids...)
+
+	results, err := s.SendBatch(context.Background(), msgs, protonats.WithBatchFlush(time.Second))
+	assert.True(t, errors.Is(err, protonats.ErrBatchFailed), err)
+
+	for i, id := range ids {
+		if id == "2" {
+			assert.Equal(t, errRejected, results[i])
+		} else {
+			assert.NoError(t, results[i], id)
+		}
+
+		assert.Equal(t, results[i], <-finished[i].finished, id)
+	}
+
+	// rejected message doesn't break order of the rest
+	var received []string
+	for range ids[1:] {
+		msg, err := sub.NextMsg(time.Second)
+		require.NoError(t, err)
+
+		e, err := binding.ToEvent(context.Background(), cn.NewMessage(msg))
+		require.NoError(t, err)
+
+		received = append(received, e.ID())
+	}
+
+	assert.Equal(t, append([]string{"0", "1"}, ids[3:]...), received)
+}
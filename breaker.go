@@ -0,0 +1,308 @@
+package protonats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/d7561985/tel"
+	"go.uber.org/zap"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+// CircuitOpenError returned instead of publish while breaker is open, errors.Is(err, ErrCircuitOpen) is true
+type CircuitOpenError struct {
+	Name string
+	// RetryAfter is the moment breaker lets probe request through
+	RetryAfter time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s %q: retry after %s", ErrCircuitOpen, e.Name, time.Until(e.RetryAfter).Round(time.Millisecond))
+}
+
+func (e *CircuitOpenError) Unwrap() error { return ErrCircuitOpen }
+
+// CircuitBreaker tracks outcomes of the last window requests and opens when failure ratio reaches threshold.
+// Open breaker fails fast for open timeout, then half-opens and lets probes through:
+// probes success closes breaker, any probe failure opens it again.
+type CircuitBreaker struct {
+	name string
+
+	window      int
+	minRequests int
+	ratio       float64
+	openTimeout time.Duration
+	probes      int
+
+	metrics BreakerMetrics
+
+	mx       sync.Mutex
+	state    BreakerState
+	gen      uint64
+	outcomes []bool
+	pos      int
+	count    int
+	failures int
+	openedAt time.Time
+	inFlight int
+	passed   int
+}
+
+type BreakerOption func(*CircuitBreaker)
+
+// WithBreakerWindow sets number of the last requests used for failure ratio
+func WithBreakerWindow(n int) BreakerOption {
+	return func(b *CircuitBreaker) {
+		if n > 0 {
+			b.window = n
+		}
+	}
+}
+
+// WithBreakerMinRequests sets number of requests within window before breaker may open
+func WithBreakerMinRequests(n int) BreakerOption {
+	return func(b *CircuitBreaker) {
+		if n > 0 {
+			b.minRequests = n
+		}
+	}
+}
+
+// WithBreakerFailureRatio sets failure ratio (0, 1] which opens breaker
+func WithBreakerFailureRatio(r float64) BreakerOption {
+	return func(b *CircuitBreaker) {
+		if r > 0 && r <= 1 {
+			b.ratio = r
+		}
+	}
+}
+
+// WithBreakerOpenTimeout sets how long breaker stays open before half-open
+func WithBreakerOpenTimeout(d time.Duration) BreakerOption {
+	return func(b *CircuitBreaker) {
+		if d > 0 {
+			b.openTimeout = d
+		}
+	}
+}
+
+// WithBreakerProbes sets number of successful half-open requests which close breaker
+func WithBreakerProbes(n int) BreakerOption {
+	return func(b *CircuitBreaker) {
+		if n > 0 {
+			b.probes = n
+		}
+	}
+}
+
+// WithBreakerMetrics exports state changes and rejected requests into m
+func WithBreakerMetrics(m BreakerMetrics) BreakerOption {
+	return func(b *CircuitBreaker) {
+		if m != nil {
+			b.metrics = m
+		}
+	}
+}
+
+// NewCircuitBreaker creates closed breaker, name is used in errors, logs and metrics label
+func NewCircuitBreaker(name string, opts ...BreakerOption) *CircuitBreaker {
+	b := &CircuitBreaker{
+		name:        name,
+		window:      20,
+		minRequests: 10,
+		ratio:       0.5,
+		openTimeout: 5 * time.Second,
+		probes:      1,
+		metrics:     nullMetrics{},
+	}
+
+	for _, fn := range opts {
+		fn(b)
+	}
+
+	if b.minRequests > b.window {
+		b.minRequests = b.window
+	}
+
+	b.outcomes = make([]bool, b.window)
+	b.metrics.SetBreakerState(b.name, BreakerClosed)
+
+	return b
+}
+
+// State returns current breaker state
+func (b *CircuitBreaker) State() BreakerState {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.state == BreakerOpen && !time.Now().Before(b.openedAt.Add(b.openTimeout)) {
+		return BreakerHalfOpen
+	}
+
+	return b.state
+}
+
+// Do runs fn if breaker allows it and records result
+func (b *CircuitBreaker) Do(ctx context.Context, fn func() error) error {
+	gen, err := b.allow(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	b.done(ctx, gen, err)
+
+	return err
+}
+
+func (b *CircuitBreaker) allow(ctx context.Context) (uint64, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.state == BreakerOpen {
+		retry := b.openedAt.Add(b.openTimeout)
+		if time.Now().Before(retry) {
+			b.metrics.AddBreakerRejected(b.name)
+			return 0, &CircuitOpenError{Name: b.name, RetryAfter: retry}
+		}
+
+		b.transit(ctx, BreakerHalfOpen)
+	}
+
+	if b.state == BreakerHalfOpen {
+		if b.inFlight >= b.probes {
+			b.metrics.AddBreakerRejected(b.name)
+			return 0, &CircuitOpenError{Name: b.name, RetryAfter: time.Now().Add(b.openTimeout)}
+		}
+
+		b.inFlight++
+	}
+
+	return b.gen, nil
+}
+
+func (b *CircuitBreaker) done(ctx context.Context, gen uint64, err error) {
+	failed := err != nil
+	// caller side errors say nothing about NATS health
+	neutral := errors.Is(err, context.Canceled) || errors.Is(err, ErrRateLimited)
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	// request started before the last state change
+	if gen != b.gen {
+		return
+	}
+
+	if neutral {
+		if b.state == BreakerHalfOpen {
+			b.inFlight--
+		}
+		return
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		b.inFlight--
+
+		if failed {
+			b.transit(ctx, BreakerOpen, zap.Error(err))
+			return
+		}
+
+		if b.passed++; b.passed >= b.probes {
+			b.transit(ctx, BreakerClosed)
+		}
+	case BreakerClosed:
+		if b.count == b.window {
+			if b.outcomes[b.pos] {
+				b.failures--
+			}
+		} else {
+			b.count++
+		}
+
+		b.outcomes[b.pos] = failed
+		b.pos = (b.pos + 1) % b.window
+
+		if failed {
+			b.failures++
+		}
+
+		if b.count >= b.minRequests && float64(b.failures)/float64(b.count) >= b.ratio {
+			b.transit(ctx, BreakerOpen, zap.Error(err), zap.Int("failures", b.failures), zap.Int("requests", b.count))
+		}
+	}
+}
+
+// transit should be called under lock
+func (b *CircuitBreaker) transit(ctx context.Context, to BreakerState, fields ...zap.Field) {
+	from := b.state
+
+	b.state = to
+	b.gen++
+	b.inFlight, b.passed = 0, 0
+
+	switch to {
+	case BreakerOpen:
+		b.openedAt = time.Now()
+	case BreakerClosed:
+		b.pos, b.count, b.failures = 0, 0, 0
+		for i := range b.outcomes {
+			b.outcomes[i] = false
+		}
+	}
+
+	b.metrics.SetBreakerState(b.name, to)
+
+	fields = append(fields, zap.String("breaker", b.name), zap.Stringer("from", from), zap.Stringer("to", to))
+	if to == BreakerOpen {
+		tel.FromCtx(ctx).Warn("circuit breaker state", fields...)
+	} else {
+		tel.FromCtx(ctx).Info("circuit breaker state", fields...)
+	}
+}
+
+// BreakSend guards send chain by breaker, rejected message is finished with CircuitOpenError
+func BreakSend(b *CircuitBreaker) SendMiddleware {
+	return func(next SendHandler) SendHandler {
+		return func(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+			gen, err := b.allow(ctx)
+			if err != nil {
+				_ = in.Finish(err)
+				return err
+			}
+
+			err = next(ctx, in, transformers...)
+			b.done(ctx, gen, err)
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package protonats_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/d7561985/protonats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	errPublish := errors.New("nats: connection closed")
+
+	b := protonats.NewCircuitBreaker("test",
+		protonats.WithBreakerWindow(4),
+		protonats.WithBreakerMinRequests(4),
+		protonats.WithBreakerFailureRatio(0.5),
+		protonats.WithBreakerOpenTimeout(20*time.Millisecond),
+	)
+
+	ok := func() error { return nil }
+	fail := func() error { return errPublish }
+
+	require.NoError(t, b.Do(ctx, ok))
+	require.NoError(t, b.Do(ctx, ok))
+	require.Equal(t, errPublish, b.Do(ctx, fail))
+	assert.Equal(t, protonats.BreakerClosed, b.State())
+
+	require.Equal(t, errPublish, b.Do(ctx, fail))
+	assert.Equal(t, protonats.BreakerOpen, b.State())
+
+	err := b.Do(ctx, ok)
+	assert.True(t, errors.Is(err, protonats.ErrCircuitOpen))
+
+	var openErr *protonats.CircuitOpenError
+	require.True(t, errors.As(err, &openErr))
+	assert.Equal(t, "test", openErr.Name)
+
+	time.Sleep(25 * time.Millisecond)
+	assert.Equal(t, protonats.BreakerHalfOpen, b.State())
+
+	// failed probe opens breaker again
+	require.Equal(t, errPublish, b.Do(ctx, fail))
+	assert.Equal(t, protonats.BreakerOpen, b.State())
+
+	time.Sleep(25 * time.Millisecond)
+	require.NoError(t, b.Do(ctx, ok))
+	assert.Equal(t, protonats.BreakerClosed, b.State())
+}
@@ -4,16 +4,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 
+	cn "github.com/cloudevents/sdk-go/protocol/nats/v2"
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
 	"github.com/cloudevents/sdk-go/v2/extensions"
 	"github.com/d7561985/tel"
+	"github.com/nats-io/nats.go"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// HeaderTraceState NATS message header of trace carrier, CloudEvents binary mode name of the extension
+const HeaderTraceState = "ce-" + extensions.TraceStateExtension
+
 var (
 	ErrTraceStateExtension = errors.New("cloudevents extension not contain key: " + extensions.TraceStateExtension)
 )
@@ -29,19 +36,27 @@ func InjectDistributedTracingExtension(ctx context.Context, event *cloudevents.E
 		return
 	}
 
-	buf := bytes.NewBuffer(nil)
-
-	if err := tel.FromCtxWithSpan(ctx).Tracer().Inject(span.Context(), opentracing.Binary, buf); err != nil {
+	data, err := EncodeSpanContext(ctx, span.Context())
+	if err != nil {
 		tel.FromCtx(ctx).Warn("inject", zap.Error(err))
 		return
 	}
 
-	// encode for correct transfer
-	data := base64.RawStdEncoding.EncodeToString(buf.Bytes())
-
 	event.SetExtension(extensions.TraceStateExtension, data)
 }
 
+// EncodeSpanContext serializes span context into the string carrier used by traceparent extension
+func EncodeSpanContext(ctx context.Context, spanCtx opentracing.SpanContext) (string, error) {
+	buf := bytes.NewBuffer(nil)
+
+	if err := tel.FromCtxWithSpan(ctx).Tracer().Inject(spanCtx, opentracing.Binary, buf); err != nil {
+		return "", err
+	}
+
+	// encode for correct transfer
+	return base64.RawStdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
 // ExtractDistributedTracingExtension extracts the tracecontext from the cloud event.
 func ExtractDistributedTracingExtension(ctx context.Context, event *cloudevents.Event) (opentracing.SpanContext, error) {
 	x, ok := event.Extensions()[extensions.TraceStateExtension]
@@ -54,6 +69,11 @@ func ExtractDistributedTracingExtension(ctx context.Context, event *cloudevents.
 		return nil, fmt.Errorf("carrier casting wrong type %T", x)
 	}
 
+	return DecodeSpanContext(ctx, v)
+}
+
+// DecodeSpanContext restores span context serialized by EncodeSpanContext
+func DecodeSpanContext(ctx context.Context, v string) (opentracing.SpanContext, error) {
 	data, err := base64.RawStdEncoding.DecodeString(v)
 	if err != nil {
 		return nil, fmt.Errorf("base64 decode %w", err)
@@ -67,3 +87,43 @@ func ExtractDistributedTracingExtension(ctx context.Context, event *cloudevents.
 
 	return span, nil
 }
+
+// MessageTraceCarrier reads trace carrier of message without decoding event:
+// NATS message header, structured envelope attribute or extension of binary and event messages.
+// Empty result means message has no carrier.
+func MessageTraceCarrier(msg binding.Message) string {
+	if r, ok := msg.(binding.MessageMetadataReader); ok {
+		s, _ := r.GetExtension(extensions.TraceStateExtension).(string)
+		return s
+	}
+
+	m := natsMsgOf(msg)
+	if m == nil {
+		return ""
+	}
+
+	if v := m.Header.Get(HeaderTraceState); v != "" {
+		return v
+	}
+
+	// the rest of envelope isn't validated, so carrier of malformed event is found too
+	var envelope struct {
+		TraceState string `json:"tracestate"`
+	}
+
+	_ = json.Unmarshal(m.Data, &envelope)
+
+	return envelope.TraceState
+}
+
+// natsMsgOf returns NATS message of protocol message
+func natsMsgOf(msg binding.Message) *nats.Msg {
+	switch v := msg.(type) {
+	case *Message:
+		return v.Msg
+	case *cn.Message:
+		return v.Msg
+	}
+
+	return nil
+}
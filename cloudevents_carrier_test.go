@@ -0,0 +1,27 @@
+package protonats_test
+
+import (
+	"testing"
+
+	cn "github.com/cloudevents/sdk-go/protocol/nats/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/d7561985/protonats"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageTraceCarrier(t *testing.T) {
+	// id is missing, event can't be decoded
+	malformed := &nats.Msg{Data: []byte(`{"specversion":"1.0","type":"t","source":"s","tracestate":"abc"}`)}
+	assert.Equal(t, "abc", protonats.MessageTraceCarrier(cn.NewMessage(malformed)))
+
+	header := &nats.Msg{Header: nats.Header{}, Data: []byte(`not json`)}
+	header.Header.Set(protonats.HeaderTraceState, "def")
+	assert.Equal(t, "def", protonats.MessageTraceCarrier(cn.NewMessage(header)))
+
+	e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	assert.Equal(t, "", protonats.MessageTraceCarrier((*binding.EventMessage)(&e)))
+
+	e.SetExtension("tracestate", "ghi")
+	assert.Equal(t, "ghi", protonats.MessageTraceCarrier((*binding.EventMessage)(&e)))
+}
@@ -0,0 +1,252 @@
+package protonats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/tel"
+	"github.com/nats-io/nats.go"
+	"github.com/opentracing/opentracing-go"
+	"go.uber.org/zap"
+)
+
+// ClusterAttr span attribute with name of the cluster which served publish
+const ClusterAttr = "messaging.nats.cluster"
+
+var (
+	ErrNoClusters         = errors.New("clusters: no cluster configured")
+	ErrNoClusterAvailable = errors.New("clusters: no connected cluster")
+)
+
+// ClusterConfig endpoint of one NATS cluster
+type ClusterConfig struct {
+	Name    string
+	Region  string
+	Servers []string
+	// Options of cluster connection, e.g. own credentials
+	Options []nats.Option
+	// SenderOptions of cluster Sender applied after the common ones, e.g. own circuit breaker
+	SenderOptions []SenderOption
+}
+
+// Cluster connected NATS cluster
+type Cluster struct {
+	ClusterConfig
+
+	Conn *nats.Conn
+}
+
+// Clusters keeps connections to several NATS clusters ordered by preference:
+// clusters of preferred region go first, then clusters in configuration order.
+type Clusters struct {
+	clusters  []*Cluster
+	region    string
+	dualWrite bool
+	metrics   ClusterMetrics
+}
+
+type ClusterOption func(*Clusters)
+
+// WithPreferredRegion puts clusters of region in front of others
+func WithPreferredRegion(region string) ClusterOption {
+	return func(c *Clusters) { c.region = region }
+}
+
+// WithDualWrite publishes every event to all clusters, e.g. during migration.
+// Result of the first cluster is returned, failures of others are logged and counted.
+func WithDualWrite() ClusterOption {
+	return func(c *Clusters) { c.dualWrite = true }
+}
+
+// WithClusterMetrics reports publishes by cluster into m
+func WithClusterMetrics(m ClusterMetrics) ClusterOption {
+	return func(c *Clusters) {
+		if m != nil {
+			c.metrics = m
+		}
+	}
+}
+
+// ConnectClusters connects to every cluster. Connections retry failed connect in background,
+// so unavailable secondary cluster doesn't prevent start.
+func ConnectClusters(configs []ClusterConfig, opts ...ClusterOption) (*Clusters, error) {
+	if len(configs) == 0 {
+		return nil, ErrNoClusters
+	}
+
+	res := &Clusters{metrics: nullMetrics{}}
+	for _, fn := range opts {
+		fn(res)
+	}
+
+	configs = append([]ClusterConfig{}, configs...)
+	sort.SliceStable(configs, func(i, j int) bool {
+		return configs[i].Region == res.region && configs[j].Region != res.region
+	})
+
+	for _, cfg := range configs {
+		natsOpts := append([]nats.Option{nats.Name(cfg.Name), nats.RetryOnFailedConnect(true)}, cfg.Options...)
+
+		conn, err := nats.Connect(strings.Join(cfg.Servers, ","), natsOpts...)
+		if err != nil {
+			res.Close()
+			return nil, fmt.Errorf("cluster %s connect: %w", cfg.Name, err)
+		}
+
+		res.clusters = append(res.clusters, &Cluster{ClusterConfig: cfg, Conn: conn})
+	}
+
+	return res, nil
+}
+
+// All clusters in preference order
+func (c *Clusters) All() []*Cluster { return c.clusters }
+
+// Active the most preferred connected cluster
+func (c *Clusters) Active() (*Cluster, error) {
+	for _, cl := range c.clusters {
+		if cl.Conn.IsConnected() {
+			return cl, nil
+		}
+	}
+
+	return nil, ErrNoClusterAvailable
+}
+
+// Close closes all cluster connections
+func (c *Clusters) Close() {
+	for _, cl := range c.clusters {
+		cl.Conn.Close()
+	}
+}
+
+type clusterKey struct{}
+
+// ClusterFrom returns name of the cluster which serves publish, available inside Sender middlewares
+func ClusterFrom(ctx context.Context) string {
+	name, _ := ctx.Value(clusterKey{}).(string)
+	return name
+}
+
+// ClusterSender publishes to the most preferred connected cluster and fails over to the next one
+// when cluster is disconnected or its publish fails because of connection or open circuit breaker.
+// In dual-write mode event is published to every cluster.
+type ClusterSender struct {
+	Clusters *Clusters
+	Subject  string
+
+	senders []*Sender
+}
+
+// NewClusterSender creates Sender for every cluster with opts followed by cluster SenderOptions.
+// opts are shared by all clusters, so stateful options like WithCircuitBreaker belong to ClusterConfig.SenderOptions:
+// shared breaker opened by one cluster rejects publishes to the others as well.
+func NewClusterSender(clusters *Clusters, subject string, opts ...SenderOption) (*ClusterSender, error) {
+	res := &ClusterSender{Clusters: clusters, Subject: subject}
+
+	for _, cl := range clusters.All() {
+		clOpts := append(append([]SenderOption{}, opts...), cl.SenderOptions...)
+
+		s, err := NewSenderFromConnWithOptions(cl.Conn, subject, clOpts...)
+		if err != nil {
+			return nil, err
+		}
+
+		res.senders = append(res.senders, s)
+	}
+
+	return res, nil
+}
+
+// Send implements protocol.Sender, message is read once and finished with the returned result
+func (s *ClusterSender) Send(ctx context.Context, in binding.Message, transformers ...binding.Transformer) (err error) {
+	defer func() {
+		if err2 := in.Finish(err); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+
+	e, err := binding.ToEvent(ctx, in, transformers...)
+	if err != nil {
+		return err
+	}
+
+	if s.Clusters.dualWrite {
+		return s.dualWrite(ctx, (*binding.EventMessage)(e))
+	}
+
+	err = ErrNoClusterAvailable
+	for i, cl := range s.Clusters.All() {
+		if !cl.Conn.IsConnected() {
+			continue
+		}
+
+		if err = s.send(ctx, i, (*binding.EventMessage)(e)); !isFailoverError(err) {
+			return err
+		}
+
+		tel.FromCtx(ctx).Warn("cluster publish failover", zap.String("cluster", cl.Name), zap.Error(err))
+	}
+
+	return err
+}
+
+func (s *ClusterSender) dualWrite(ctx context.Context, msg binding.Message) error {
+	var primary error
+
+	for i, cl := range s.Clusters.All() {
+		err := s.send(ctx, i, msg)
+		if i == 0 {
+			primary = err
+			continue
+		}
+
+		if err != nil {
+			tel.FromCtx(ctx).Warn("cluster dual write", zap.String("cluster", cl.Name), zap.Error(err))
+		}
+	}
+
+	return primary
+}
+
+func (s *ClusterSender) send(ctx context.Context, i int, msg binding.Message) error {
+	name := s.Clusters.clusters[i].Name
+
+	// dual write is reported by spans of every cluster Sender only
+	if span := opentracing.SpanFromContext(ctx); span != nil && !s.Clusters.dualWrite {
+		span.SetTag(ClusterAttr, name)
+	}
+
+	err := s.senders[i].Send(context.WithValue(ctx, clusterKey{}, name), msg)
+	s.Clusters.metrics.AddClusterPublish(name, i > 0 && !s.Clusters.dualWrite, err)
+
+	return err
+}
+
+// Close closes senders, clusters are closed by their owner
+func (s *ClusterSender) Close(ctx context.Context) error {
+	var errs []string
+
+	for _, sender := range s.senders {
+		if err := sender.Close(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("cluster sender close: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func isFailoverError(err error) bool {
+	return isConnectionError(err) || errors.Is(err, ErrCircuitOpen)
+}
+
+var _ protocol.SendCloser = (*ClusterSender)(nil)
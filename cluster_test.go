@@ -0,0 +1,165 @@
+package protonats_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/d7561985/protonats"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClustersUnavailable(t *testing.T) {
+	// nothing listens there, connections keep retrying
+	clusters, err := protonats.ConnectClusters([]protonats.ClusterConfig{
+		{Name: "us", Region: "us", Servers: []string{"nats://127.0.0.1:1"}},
+		{Name: "eu", Region: "eu", Servers: []string{"nats://127.0.0.1:2"}},
+	}, protonats.WithPreferredRegion("eu"))
+	require.NoError(t, err)
+	defer clusters.Close()
+
+	var names []string
+	for _, cl := range clusters.All() {
+		names = append(names, cl.Name)
+	}
+	assert.Equal(t, []string{"eu", "us"}, names)
+
+	_, err = clusters.Active()
+	assert.True(t, errors.Is(err, protonats.ErrNoClusterAvailable))
+
+	s, err := protonats.NewClusterSender(clusters, "orders")
+	require.NoError(t, err)
+
+	e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	err = s.Send(context.Background(), (*binding.EventMessage)(&e))
+	assert.True(t, errors.Is(err, protonats.ErrNoClusterAvailable))
+}
+
+// clusterSub subscribes to "orders" at server s
+func clusterSub(t *testing.T, s *server.Server) *nats.Subscription {
+	conn, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	t.Cleanup(conn.Close)
+
+	sub, err := conn.SubscribeSync("orders")
+	require.NoError(t, err)
+	require.NoError(t, conn.Flush())
+
+	return sub
+}
+
+// failSend fails every publish with err
+func failSend(err error) protonats.SenderOption {
+	return protonats.WithSendMiddleware(func(next protonats.SendHandler) protonats.SendHandler {
+		return func(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+			return err
+		}
+	})
+}
+
+func connectClusters(t *testing.T, primary, secondary protonats.ClusterConfig, opts ...protonats.ClusterOption) *protonats.Clusters {
+	clusters, err := protonats.ConnectClusters([]protonats.ClusterConfig{primary, secondary}, opts...)
+	require.NoError(t, err)
+	t.Cleanup(clusters.Close)
+
+	for _, cl := range clusters.All() {
+		require.NoError(t, cl.Conn.Flush())
+	}
+
+	return clusters
+}
+
+func TestClusterSenderFailover(t *testing.T) {
+	eu, us := startServer(t), startServer(t)
+	euSub, usSub := clusterSub(t, eu), clusterSub(t, us)
+
+	breaker := func(name string) *protonats.CircuitBreaker {
+		return protonats.NewCircuitBreaker(name, protonats.WithBreakerWindow(1), protonats.WithBreakerMinRequests(1),
+			protonats.WithBreakerOpenTimeout(time.Minute))
+	}
+	euBreaker, usBreaker := breaker("eu"), breaker("us")
+
+	clusters := connectClusters(t,
+		protonats.ClusterConfig{Name: "eu", Servers: []string{eu.ClientURL()},
+			SenderOptions: []protonats.SenderOption{protonats.WithCircuitBreaker(euBreaker), failSend(nats.ErrConnectionClosed)}},
+		protonats.ClusterConfig{Name: "us", Servers: []string{us.ClientURL()},
+			SenderOptions: []protonats.SenderOption{protonats.WithCircuitBreaker(usBreaker)}},
+	)
+
+	s, err := protonats.NewClusterSender(clusters, "orders")
+	require.NoError(t, err)
+
+	for _, id := range []string{"o1", "o2"} {
+		e := newEvent(t, "orders.created", orderCreated{ID: id})
+		require.NoError(t, s.Send(context.Background(), (*binding.EventMessage)(&e)))
+
+		_, err = usSub.NextMsg(time.Second)
+		require.NoError(t, err)
+	}
+
+	// the second publish fails over on open breaker of eu, breaker of us isn't affected
+	assert.Equal(t, protonats.BreakerOpen, euBreaker.State())
+	assert.Equal(t, protonats.BreakerClosed, usBreaker.State())
+
+	_, err = euSub.NextMsg(50 * time.Millisecond)
+	assert.True(t, errors.Is(err, nats.ErrTimeout), err)
+
+	// other errors don't fail over
+	errBoom := errors.New("boom")
+	clusters = connectClusters(t,
+		protonats.ClusterConfig{Name: "eu", Servers: []string{eu.ClientURL()}, SenderOptions: []protonats.SenderOption{failSend(errBoom)}},
+		protonats.ClusterConfig{Name: "us", Servers: []string{us.ClientURL()}},
+	)
+
+	s, err = protonats.NewClusterSender(clusters, "orders")
+	require.NoError(t, err)
+
+	e := newEvent(t, "orders.created", orderCreated{ID: "o3"})
+	assert.Equal(t, errBoom, s.Send(context.Background(), (*binding.EventMessage)(&e)))
+
+	_, err = usSub.NextMsg(50 * time.Millisecond)
+	assert.True(t, errors.Is(err, nats.ErrTimeout), err)
+}
+
+func TestClusterSenderDualWrite(t *testing.T) {
+	eu, us := startServer(t), startServer(t)
+	euSub, usSub := clusterSub(t, eu), clusterSub(t, us)
+
+	errBoom := errors.New("boom")
+
+	send := func(primary, secondary []protonats.SenderOption) error {
+		clusters := connectClusters(t,
+			protonats.ClusterConfig{Name: "eu", Servers: []string{eu.ClientURL()}, SenderOptions: primary},
+			protonats.ClusterConfig{Name: "us", Servers: []string{us.ClientURL()}, SenderOptions: secondary},
+			protonats.WithDualWrite(),
+		)
+
+		s, err := protonats.NewClusterSender(clusters, "orders")
+		require.NoError(t, err)
+
+		e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+		return s.Send(context.Background(), (*binding.EventMessage)(&e))
+	}
+
+	// both clusters get the event
+	require.NoError(t, send(nil, nil))
+	_, err := euSub.NextMsg(time.Second)
+	require.NoError(t, err)
+	_, err = usSub.NextMsg(time.Second)
+	require.NoError(t, err)
+
+	// failed secondary doesn't fail publish
+	require.NoError(t, send(nil, []protonats.SenderOption{failSend(errBoom)}))
+	_, err = euSub.NextMsg(time.Second)
+	require.NoError(t, err)
+
+	// result of primary is returned even though secondary got the event
+	assert.Equal(t, errBoom, send([]protonats.SenderOption{failSend(errBoom)}, nil))
+	_, err = usSub.NextMsg(time.Second)
+	require.NoError(t, err)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+)
+
+func bench(ctx context.Context, args []string) error {
+	var (
+		conn    connFlags
+		n       int
+		size    int
+		consume bool
+		buffer  int
+		timeout time.Duration
+	)
+
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	conn.register(fs)
+	fs.IntVar(&n, "n", 10000, "number of events")
+	fs.IntVar(&size, "size", 128, "event data size in bytes")
+	fs.BoolVar(&consume, "consume", true, "also consume published events and measure end-to-end throughput")
+	fs.IntVar(&buffer, "buffer", 65536, "consumer receive buffer size")
+	fs.DurationVar(&timeout, "timeout", time.Minute, "max time to wait for consumed events")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: protonats bench [flags] <nats subject>")
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("nats subject is required")
+	}
+
+	subject := fs.Arg(0)
+
+	nc, err := conn.connect()
+	if err != nil {
+		return err
+	}
+
+	defer nc.Close()
+
+	sender, err := protonats.NewSenderFromConn(nc, subject)
+	if err != nil {
+		return err
+	}
+
+	var (
+		received int64
+		done     = make(chan struct{})
+		errs     = make(chan error, 1)
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if consume {
+		c, err := protonats.NewConsumerFromConn(nc, subject, protonats.WithReceiveBuffer(buffer))
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			errs <- c.StartReceiver(ctx, func(ctx context.Context, e cloudevents.Event) protocol.Result {
+				if atomic.AddInt64(&received, 1) == int64(n) {
+					close(done)
+				}
+				return nil
+			})
+		}()
+
+		// subscription should be ready before publish
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	e := cloudevents.NewEvent()
+	e.SetSource("protonats-cli")
+	e.SetType("protonats.bench")
+
+	if err = e.SetData("application/octet-stream", make([]byte, size)); err != nil {
+		return err
+	}
+
+	start := time.Now()
+
+	for i := 0; i < n; i++ {
+		e.SetID(strconv.Itoa(i))
+
+		if err = sender.Send(ctx, (*binding.EventMessage)(&e)); err != nil {
+			return fmt.Errorf("send %d: %w", i, err)
+		}
+	}
+
+	if err = nc.Flush(); err != nil {
+		return err
+	}
+
+	report("publish", n, size, time.Since(start))
+
+	if !consume {
+		return nil
+	}
+
+	select {
+	case <-done:
+		report("end-to-end", n, size, time.Since(start))
+	case err = <-errs:
+		return err
+	case <-time.After(timeout):
+		fmt.Fprintf(os.Stderr, "timeout: received %d of %d\n", atomic.LoadInt64(&received), n)
+	case <-ctx.Done():
+	}
+
+	return nil
+}
+
+func report(name string, n, size int, d time.Duration) {
+	rate := float64(n) / d.Seconds()
+
+	fmt.Printf("%-10s %d events in %s: %.0f events/s, %.2f MB/s\n",
+		name, n, d.Round(time.Millisecond), rate, rate*float64(size)/(1<<20))
+}
@@ -0,0 +1,115 @@
+// Command protonats is a CloudEvents over NATS debugging tool built on protonats package
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/d7561985/tel"
+	"github.com/nats-io/nats.go"
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"publish": {usage: "build event from flags or file and send it", run: publish},
+	"tail":    {usage: "subscribe and pretty-print events with decoded trace context", run: tail},
+	"bench":   {usage: "measure publish and consume throughput", run: bench},
+	"replay":  {usage: "re-run events from JetStream by time range or sequence", run: replay},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// jaeger tracer is required for trace carrier decoding, spans are never reported
+	tracer, closer := jaeger.NewTracer("protonats-cli", jaeger.NewConstSampler(false), jaeger.NewNullReporter())
+	defer closer.Close()
+
+	opentracing.SetGlobalTracer(tracer)
+
+	t := tel.NewNull()
+
+	if err := cmd.run(t.WithContext(ctx), os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: protonats <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
+
+// connFlags common NATS connection flags
+type connFlags struct {
+	server string
+	creds  string
+}
+
+func (c *connFlags) register(fs *flag.FlagSet) {
+	server := os.Getenv("NATS_URL")
+	if server == "" {
+		server = nats.DefaultURL
+	}
+
+	fs.StringVar(&c.server, "server", server, "NATS server URL, NATS_URL env")
+	fs.StringVar(&c.creds, "creds", os.Getenv("NATS_CREDS"), "NATS credentials file, NATS_CREDS env")
+}
+
+func (c *connFlags) connect() (*nats.Conn, error) {
+	opts := []nats.Option{nats.Name("protonats-cli")}
+	if c.creds != "" {
+		opts = append(opts, nats.UserCredentials(c.creds))
+	}
+
+	return nats.Connect(c.server, opts...)
+}
+
+// listFlag repeatable or comma separated flag
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/d7561985/protonats"
+	"github.com/d7561985/tel"
+	"github.com/google/uuid"
+)
+
+func publish(ctx context.Context, args []string) error {
+	var (
+		conn        connFlags
+		file        string
+		id          string
+		typ         string
+		source      string
+		subject     string
+		contentType string
+		dataSchema  string
+		data        string
+		dataFile    string
+		exts        listFlag
+		trace       bool
+		count       int
+	)
+
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	conn.register(fs)
+	fs.StringVar(&file, "file", "", "structured JSON event file, '-' for stdin; flags override its attributes")
+	fs.StringVar(&id, "id", "", "event id, random uuid by default")
+	fs.StringVar(&typ, "type", "", "event type")
+	fs.StringVar(&source, "source", "protonats-cli", "event source")
+	fs.StringVar(&subject, "subject", "", "event subject attribute")
+	fs.StringVar(&contentType, "content-type", cloudevents.ApplicationJSON, "data content type")
+	fs.StringVar(&dataSchema, "schema", "", "data schema")
+	fs.StringVar(&data, "data", "", "event data")
+	fs.StringVar(&dataFile, "data-file", "", "event data file")
+	fs.Var(&exts, "ext", "extension key=value, repeatable or comma separated")
+	fs.BoolVar(&trace, "trace", false, "start span and put trace carrier into event")
+	fs.IntVar(&count, "count", 1, "number of events to send, each with own id")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: protonats publish [flags] <nats subject>")
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("nats subject is required")
+	}
+
+	e := cloudevents.NewEvent()
+
+	if file != "" {
+		raw, err := readFile(file)
+		if err != nil {
+			return err
+		}
+
+		if err = json.Unmarshal(raw, &e); err != nil {
+			return fmt.Errorf("decode event file: %w", err)
+		}
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if typ != "" {
+		e.SetType(typ)
+	}
+
+	if file == "" || set["source"] {
+		e.SetSource(source)
+	}
+
+	if subject != "" {
+		e.SetSubject(subject)
+	}
+
+	if dataSchema != "" {
+		e.SetDataSchema(dataSchema)
+	}
+
+	if dataFile != "" {
+		raw, err := readFile(dataFile)
+		if err != nil {
+			return err
+		}
+
+		data = string(raw)
+	}
+
+	if data != "" || dataFile != "" {
+		if err := setData(&e, contentType, []byte(data)); err != nil {
+			return err
+		}
+	}
+
+	for _, kv := range exts {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("extension %q: expected key=value", kv)
+		}
+
+		e.SetExtension(parts[0], parts[1])
+	}
+
+	nc, err := conn.connect()
+	if err != nil {
+		return err
+	}
+
+	defer nc.Close()
+
+	sender, err := protonats.NewSenderFromConn(nc, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < count; i++ {
+		switch {
+		case i == 0 && id != "":
+			e.SetID(id)
+		case i == 0 && e.ID() != "":
+			// id from file
+		default:
+			e.SetID(uuid.New().String())
+		}
+
+		if i > 0 || e.Time().IsZero() {
+			e.SetTime(time.Now())
+		}
+
+		if err = send(ctx, sender, e, trace); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "published %s %s to %s\n", e.Type(), e.ID(), fs.Arg(0))
+	}
+
+	return nc.Flush()
+}
+
+func send(ctx context.Context, sender *protonats.Sender, e cloudevents.Event, trace bool) error {
+	e = e.Clone()
+
+	if trace {
+		span, sctx := tel.StartSpanFromContext(ctx, "protonats-cli publish")
+		defer span.Finish()
+
+		ctx = sctx
+		protonats.InjectDistributedTracingExtension(ctx, &e)
+	}
+
+	if err := e.Validate(); err != nil {
+		return err
+	}
+
+	return sender.Send(ctx, (*binding.EventMessage)(&e))
+}
+
+// setData JSON data stays as is, other content types are set as raw bytes
+func setData(e *cloudevents.Event, contentType string, data []byte) error {
+	if contentType == cloudevents.ApplicationJSON {
+		if !json.Valid(data) {
+			return errors.New("data is not valid JSON, set -content-type")
+		}
+
+		return e.SetData(contentType, json.RawMessage(data))
+	}
+
+	return e.SetData(contentType, data)
+}
+
+func readFile(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+
+	return os.ReadFile(name)
+}
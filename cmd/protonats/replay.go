@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+)
+
+func replay(ctx context.Context, args []string) error {
+	var (
+		conn      connFlags
+		types     listFlag
+		stream    = ""
+		since     time.Duration
+		startTime string
+		startSeq  uint64
+		endTime   string
+		endSeq    uint64
+		rate      float64
+		dryRun    bool
+		to        string
+	)
+
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	conn.register(fs)
+	fs.StringVar(&stream, "stream", "", "stream name, looked up by subject when empty")
+	fs.DurationVar(&since, "since", 0, "start from now minus duration")
+	fs.StringVar(&startTime, "start-time", "", "start time, RFC3339")
+	fs.Uint64Var(&startSeq, "start-seq", 0, "start stream sequence")
+	fs.StringVar(&endTime, "end-time", "", "end time, RFC3339")
+	fs.Uint64Var(&endSeq, "end-seq", 0, "end stream sequence")
+	fs.Var(&types, "type", "event type pattern, repeatable or comma separated")
+	fs.Float64Var(&rate, "rate", 0, "max events per second, 0 is unlimited")
+	fs.BoolVar(&dryRun, "dry-run", false, "only print events")
+	fs.StringVar(&to, "to", "", "republish replayed events to subject, consumers re-handle them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: protonats replay [flags] <subject>")
+		fmt.Fprintln(fs.Output(), "events are printed or republished, consumer handlers are fed by Replay.Run inside the service")
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("subject is required")
+	}
+
+	if !dryRun && to == "" {
+		return errors.New("either -dry-run or -to is required")
+	}
+
+	if since > 0 && startTime != "" {
+		fs.Usage()
+		return errors.New("-since and -start-time are mutually exclusive")
+	}
+
+	opts := []protonats.ReplayOption{
+		protonats.WithReplayStream(stream),
+		protonats.WithReplayTypes(types...),
+		protonats.WithReplayRate(rate),
+		protonats.WithReplayEndSequence(endSeq),
+	}
+
+	if since > 0 {
+		opts = append(opts, protonats.WithReplayStartTime(time.Now().Add(-since)))
+	}
+
+	if startTime != "" {
+		t, err := time.Parse(time.RFC3339, startTime)
+		if err != nil {
+			return fmt.Errorf("start-time: %w", err)
+		}
+
+		opts = append(opts, protonats.WithReplayStartTime(t))
+	}
+
+	if startSeq > 0 {
+		opts = append(opts, protonats.WithReplayStartSequence(startSeq))
+	}
+
+	if endTime != "" {
+		t, err := time.Parse(time.RFC3339, endTime)
+		if err != nil {
+			return fmt.Errorf("end-time: %w", err)
+		}
+
+		opts = append(opts, protonats.WithReplayEndTime(t))
+	}
+
+	if dryRun {
+		opts = append(opts, protonats.WithReplayDryRun(os.Stdout))
+	}
+
+	nc, err := conn.connect()
+	if err != nil {
+		return err
+	}
+
+	defer nc.Close()
+
+	r, err := protonats.NewReplay(nc, fs.Arg(0), opts...)
+	if err != nil {
+		return err
+	}
+
+	var h protonats.Handler
+	if !dryRun {
+		s, err := protonats.NewSenderFromConn(nc, to)
+		if err != nil {
+			return err
+		}
+
+		h = func(ctx context.Context, e cloudevents.Event) protocol.Result {
+			return s.Send(ctx, (*binding.EventMessage)(&e))
+		}
+	}
+
+	stats, err := r.Run(ctx, h)
+
+	fmt.Fprintf(os.Stderr, "processed: %d skipped: %d failed: %d malformed: %d last sequence: %d\n",
+		stats.Processed, stats.Skipped, stats.Failed, stats.Malformed, stats.LastSequence)
+
+	if err != nil {
+		return err
+	}
+
+	return nc.Flush()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/extensions"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/uber/jaeger-client-go"
+)
+
+func tail(ctx context.Context, args []string) error {
+	var (
+		conn   connFlags
+		queue  string
+		types  listFlag
+		raw    bool
+		buffer int
+	)
+
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	conn.register(fs)
+	fs.StringVar(&queue, "queue", "", "join queue group")
+	fs.Var(&types, "type", "print only event types matching pattern, repeatable or comma separated")
+	fs.BoolVar(&raw, "raw", false, "print data as is without JSON indentation")
+	fs.IntVar(&buffer, "buffer", 4096, "receive buffer size")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: protonats tail [flags] <nats subject>")
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("nats subject is required")
+	}
+
+	nc, err := conn.connect()
+	if err != nil {
+		return err
+	}
+
+	defer nc.Close()
+
+	opts := []protonats.ConsumerOption{protonats.WithReceiveBuffer(buffer)}
+	if queue != "" {
+		opts = append(opts, protonats.WithQueueSubscriber(queue))
+	}
+
+	c, err := protonats.NewConsumerFromConn(nc, fs.Arg(0), opts...)
+	if err != nil {
+		return err
+	}
+
+	var mx sync.Mutex
+
+	return c.StartReceiver(ctx, func(ctx context.Context, e cloudevents.Event) protocol.Result {
+		if !matchAny(types, e.Type()) {
+			return nil
+		}
+
+		mx.Lock()
+		defer mx.Unlock()
+
+		printEvent(ctx, os.Stdout, e, raw)
+
+		return nil
+	})
+}
+
+func printEvent(ctx context.Context, w io.Writer, e cloudevents.Event, raw bool) {
+	fmt.Fprintf(w, "--- %s %s\n", e.Type(), e.ID())
+	fmt.Fprintf(w, "  source:          %s\n", e.Source())
+	fmt.Fprintf(w, "  specversion:     %s\n", e.SpecVersion())
+
+	if !e.Time().IsZero() {
+		fmt.Fprintf(w, "  time:            %s (%s ago)\n", e.Time().Format(time.RFC3339Nano), time.Since(e.Time()).Round(time.Millisecond))
+	}
+
+	if v := e.Subject(); v != "" {
+		fmt.Fprintf(w, "  subject:         %s\n", v)
+	}
+
+	if v := e.DataContentType(); v != "" {
+		fmt.Fprintf(w, "  datacontenttype: %s\n", v)
+	}
+
+	if v := e.DataSchema(); v != "" {
+		fmt.Fprintf(w, "  dataschema:      %s\n", v)
+	}
+
+	keys := make([]string, 0, len(e.Extensions()))
+	for k := range e.Extensions() {
+		if k != extensions.TraceStateExtension {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	if len(keys) > 0 {
+		fmt.Fprintln(w, "  extensions:")
+
+		for _, k := range keys {
+			fmt.Fprintf(w, "    %s: %v\n", k, e.Extensions()[k])
+		}
+	}
+
+	if _, ok := e.Extensions()[extensions.TraceStateExtension]; ok {
+		fmt.Fprintf(w, "  trace:           %s\n", traceString(ctx, e))
+	}
+
+	if len(e.Data()) > 0 {
+		fmt.Fprintln(w, "  data:")
+		fmt.Fprintln(w, dataString(e, raw))
+	}
+}
+
+func traceString(ctx context.Context, e cloudevents.Event) string {
+	spanCtx, err := protonats.ExtractDistributedTracingExtension(ctx, &e)
+	if err != nil {
+		return "undecodable: " + err.Error()
+	}
+
+	sc, ok := spanCtx.(jaeger.SpanContext)
+	if !ok {
+		return fmt.Sprintf("%v", spanCtx)
+	}
+
+	return fmt.Sprintf("trace_id=%s span_id=%s parent_id=%s sampled=%t",
+		sc.TraceID(), sc.SpanID(), sc.ParentID(), sc.IsSampled())
+}
+
+func dataString(e cloudevents.Event, raw bool) string {
+	switch e.DataMediaType() {
+	case "", cloudevents.ApplicationJSON, "text/json":
+		if raw {
+			return string(e.Data())
+		}
+
+		buf := bytes.NewBuffer(nil)
+		if err := json.Indent(buf, e.Data(), "    ", "  "); err != nil {
+			return string(e.Data())
+		}
+
+		return "    " + buf.String()
+	case protonats.ApplicationProtobuf, protonats.ApplicationXProtobuf, protonats.ApplicationAvro:
+		if v, err := protonats.DecodeData(e); err == nil {
+			return fmt.Sprintf("    %+v", v)
+		}
+
+		return fmt.Sprintf("    %d bytes of %s, type %q is not registered", len(e.Data()), e.DataMediaType(), e.DataSchema())
+	}
+
+	if bytes.HasPrefix([]byte(e.DataMediaType()), []byte("text/")) {
+		return "    " + string(e.Data())
+	}
+
+	return fmt.Sprintf("    %d bytes of %s", len(e.Data()), e.DataMediaType())
+}
+
+func matchAny(patterns []string, typ string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, typ); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,258 @@
+package protonats
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/event/datacodec"
+	"github.com/hamba/avro"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const (
+	ApplicationProtobuf  = "application/protobuf"
+	ApplicationXProtobuf = "application/x-protobuf"
+	ApplicationAvro      = "application/avro"
+
+	// ProtoSchemaPrefix dataschema prefix followed by protobuf message full name, e.g. proto:orders.v1.OrderCreated
+	ProtoSchemaPrefix = "proto:"
+	// AvroSchemaPrefix dataschema prefix followed by avro named schema full name or schema fingerprint
+	AvroSchemaPrefix = "avro:"
+)
+
+var (
+	ErrNotProtoMessage     = errors.New("value is not proto.Message")
+	ErrAvroTypeUnknown     = errors.New("avro schema is not registered for type")
+	ErrDataSchemaUnknown   = errors.New("data schema is not registered")
+	ErrDataSchemaEmpty     = errors.New("event has no data schema")
+	ErrDataTypeUnsupported = errors.New("data content type is not supported for automatic decoding")
+)
+
+// init registers codecs inside cloudevents datacodec, which is global: Event.SetData encodes and Event.DataAs decodes
+// with them, so Sender, Consumer and cloudevents client need no codec options
+func init() {
+	for _, ct := range []string{ApplicationProtobuf, ApplicationXProtobuf} {
+		datacodec.AddEncoder(ct, EncodeProtobuf)
+		datacodec.AddDecoder(ct, DecodeProtobuf)
+	}
+
+	datacodec.AddEncoder(ApplicationAvro, EncodeAvro)
+	datacodec.AddDecoder(ApplicationAvro, DecodeAvro)
+}
+
+// dataTypes keeps relation between dataschema and go types
+// it allows receiver side decode event data without knowing concrete type in advance
+type dataTypes struct {
+	mx sync.RWMutex
+
+	// schema => go type
+	bySchema map[string]reflect.Type
+	// go type => avro schema
+	avro map[reflect.Type]avro.Schema
+}
+
+var registry = &dataTypes{
+	bySchema: make(map[string]reflect.Type),
+	avro:     make(map[reflect.Type]avro.Schema),
+}
+
+// RegisterProtoType registers protobuf message type for automatic decoding and returns its dataschema.
+// Registration is optional for messages linked into global protobuf registry.
+func RegisterProtoType(m proto.Message) string {
+	schema := protoSchema(m)
+
+	registry.mx.Lock()
+	defer registry.mx.Unlock()
+
+	registry.bySchema[schema] = reflect.TypeOf(m)
+
+	return schema
+}
+
+// RegisterAvroType registers go type of v with avro schema and returns its dataschema.
+// Registration is required as avro payload could not be handled without schema.
+func RegisterAvroType(v interface{}, schema string) (string, error) {
+	s, err := avro.Parse(schema)
+	if err != nil {
+		return "", fmt.Errorf("avro parse schema: %w", err)
+	}
+
+	t := reflect.TypeOf(v)
+	dataSchema := avroSchema(s)
+
+	registry.mx.Lock()
+	defer registry.mx.Unlock()
+
+	registry.avro[elemType(t)] = s
+	registry.bySchema[dataSchema] = t
+
+	return dataSchema, nil
+}
+
+// SetProtoData encodes m as event data with protobuf content type and message type inside dataschema
+func SetProtoData(e *cloudevents.Event, m proto.Message) error {
+	e.SetDataSchema(protoSchema(m))
+	return e.SetData(ApplicationProtobuf, m)
+}
+
+// SetAvroData encodes v as event data with avro content type, v type should be registered with RegisterAvroType
+func SetAvroData(e *cloudevents.Event, v interface{}) error {
+	s, err := avroSchemaOf(v)
+	if err != nil {
+		return err
+	}
+
+	e.SetDataSchema(avroSchema(s))
+	return e.SetData(ApplicationAvro, v)
+}
+
+// SetEventData negotiates content type by v:
+// proto.Message uses protobuf, registered avro types use avro and everything else goes as JSON
+func SetEventData(e *cloudevents.Event, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return SetProtoData(e, m)
+	}
+
+	if _, err := avroSchemaOf(v); err == nil {
+		return SetAvroData(e, v)
+	}
+
+	return e.SetData(cloudevents.ApplicationJSON, v)
+}
+
+// DecodeData decodes event data into new instance of go type registered for event dataschema.
+// Protobuf messages known by global protobuf registry are resolved without registration.
+func DecodeData(e cloudevents.Event) (interface{}, error) {
+	schema := e.DataSchema()
+	if schema == "" {
+		return nil, ErrDataSchemaEmpty
+	}
+
+	switch ct := e.DataMediaType(); ct {
+	case ApplicationProtobuf, ApplicationXProtobuf, ApplicationAvro:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrDataTypeUnsupported, ct)
+	}
+
+	v, err := newOf(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = e.DataAs(v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// EncodeProtobuf implements datacodec.Encoder for protobuf content
+func EncodeProtobuf(_ context.Context, in interface{}) ([]byte, error) {
+	m, ok := in.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrNotProtoMessage, in)
+	}
+
+	return proto.Marshal(m)
+}
+
+// DecodeProtobuf implements datacodec.Decoder for protobuf content
+func DecodeProtobuf(_ context.Context, in []byte, out interface{}) error {
+	m, ok := out.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrNotProtoMessage, out)
+	}
+
+	return proto.Unmarshal(in, m)
+}
+
+// EncodeAvro implements datacodec.Encoder for avro content
+func EncodeAvro(_ context.Context, in interface{}) ([]byte, error) {
+	s, err := avroSchemaOf(in)
+	if err != nil {
+		return nil, err
+	}
+
+	return avro.Marshal(s, in)
+}
+
+// DecodeAvro implements datacodec.Decoder for avro content
+func DecodeAvro(_ context.Context, in []byte, out interface{}) error {
+	s, err := avroSchemaOf(out)
+	if err != nil {
+		return err
+	}
+
+	return avro.Unmarshal(s, in, out)
+}
+
+// avroSchemaOf looks up schema by type of v, pointer and value types both are accepted whichever was registered,
+// e.g. **T of DataAs into *T variable
+func avroSchemaOf(v interface{}) (avro.Schema, error) {
+	t := reflect.TypeOf(v)
+
+	registry.mx.RLock()
+	defer registry.mx.RUnlock()
+
+	if s, ok := registry.avro[elemType(t)]; ok {
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("%w: %v", ErrAvroTypeUnknown, t)
+}
+
+// elemType strips pointers of t
+func elemType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t
+}
+
+// newOf creates pointer to new value of type registered for schema
+func newOf(schema string) (interface{}, error) {
+	registry.mx.RLock()
+	t, ok := registry.bySchema[schema]
+	registry.mx.RUnlock()
+
+	if ok {
+		if t.Kind() == reflect.Ptr {
+			return reflect.New(t.Elem()).Interface(), nil
+		}
+
+		return reflect.New(t).Interface(), nil
+	}
+
+	if strings.HasPrefix(schema, ProtoSchemaPrefix) {
+		name := protoreflect.FullName(strings.TrimPrefix(schema, ProtoSchemaPrefix))
+
+		mt, err := protoregistry.GlobalTypes.FindMessageByName(name)
+		if err == nil {
+			return mt.New().Interface(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrDataSchemaUnknown, schema)
+}
+
+func protoSchema(m proto.Message) string {
+	return ProtoSchemaPrefix + string(m.ProtoReflect().Descriptor().FullName())
+}
+
+func avroSchema(s avro.Schema) string {
+	if n, ok := s.(avro.NamedSchema); ok {
+		return AvroSchemaPrefix + n.FullName()
+	}
+
+	f := s.Fingerprint()
+	return AvroSchemaPrefix + hex.EncodeToString(f[:])
+}
@@ -0,0 +1,122 @@
+package protonats_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/d7561985/protonats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type avroOrder struct {
+	ID    string `avro:"id"`
+	Total int64  `avro:"total"`
+}
+
+const avroOrderSchema = `{
+	"type": "record",
+	"name": "OrderCreated",
+	"namespace": "orders.v1",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "total", "type": "long"}
+	]
+}`
+
+// transfer emulates wire round trip of structured event
+func transfer(t *testing.T, e cloudevents.Event) cloudevents.Event {
+	data, err := json.Marshal(e)
+	require.NoError(t, err)
+
+	res := cloudevents.NewEvent()
+	require.NoError(t, json.Unmarshal(data, &res))
+
+	return res
+}
+
+func TestProtobufData(t *testing.T) {
+	e := cloudevents.NewEvent()
+	e.SetID("1")
+	e.SetType("orders.created")
+	e.SetSource("test")
+	require.NoError(t, protonats.SetEventData(&e, wrapperspb.String("hello")))
+
+	assert.Equal(t, protonats.ApplicationProtobuf, e.DataContentType())
+	assert.Equal(t, "proto:google.protobuf.StringValue", e.DataSchema())
+
+	got := transfer(t, e)
+
+	out := &wrapperspb.StringValue{}
+	require.NoError(t, got.DataAs(out))
+	assert.Equal(t, "hello", out.GetValue())
+
+	v, err := protonats.DecodeData(got)
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(wrapperspb.String("hello"), v.(proto.Message)))
+}
+
+func TestAvroData(t *testing.T) {
+	schema, err := protonats.RegisterAvroType(avroOrder{}, avroOrderSchema)
+	require.NoError(t, err)
+	assert.Equal(t, "avro:orders.v1.OrderCreated", schema)
+
+	e := cloudevents.NewEvent()
+	e.SetID("1")
+	e.SetType("orders.created")
+	e.SetSource("test")
+	require.NoError(t, protonats.SetEventData(&e, &avroOrder{ID: "A-1", Total: 42}))
+
+	assert.Equal(t, protonats.ApplicationAvro, e.DataContentType())
+
+	got := transfer(t, e)
+
+	v, err := protonats.DecodeData(got)
+	require.NoError(t, err)
+	assert.Equal(t, &avroOrder{ID: "A-1", Total: 42}, v)
+}
+
+func TestDecodeDataUnknownSchema(t *testing.T) {
+	e := cloudevents.NewEvent()
+	e.SetDataSchema("proto:unknown.Message")
+	require.NoError(t, e.SetData(protonats.ApplicationProtobuf, wrapperspb.String("x")))
+
+	_, err := protonats.DecodeData(e)
+	assert.ErrorIs(t, err, protonats.ErrDataSchemaUnknown)
+}
+
+func TestAvroDataPointerTypes(t *testing.T) {
+	type avroPayment struct {
+		ID string `avro:"id"`
+	}
+
+	const paymentSchema = `{"type":"record","name":"PaymentCreated","namespace":"payments.v1","fields":[{"name":"id","type":"string"}]}`
+
+	// registered as pointer, sent as value
+	_, err := protonats.RegisterAvroType(&avroPayment{}, paymentSchema)
+	require.NoError(t, err)
+
+	e := cloudevents.NewEvent()
+	e.SetID("1")
+	e.SetType("payments.created")
+	e.SetSource("test")
+	require.NoError(t, protonats.SetAvroData(&e, avroPayment{ID: "P-1"}))
+
+	got := transfer(t, e)
+
+	var value avroPayment
+	require.NoError(t, got.DataAs(&value))
+	assert.Equal(t, "P-1", value.ID)
+
+	// registered as value, decoded into pointer variable
+	_, err = protonats.RegisterAvroType(avroOrder{}, avroOrderSchema)
+	require.NoError(t, err)
+	require.NoError(t, protonats.SetAvroData(&e, &avroOrder{ID: "A-2", Total: 7}))
+
+	var ptr *avroOrder
+	require.NoError(t, transfer(t, e).DataAs(&ptr))
+	assert.Equal(t, &avroOrder{ID: "A-2", Total: 7}, ptr)
+}
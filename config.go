@@ -0,0 +1,488 @@
+package protonats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d7561985/tel"
+	"github.com/d7561985/tel/monitoring/metrics"
+	"github.com/nats-io/nats.go"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	envURL            = "NATS_URL"
+	envName           = "NATS_NAME"
+	envCreds          = "NATS_CREDS"
+	envNKey           = "NATS_NKEY"
+	envToken          = "NATS_TOKEN"
+	envTLSCert        = "NATS_TLS_CERT"
+	envTLSKey         = "NATS_TLS_KEY"
+	envTLSCA          = "NATS_TLS_CA"
+	envSendSubject    = "NATS_SEND_SUBJECT"
+	envReceiveSubject = "NATS_RECEIVE_SUBJECT"
+	envQueue          = "NATS_QUEUE"
+	envQueueSubjects  = "NATS_QUEUE_SUBJECTS"
+	envReceiveBuffer  = "NATS_RECEIVE_BUFFER"
+	envConcurrency    = "NATS_CONCURRENCY"
+	envDeadLetter     = "NATS_DEAD_LETTER"
+	envJetStream      = "NATS_JETSTREAM"
+	envJSDurable      = "NATS_JETSTREAM_DURABLE"
+	envJSDeliver      = "NATS_JETSTREAM_DELIVER"
+	envJSAckWait      = "NATS_JETSTREAM_ACK_WAIT"
+	envJSMaxDeliver   = "NATS_JETSTREAM_MAX_DELIVER"
+	envObservability  = "NATS_OBSERVABILITY"
+	envTenantMetrics  = "NATS_TENANT_METRICS"
+)
+
+// JetStream deliver policies of JetStreamConfig
+const (
+	DeliverAll  = "all"
+	DeliverNew  = "new"
+	DeliverLast = "last"
+)
+
+var ErrInvalidConfig = errors.New("invalid protonats config")
+
+// Config declarative Protocol configuration, see LoadConfig and NewProtocolFromConfig
+type Config struct {
+	URL   string `json:"url" yaml:"url"`
+	Name  string `json:"name" yaml:"name"`
+	Creds string `json:"creds" yaml:"creds"`
+	// NKey user seed file
+	NKey  string    `json:"nkey" yaml:"nkey"`
+	Token string    `json:"token" yaml:"token"`
+	TLS   TLSConfig `json:"tls" yaml:"tls"`
+
+	SendSubject    string `json:"send_subject" yaml:"send_subject"`
+	ReceiveSubject string `json:"receive_subject" yaml:"receive_subject"`
+
+	// Queue group of receive subject, with QueueSubjects consumer subscribes to every of them
+	Queue         string   `json:"queue" yaml:"queue"`
+	QueueSubjects []string `json:"queue_subjects" yaml:"queue_subjects"`
+
+	ReceiveBuffer int    `json:"receive_buffer" yaml:"receive_buffer"`
+	Concurrency   int    `json:"concurrency" yaml:"concurrency"`
+	DeadLetter    string `json:"dead_letter" yaml:"dead_letter"`
+
+	JetStream     JetStreamConfig     `json:"jetstream" yaml:"jetstream"`
+	Observability ObservabilityConfig `json:"observability" yaml:"observability"`
+
+	// malformed environment values reported by Validate
+	envErrs []string
+}
+
+// TLSConfig client certificate and CA files
+type TLSConfig struct {
+	Cert string `json:"cert" yaml:"cert"`
+	Key  string `json:"key" yaml:"key"`
+	CA   string `json:"ca" yaml:"ca"`
+}
+
+// JetStreamConfig JetStream push subscription of receive subject
+type JetStreamConfig struct {
+	Enabled    bool     `json:"enabled" yaml:"enabled"`
+	Durable    string   `json:"durable" yaml:"durable"`
+	Deliver    string   `json:"deliver" yaml:"deliver"`
+	AckWait    Duration `json:"ack_wait" yaml:"ack_wait"`
+	MaxDeliver int      `json:"max_deliver" yaml:"max_deliver"`
+}
+
+// ObservabilityConfig wires TeleObservability of context telemetry into Consumer and Sender middlewares
+type ObservabilityConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// TenantMetrics uses NewTenantMetricsReader instead of tel reader metrics
+	TenantMetrics bool `json:"tenant_metrics" yaml:"tenant_metrics"`
+}
+
+// Duration is time.Duration written as "30s" in config files
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+func DefaultConfig() Config {
+	return Config{
+		URL:       nats.DefaultURL,
+		JetStream: JetStreamConfig{Deliver: DeliverAll},
+	}
+}
+
+// GetConfigFromEnv uses DefaultConfig and overwrite only variables present in env.
+// Malformed values are reported by Validate.
+func GetConfigFromEnv() Config {
+	c := DefaultConfig()
+	c.readEnv()
+
+	return c
+}
+
+// LoadConfig reads YAML or JSON file by its extension over DefaultConfig, then variables present in env
+// overwrite file values. Unknown file fields are errors.
+func LoadConfig(path string) (Config, error) {
+	c := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("%w: %s", ErrInvalidConfig, err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&c)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&c)
+	default:
+		err = fmt.Errorf("unsupported config file extension %q", ext)
+	}
+
+	if err != nil {
+		return c, fmt.Errorf("%w: %s: %s", ErrInvalidConfig, path, err)
+	}
+
+	c.readEnv()
+
+	return c, c.Validate()
+}
+
+// Validate reports every problem of config at once
+func (c Config) Validate() error {
+	problems := append([]string{}, c.envErrs...)
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.URL == "" {
+		add("url is required")
+	}
+
+	if c.ReceiveSubject == "" && len(c.QueueSubjects) == 0 {
+		add("receive_subject or queue_subjects is required")
+	}
+
+	if len(c.QueueSubjects) > 0 && c.Queue == "" {
+		add("queue_subjects require queue")
+	}
+
+	if len(c.QueueSubjects) > 0 && c.JetStream.Enabled {
+		add("queue_subjects aren't supported with jetstream")
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		add("tls cert and key should be set together")
+	}
+
+	n := 0
+	for _, v := range []string{c.Creds, c.NKey, c.Token} {
+		if v != "" {
+			n++
+		}
+	}
+
+	if n > 1 {
+		add("only one of creds, nkey and token can be set")
+	}
+
+	for _, file := range []string{c.Creds, c.NKey, c.TLS.Cert, c.TLS.Key, c.TLS.CA} {
+		if file == "" {
+			continue
+		}
+
+		if _, err := os.Stat(file); err != nil {
+			add("%s", err)
+		}
+	}
+
+	if c.ReceiveBuffer < 0 {
+		add("receive_buffer should not be negative")
+	}
+
+	if c.Concurrency < 0 {
+		add("concurrency should not be negative")
+	}
+
+	switch c.JetStream.Deliver {
+	case "", DeliverAll, DeliverNew, DeliverLast:
+	default:
+		add("jetstream deliver should be one of all, new, last: got %q", c.JetStream.Deliver)
+	}
+
+	if c.JetStream.AckWait < 0 {
+		add("jetstream ack_wait should not be negative")
+	}
+
+	if c.JetStream.MaxDeliver < -1 {
+		add("jetstream max_deliver should be -1 (unlimited) or more")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Auth typed authentication of config
+func (c Config) Auth() (*Auth, error) {
+	var opts []AuthOption
+
+	if c.TLS.Cert != "" || c.TLS.CA != "" {
+		opts = append(opts, WithTLSAuth(c.TLS.Cert, c.TLS.Key, c.TLS.CA))
+	}
+
+	switch {
+	case c.Creds != "":
+		opts = append(opts, WithCredsAuth(c.Creds))
+	case c.NKey != "":
+		opts = append(opts, WithNKeyAuth(c.NKey))
+	case c.Token != "":
+		opts = append(opts, WithTokenAuth(c.Token))
+	}
+
+	return NewAuth(opts...)
+}
+
+// NatsOptions connection options of config, auth files are validated
+func (c Config) NatsOptions() ([]nats.Option, error) {
+	opts, _, err := c.natsOptions()
+	return opts, err
+}
+
+// natsOptions connection options and auth they are built of, protocol keeps auth for Health
+func (c Config) natsOptions() ([]nats.Option, *Auth, error) {
+	var opts []nats.Option
+
+	if c.Name != "" {
+		opts = append(opts, nats.Name(c.Name))
+	}
+
+	auth, err := c.Auth()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(opts, auth.Options()...), auth, nil
+}
+
+// ProtocolOptions consumer and sender options of config, observability uses telemetry of ctx
+func (c Config) ProtocolOptions(ctx context.Context) []ProtocolOption {
+	var consumer []ConsumerOption
+	var sender []SenderOption
+
+	switch {
+	case len(c.QueueSubjects) > 0:
+		consumer = append(consumer, WithQueuePoolSubscriber(c.Queue, c.QueueSubjects...))
+	case c.JetStream.Enabled:
+		consumer = append(consumer, WithJetStreamSubscriber(c.Queue, c.JetStream.subOptions()...))
+	case c.Queue != "":
+		consumer = append(consumer, WithQueueSubscriber(c.Queue))
+	}
+
+	consumer = append(consumer, WithReceiveBuffer(c.ReceiveBuffer), WithConcurrency(c.Concurrency))
+
+	if c.DeadLetter != "" {
+		consumer = append(consumer, WithDeadLetter(c.DeadLetter))
+	}
+
+	if c.Observability.Enabled {
+		obs := NewTeleObservability(tel.FromCtx(ctx), c.Observability.readerMetrics()).(*TeleObservability)
+
+		consumer = append(consumer, WithObservability(obs))
+		sender = append(sender, WithSendMiddleware(obs.SendMiddleware()))
+	}
+
+	return []ProtocolOption{AppendConsumerOptions(consumer...), AppendSenderOptions(sender...)}
+}
+
+// NewProtocolFromConfig validates config and connects protocol, opts are applied after config ones.
+// Use AppendConsumerOptions and AppendSenderOptions to extend config options, With* variants replace them.
+func NewProtocolFromConfig(ctx context.Context, c Config, opts ...ProtocolOption) (*Protocol, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	receive := c.ReceiveSubject
+	if receive == "" {
+		receive = c.QueueSubjects[0]
+	}
+
+	natsOpts, auth, err := c.natsOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := NewProtocol(c.URL, c.SendSubject, receive, natsOpts, append(c.ProtocolOptions(ctx), opts...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	p.auth = auth
+
+	return p, nil
+}
+
+func (j JetStreamConfig) subOptions() []nats.SubOpt {
+	var opts []nats.SubOpt
+
+	if j.Durable != "" {
+		opts = append(opts, nats.Durable(j.Durable))
+	}
+
+	switch j.Deliver {
+	case DeliverNew:
+		opts = append(opts, nats.DeliverNew())
+	case DeliverLast:
+		opts = append(opts, nats.DeliverLast())
+	default:
+		opts = append(opts, nats.DeliverAll())
+	}
+
+	if j.AckWait > 0 {
+		opts = append(opts, nats.AckWait(time.Duration(j.AckWait)))
+	}
+
+	if j.MaxDeliver != 0 {
+		opts = append(opts, nats.MaxDeliver(j.MaxDeliver))
+	}
+
+	return opts
+}
+
+var (
+	configReaderOnce sync.Once
+	configReader     metrics.MetricsReader
+	configTenantOnce sync.Once
+	configTenant     TenantMetricsReader
+)
+
+// readerMetrics collectors are registered globally, so every config protocol shares them
+func (o ObservabilityConfig) readerMetrics() metrics.MetricsReader {
+	if o.TenantMetrics {
+		configTenantOnce.Do(func() { configTenant = NewTenantMetricsReader() })
+		return configTenant
+	}
+
+	configReaderOnce.Do(func() { configReader = metrics.NewCollectorMetricsReader() })
+	return configReader
+}
+
+func (c *Config) readEnv() {
+	str(envURL, &c.URL)
+	str(envName, &c.Name)
+	str(envCreds, &c.Creds)
+	str(envNKey, &c.NKey)
+	str(envToken, &c.Token)
+	str(envTLSCert, &c.TLS.Cert)
+	str(envTLSKey, &c.TLS.Key)
+	str(envTLSCA, &c.TLS.CA)
+	str(envSendSubject, &c.SendSubject)
+	str(envReceiveSubject, &c.ReceiveSubject)
+	str(envQueue, &c.Queue)
+	strList(envQueueSubjects, &c.QueueSubjects)
+	str(envDeadLetter, &c.DeadLetter)
+	str(envJSDurable, &c.JetStream.Durable)
+	str(envJSDeliver, &c.JetStream.Deliver)
+
+	c.envErrs = nil
+	for _, err := range []error{
+		integer(envReceiveBuffer, &c.ReceiveBuffer),
+		integer(envConcurrency, &c.Concurrency),
+		integer(envJSMaxDeliver, &c.JetStream.MaxDeliver),
+		dur(envJSAckWait, &c.JetStream.AckWait),
+		bl(envJetStream, &c.JetStream.Enabled),
+		bl(envObservability, &c.Observability.Enabled),
+		bl(envTenantMetrics, &c.Observability.TenantMetrics),
+	} {
+		if err != nil {
+			c.envErrs = append(c.envErrs, err.Error())
+		}
+	}
+}
+
+func str(env string, v *string) {
+	if val, ok := os.LookupEnv(env); ok {
+		*v = val
+	}
+}
+
+// list comma separated values
+func strList(env string, v *[]string) {
+	val, ok := os.LookupEnv(env)
+	if !ok {
+		return
+	}
+
+	*v = nil
+	for _, s := range strings.Split(val, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*v = append(*v, s)
+		}
+	}
+}
+
+func integer(env string, v *int) error {
+	val, ok := os.LookupEnv(env)
+	if !ok {
+		return nil
+	}
+
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return fmt.Errorf("%s: %q isn't integer", env, val)
+	}
+
+	*v = i
+	return nil
+}
+
+func dur(env string, v *Duration) error {
+	val, ok := os.LookupEnv(env)
+	if !ok {
+		return nil
+	}
+
+	if err := v.UnmarshalText([]byte(val)); err != nil {
+		return fmt.Errorf("%s: %q isn't duration", env, val)
+	}
+
+	return nil
+}
+
+func bl(env string, v *bool) error {
+	val, ok := os.LookupEnv(env)
+	if !ok {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return fmt.Errorf("%s: %q isn't boolean", env, val)
+	}
+
+	*v = b
+	return nil
+}
@@ -0,0 +1,70 @@
+package protonats_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/d7561985/protonats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, "nats.yaml", `
+url: nats://nats:4222
+send_subject: orders
+receive_subject: orders.commands
+queue: orders-api
+jetstream:
+  enabled: true
+  durable: orders-api
+  ack_wait: 30s
+`)
+
+	t.Setenv("NATS_URL", "nats://override:4222")
+	t.Setenv("NATS_JETSTREAM_MAX_DELIVER", "5")
+
+	c, err := protonats.LoadConfig(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "nats://override:4222", c.URL)
+	assert.Equal(t, "orders.commands", c.ReceiveSubject)
+	assert.Equal(t, protonats.Duration(30*time.Second), c.JetStream.AckWait)
+	assert.Equal(t, 5, c.JetStream.MaxDeliver)
+	assert.Equal(t, protonats.DeliverAll, c.JetStream.Deliver)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	_, err := protonats.LoadConfig(writeConfig(t, "nats.json", `{"url": "nats://nats:4222", "recieve_subject": "typo"}`))
+	assert.True(t, errors.Is(err, protonats.ErrInvalidConfig))
+
+	t.Setenv("NATS_CONCURRENCY", "many")
+
+	path := writeConfig(t, "nats.yml", `
+queue_subjects: [a, b]
+tls:
+  cert: missing.pem
+jetstream:
+  enabled: true
+  deliver: sometimes
+`)
+
+	_, err = protonats.LoadConfig(path)
+	require.True(t, errors.Is(err, protonats.ErrInvalidConfig))
+
+	// every problem is reported
+	for _, problem := range []string{"NATS_CONCURRENCY", "require queue", "jetstream", "cert and key", "missing.pem", "sometimes"} {
+		assert.True(t, strings.Contains(err.Error(), problem), problem)
+	}
+}
@@ -0,0 +1,147 @@
+package protonats
+
+import (
+	"context"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/binding/spec"
+	"github.com/cloudevents/sdk-go/v2/binding/transformer"
+	"github.com/opentracing/opentracing-go"
+)
+
+// CloudEvents extensions which tie related events together:
+// correlation id is shared by the whole chain, causation id is id of the event which caused this one
+const (
+	CorrelationIDExtension = "correlationid"
+	CausationIDExtension   = "causationid"
+)
+
+// span attributes of correlation extensions
+const (
+	CorrelationIDAttr = "cloudevents.correlationid"
+	CausationIDAttr   = "cloudevents.causationid"
+)
+
+// Correlation ids of the event chain
+type Correlation struct {
+	CorrelationID string
+	CausationID   string
+}
+
+type correlationKey struct{}
+
+// WithCorrelation puts correlation into context, Sender sets it to events which don't have own extensions
+func WithCorrelation(ctx context.Context, c Correlation) context.Context {
+	return context.WithValue(ctx, correlationKey{}, c)
+}
+
+// CorrelationFrom returns correlation put by WithCorrelation or WithCausingEvent
+func CorrelationFrom(ctx context.Context) Correlation {
+	c, _ := ctx.Value(correlationKey{}).(Correlation)
+	return c
+}
+
+// WithCausingEvent makes events sent with ctx caused by e: they inherit its correlation id
+// (or its id when e starts the chain) and get e id as causation id.
+// Consumer and TeleObservability.RecordCallingInvoker do it for the handled event.
+func WithCausingEvent(ctx context.Context, e cloudevents.Event) context.Context {
+	c := EventCorrelation(e)
+	if c.CorrelationID == "" {
+		c.CorrelationID = e.ID()
+	}
+
+	c.CausationID = e.ID()
+
+	return WithCorrelation(ctx, c)
+}
+
+// EventCorrelation reads correlation extensions of e
+func EventCorrelation(e cloudevents.Event) Correlation {
+	return Correlation{
+		CorrelationID: stringExtension(e, CorrelationIDExtension),
+		CausationID:   stringExtension(e, CausationIDExtension),
+	}
+}
+
+// SetCorrelation sets not empty ids which e doesn't have yet
+func SetCorrelation(e *cloudevents.Event, c Correlation) {
+	if c.CorrelationID != "" && stringExtension(*e, CorrelationIDExtension) == "" {
+		e.SetExtension(CorrelationIDExtension, c.CorrelationID)
+	}
+
+	if c.CausationID != "" && c.CausationID != e.ID() && stringExtension(*e, CausationIDExtension) == "" {
+		e.SetExtension(CausationIDExtension, c.CausationID)
+	}
+}
+
+// correlate sets context correlation to sent messages, it is the outermost Sender middleware
+func correlate() SendMiddleware {
+	return func(next SendHandler) SendHandler {
+		return func(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+			c := CorrelationFrom(ctx)
+			if c.CorrelationID == "" && c.CausationID == "" {
+				return next(ctx, in, transformers...)
+			}
+
+			// republished event isn't caused by itself
+			if mr, ok := in.(binding.MessageMetadataReader); ok {
+				if _, id := mr.GetAttribute(spec.ID); id == c.CausationID {
+					c.CausationID = ""
+				}
+			}
+
+			for ext, v := range map[string]string{CorrelationIDExtension: c.CorrelationID, CausationIDExtension: c.CausationID} {
+				if v == "" {
+					continue
+				}
+
+				value := v
+				transformers = append(transformers, transformer.SetExtension(ext, func(current interface{}) (interface{}, error) {
+					// event reader returns empty string for missing extension
+					if current != nil && current != "" {
+						return current, nil
+					}
+
+					return value, nil
+				}))
+			}
+
+			return next(ctx, in, transformers...)
+		}
+	}
+}
+
+// correlationTags span attributes of event correlation, context is used for not sent yet events
+func correlationTags(ctx context.Context, e cloudevents.Event) opentracing.Tags {
+	c, fallback := EventCorrelation(e), CorrelationFrom(ctx)
+
+	if c.CorrelationID == "" {
+		c.CorrelationID = fallback.CorrelationID
+	}
+
+	if c.CausationID == "" && fallback.CausationID != e.ID() {
+		c.CausationID = fallback.CausationID
+	}
+
+	tags := opentracing.Tags{}
+	if c.CorrelationID != "" {
+		tags[CorrelationIDAttr] = c.CorrelationID
+	}
+
+	if c.CausationID != "" {
+		tags[CausationIDAttr] = c.CausationID
+	}
+
+	return tags
+}
+
+func stringExtension(e cloudevents.Event, name string) string {
+	v, ok := e.Extensions()[name]
+	if !ok {
+		return ""
+	}
+
+	s, _ := v.(string)
+	return s
+}
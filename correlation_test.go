@@ -0,0 +1,97 @@
+package protonats_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cn "github.com/cloudevents/sdk-go/protocol/nats/v2"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCausingEvent(t *testing.T) {
+	first := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	first.SetID("e1")
+
+	ctx := protonats.WithCausingEvent(context.Background(), first)
+	assert.Equal(t, protonats.Correlation{CorrelationID: "e1", CausationID: "e1"}, protonats.CorrelationFrom(ctx))
+
+	second := newEvent(t, "payments.charge", orderCreated{ID: "o1"})
+	second.SetID("e2")
+	protonats.SetCorrelation(&second, protonats.CorrelationFrom(ctx))
+
+	assert.Equal(t, protonats.Correlation{CorrelationID: "e1", CausationID: "e1"}, protonats.EventCorrelation(second))
+
+	// the chain keeps the first correlation id
+	ctx = protonats.WithCausingEvent(ctx, second)
+	assert.Equal(t, protonats.Correlation{CorrelationID: "e1", CausationID: "e2"}, protonats.CorrelationFrom(ctx))
+
+	// own extensions win
+	third := newEvent(t, "shipping.ship", orderCreated{ID: "o1"})
+	third.SetID("e3")
+	third.SetExtension(protonats.CorrelationIDExtension, "custom")
+	protonats.SetCorrelation(&third, protonats.CorrelationFrom(ctx))
+
+	assert.Equal(t, protonats.Correlation{CorrelationID: "custom", CausationID: "e2"}, protonats.EventCorrelation(third))
+}
+
+func TestSenderCorrelation(t *testing.T) {
+	conn := runServer(t)
+
+	sub, err := conn.SubscribeSync("payments.charge")
+	require.NoError(t, err)
+
+	s, err := protonats.NewSenderFromConnWithOptions(conn, "payments.charge")
+	require.NoError(t, err)
+
+	c, err := protonats.NewConsumerFromConn(conn, "orders.created", protonats.WithReceiveBuffer(8))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = c.StartReceiver(ctx, func(ctx context.Context, e cloudevents.Event) protocol.Result {
+			charge := newEvent(t, "payments.charge", orderCreated{ID: "o1"})
+			charge.SetID("charge-" + e.ID())
+
+			return s.Send(ctx, (*binding.EventMessage)(&charge))
+		})
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	first := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	first.SetID("e1")
+
+	chained := newEvent(t, "orders.created", orderCreated{ID: "o2"})
+	chained.SetID("e2")
+	chained.SetExtension(protonats.CorrelationIDExtension, "c0")
+
+	for _, e := range []cloudevents.Event{first, chained} {
+		e := e
+		require.NoError(t, s.Send(cecontext.WithTopic(context.Background(), "orders.created"), (*binding.EventMessage)(&e)))
+	}
+
+	// event sent by handler is caused by the handled one and keeps its chain
+	want := map[string]protonats.Correlation{
+		"charge-e1": {CorrelationID: "e1", CausationID: "e1"},
+		"charge-e2": {CorrelationID: "c0", CausationID: "e2"},
+	}
+
+	for range want {
+		msg, err := sub.NextMsg(time.Second)
+		require.NoError(t, err)
+
+		e, err := binding.ToEvent(context.Background(), cn.NewMessage(msg))
+		require.NoError(t, err)
+
+		assert.Equal(t, want[e.ID()], protonats.EventCorrelation(*e), e.ID())
+	}
+}
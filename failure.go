@@ -0,0 +1,108 @@
+package protonats
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// HeaderError DLQ message header with handler error
+	HeaderError = "Protonats-Error"
+	// HeaderOriginSubject DLQ message header with original message subject
+	HeaderOriginSubject = "Protonats-Origin-Subject"
+)
+
+// ErrMalformedEvent message can't be decoded into valid event, redelivery won't fix it
+var ErrMalformedEvent = errors.New("malformed event")
+
+// MalformedEventError decode or validation error of consumed message
+type MalformedEventError struct {
+	Err error
+}
+
+func (e *MalformedEventError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrMalformedEvent, e.Err)
+}
+
+func (e *MalformedEventError) Unwrap() error { return e.Err }
+
+func (e *MalformedEventError) Is(target error) bool { return target == ErrMalformedEvent }
+
+// FailureHandler settles message which was not acknowledged by handler.
+// Core NATS messages have nothing to settle, JetStream messages are negatively acked or terminated.
+type FailureHandler func(msg *nats.Msg, result error) error
+
+// NakOnFailure asks JetStream to redeliver failed message, default Consumer failure path
+func NakOnFailure() FailureHandler {
+	return func(msg *nats.Msg, _ error) error {
+		if !isJetStream(msg) {
+			return nil
+		}
+
+		return msg.Nak()
+	}
+}
+
+// TermOnFailure tells JetStream to never redeliver failed message
+func TermOnFailure() FailureHandler {
+	return func(msg *nats.Msg, _ error) error {
+		if !isJetStream(msg) {
+			return nil
+		}
+
+		return msg.Term()
+	}
+}
+
+// DeadLetterOnFailure publishes failed message to subject with error and origin subject headers.
+// JetStream message is terminated after successful publish, on publish error message is nacked.
+func DeadLetterOnFailure(conn *nats.Conn, subject string) FailureHandler {
+	return func(msg *nats.Msg, result error) error {
+		dlq := &nats.Msg{Subject: subject, Data: msg.Data}
+
+		if conn.HeadersSupported() {
+			dlq.Header = nats.Header{}
+			for k, v := range msg.Header {
+				dlq.Header[k] = v
+			}
+
+			dlq.Header.Set(HeaderOriginSubject, msg.Subject)
+			if result != nil {
+				dlq.Header.Set(HeaderError, result.Error())
+			}
+		}
+
+		if err := conn.PublishMsg(dlq); err != nil {
+			if isJetStream(msg) {
+				_ = msg.Nak()
+			}
+
+			return err
+		}
+
+		if !isJetStream(msg) {
+			return nil
+		}
+
+		return msg.Term()
+	}
+}
+
+// malformedOnFailure malformed events are terminated or dead-lettered, other failures follow next
+func malformedOnFailure(malformed, next FailureHandler) FailureHandler {
+	return func(msg *nats.Msg, result error) error {
+		if errors.Is(result, ErrMalformedEvent) {
+			return malformed(msg, result)
+		}
+
+		return next(msg, result)
+	}
+}
+
+// isJetStream only JetStream messages have metadata inside reply subject
+func isJetStream(msg *nats.Msg) bool {
+	_, err := msg.Metadata()
+	return err == nil
+}
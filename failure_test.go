@@ -0,0 +1,200 @@
+package protonats_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer starts embedded JetStream server
+func startServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	go s.Start()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+	t.Cleanup(s.Shutdown)
+
+	return s
+}
+
+// runServer starts embedded JetStream server with ORDERS stream on orders.> subjects
+func runServer(t *testing.T) *nats.Conn {
+	conn, err := nats.Connect(startServer(t).ClientURL())
+	require.NoError(t, err)
+	t.Cleanup(conn.Close)
+
+	js, err := conn.JetStream()
+	require.NoError(t, err)
+
+	_, err = js.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}})
+	require.NoError(t, err)
+
+	return conn
+}
+
+// newKV creates KV bucket on server of conn
+func newKV(t *testing.T, conn *nats.Conn, bucket string) nats.KeyValue {
+	js, err := conn.JetStream()
+	require.NoError(t, err)
+
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket})
+	require.NoError(t, err)
+
+	return kv
+}
+
+// fetchOne fetches single message by pull consumer
+func fetchOne(t *testing.T, sub *nats.Subscription) *nats.Msg {
+	msgs, err := sub.Fetch(1, nats.MaxWait(time.Second))
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	return msgs[0]
+}
+
+// finish settles msg through Message.Finish with fn failure handler
+func finish(t *testing.T, msg *nats.Msg, fn protonats.FailureHandler, result error) error {
+	ch := make(chan *nats.Msg, 1)
+	ch <- msg
+
+	m, err := protonats.NewReceiverWithFailureHandler(ch, fn).Receive(context.Background())
+	require.NoError(t, err)
+
+	return m.Finish(result)
+}
+
+func TestMessageFinish(t *testing.T) {
+	conn := runServer(t)
+	js, err := conn.JetStream()
+	require.NoError(t, err)
+
+	sub, err := js.PullSubscribe("orders.created", "finish", nats.AckWait(time.Minute))
+	require.NoError(t, err)
+
+	noMore := func() {
+		_, err := sub.Fetch(1, nats.MaxWait(100*time.Millisecond))
+		assert.True(t, errors.Is(err, nats.ErrTimeout), err)
+	}
+
+	_, err = js.Publish("orders.created", []byte("1"))
+	require.NoError(t, err)
+
+	// nak redelivers
+	require.NoError(t, finish(t, fetchOne(t, sub), protonats.NakOnFailure(), errors.New("boom")))
+
+	msg := fetchOne(t, sub)
+	meta, err := msg.Metadata()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), meta.NumDelivered)
+
+	// term never redelivers
+	require.NoError(t, finish(t, msg, protonats.TermOnFailure(), errors.New("boom")))
+	noMore()
+
+	// ack ignores the failure handler
+	_, err = js.Publish("orders.created", []byte("2"))
+	require.NoError(t, err)
+
+	require.NoError(t, finish(t, fetchOne(t, sub), protonats.NakOnFailure(), nil))
+	noMore()
+
+	// core NATS message has nothing to settle
+	assert.NoError(t, finish(t, &nats.Msg{Subject: "orders.created"}, protonats.NakOnFailure(), errors.New("boom")))
+}
+
+func TestDeadLetterOnFailure(t *testing.T) {
+	conn := runServer(t)
+	js, err := conn.JetStream()
+	require.NoError(t, err)
+
+	dlq, err := conn.SubscribeSync("dlq.orders")
+	require.NoError(t, err)
+
+	sub, err := js.PullSubscribe("orders.created", "dlq", nats.AckWait(time.Minute))
+	require.NoError(t, err)
+
+	_, err = js.PublishMsg(&nats.Msg{Subject: "orders.created", Data: []byte("1"), Header: nats.Header{"Ce-Id": []string{"1"}}})
+	require.NoError(t, err)
+
+	require.NoError(t, finish(t, fetchOne(t, sub), protonats.DeadLetterOnFailure(conn, "dlq.orders"), errors.New("boom")))
+
+	msg, err := dlq.NextMsg(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), msg.Data)
+	assert.Equal(t, "boom", msg.Header.Get(protonats.HeaderError))
+	assert.Equal(t, "orders.created", msg.Header.Get(protonats.HeaderOriginSubject))
+	assert.Equal(t, "1", msg.Header.Get("Ce-Id"))
+
+	// dead-lettered message is terminated
+	_, err = sub.Fetch(1, nats.MaxWait(100*time.Millisecond))
+	assert.True(t, errors.Is(err, nats.ErrTimeout), err)
+}
+
+func TestConsumerMalformedEvent(t *testing.T) {
+	for name, opts := range map[string][]protonats.ConsumerOption{
+		"term":        nil,
+		"dead letter": {protonats.WithDeadLetter("dlq.orders")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := runServer(t)
+			js, err := conn.JetStream()
+			require.NoError(t, err)
+
+			dlq, err := conn.SubscribeSync("dlq.orders")
+			require.NoError(t, err)
+
+			opts = append(opts, protonats.WithJetStreamSubscriber("", nats.Durable("malformed"), nats.AckWait(100*time.Millisecond)))
+			c, err := protonats.NewConsumerFromConn(conn, "orders.created", opts...)
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			handled := make(chan struct{}, 1)
+			go func() {
+				_ = c.StartReceiver(ctx, func(ctx context.Context, e cloudevents.Event) protocol.Result {
+					handled <- struct{}{}
+					return nil
+				})
+			}()
+
+			_, err = js.Publish("orders.created", []byte("garbage"))
+			require.NoError(t, err)
+
+			// terminated message is neither handled nor redelivered after ack wait
+			time.Sleep(300 * time.Millisecond)
+			assert.Empty(t, handled)
+
+			info, err := js.ConsumerInfo("ORDERS", "malformed")
+			require.NoError(t, err)
+			assert.Equal(t, uint64(1), info.Delivered.Consumer)
+			assert.Equal(t, 0, info.NumAckPending)
+
+			msg, err := dlq.NextMsg(100 * time.Millisecond)
+			if name == "term" {
+				assert.True(t, errors.Is(err, nats.ErrTimeout), err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Contains(t, msg.Header.Get(protonats.HeaderError), protonats.ErrMalformedEvent.Error())
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package protonats
+
+import (
+	"container/list"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/tel"
+	"github.com/d7561985/tel/monitoring/metrics"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+// ErrDedupInProgress event is handled by another delivery right now, redelivery finds it processed or released
+var ErrDedupInProgress = errors.New("dedup: event is handled by another delivery")
+
+// DedupStore remembers events processed successfully
+type DedupStore interface {
+	// Seen reports whether key was already processed
+	Seen(ctx context.Context, key string) (bool, error)
+	// Mark remembers key as processed
+	Mark(ctx context.Context, key string) error
+}
+
+// DedupClaimer is DedupStore shared by several consumers which reserves key before handling,
+// so concurrent deliveries of the same event don't both run the handler.
+type DedupClaimer interface {
+	// Claim atomically reserves not processed key, false means key is processed or claimed by another delivery
+	Claim(ctx context.Context, key string) (bool, error)
+	// Release drops claim of failed handling, so redelivery handles the event
+	Release(ctx context.Context, key string) error
+}
+
+// DedupKey identity of event according to CloudEvents spec: source + id
+func DedupKey(e cloudevents.Event) string {
+	return e.Source() + "\n" + e.ID()
+}
+
+// Idempotent drops events which (source, id) pair was already processed successfully.
+// Duplicates are acked and counted by AddReaderTopicSkippedEvents when m is not nil.
+// Store implementing DedupClaimer is claimed before the handler, event claimed by another delivery
+// fails with ErrDedupInProgress, so JetStream redelivers it later.
+// Store errors don't stop processing: event is handled as if it is seen first time.
+func Idempotent(store DedupStore, m metrics.MetricsReader) Middleware {
+	claimer, claims := store.(DedupClaimer)
+
+	return func(next Handler) Handler {
+		return func(ctx context.Context, e cloudevents.Event) protocol.Result {
+			key := DedupKey(e)
+
+			var (
+				seen, claimed bool
+				err           error
+			)
+
+			if claims {
+				if claimed, err = claimer.Claim(ctx, key); err != nil {
+					tel.FromCtx(ctx).Warn("dedup store claim", zap.Error(err), zap.String("id", e.ID()))
+				}
+			}
+
+			if !claims || err == nil && !claimed {
+				if seen, err = store.Seen(ctx, key); err != nil {
+					tel.FromCtx(ctx).Warn("dedup store seen", zap.Error(err), zap.String("id", e.ID()))
+				}
+
+				if claims && err == nil && !seen {
+					return fmt.Errorf("%w: %s", ErrDedupInProgress, e.ID())
+				}
+			}
+
+			if seen {
+				if m != nil {
+					m.AddReaderTopicSkippedEvents(e.Type(), 1)
+				}
+
+				return protocol.ResultACK
+			}
+
+			res := next(ctx, e)
+			if !protocol.IsACK(res) {
+				if claimed {
+					if err = claimer.Release(ctx, key); err != nil {
+						tel.FromCtx(ctx).Warn("dedup store release", zap.Error(err), zap.String("id", e.ID()))
+					}
+				}
+
+				return res
+			}
+
+			if err = store.Mark(ctx, key); err != nil {
+				tel.FromCtx(ctx).Warn("dedup store mark", zap.Error(err), zap.String("id", e.ID()))
+			}
+
+			return res
+		}
+	}
+}
+
+// MemoryDedupStore in-memory LRU store which keys expire after ttl
+type MemoryDedupStore struct {
+	mx sync.Mutex
+
+	size int
+	ttl  time.Duration
+
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type dedupItem struct {
+	key     string
+	expires time.Time
+}
+
+// NewMemoryDedupStore creates LRU store keeping up to size keys, zero ttl means keys never expire
+func NewMemoryDedupStore(size int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+// Seen implements DedupStore.Seen
+func (s *MemoryDedupStore) Seen(_ context.Context, key string) (bool, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return false, nil
+	}
+
+	if item := el.Value.(*dedupItem); s.ttl > 0 && time.Now().After(item.expires) {
+		s.remove(el)
+		return false, nil
+	}
+
+	s.ll.MoveToFront(el)
+
+	return true, nil
+}
+
+// Mark implements DedupStore.Mark
+func (s *MemoryDedupStore) Mark(_ context.Context, key string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	expires := time.Now().Add(s.ttl)
+
+	if el, ok := s.items[key]; ok {
+		el.Value.(*dedupItem).expires = expires
+		s.ll.MoveToFront(el)
+		return nil
+	}
+
+	s.items[key] = s.ll.PushFront(&dedupItem{key: key, expires: expires})
+
+	for s.size > 0 && s.ll.Len() > s.size {
+		s.remove(s.ll.Back())
+	}
+
+	return nil
+}
+
+// Len returns number of remembered keys including expired but not evicted yet
+func (s *MemoryDedupStore) Len() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.ll.Len()
+}
+
+func (s *MemoryDedupStore) remove(el *list.Element) {
+	s.ll.Remove(el)
+	delete(s.items, el.Value.(*dedupItem).key)
+}
+
+// kvClaimPrefix value of claimed but not processed key, processed key keeps its unix time
+const kvClaimPrefix = "claim:"
+
+// KVDedupStore keeps processed keys inside NATS KV bucket, expiration is controlled by bucket TTL.
+// Keys are claimed with KV create, so consumers sharing the bucket never handle the same event concurrently.
+type KVDedupStore struct {
+	KV nats.KeyValue
+
+	// ClaimTimeout after which claim of crashed consumer is taken over, handling must be shorter, one minute by default
+	ClaimTimeout time.Duration
+}
+
+func NewKVDedupStore(kv nats.KeyValue) *KVDedupStore {
+	return &KVDedupStore{KV: kv, ClaimTimeout: time.Minute}
+}
+
+// Seen implements DedupStore.Seen, claimed key isn't processed yet
+func (s *KVDedupStore) Seen(_ context.Context, key string) (bool, error) {
+	entry, err := s.KV.Get(kvKey(key))
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrKeyDeleted) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return !strings.HasPrefix(string(entry.Value()), kvClaimPrefix), nil
+}
+
+// Claim implements DedupClaimer.Claim
+func (s *KVDedupStore) Claim(_ context.Context, key string) (bool, error) {
+	k, now := kvKey(key), time.Now()
+	value := []byte(kvClaimPrefix + strconv.FormatInt(now.UnixNano(), 10))
+
+	_, err := s.KV.Create(k, value)
+	if err == nil {
+		return true, nil
+	}
+
+	entry, gErr := s.KV.Get(k)
+	if errors.Is(gErr, nats.ErrKeyNotFound) || errors.Is(gErr, nats.ErrKeyDeleted) {
+		// create failed for another reason
+		return false, err
+	}
+
+	if gErr != nil {
+		return false, gErr
+	}
+
+	claimedAt, pErr := strconv.ParseInt(strings.TrimPrefix(string(entry.Value()), kvClaimPrefix), 10, 64)
+	stale := pErr == nil && strings.HasPrefix(string(entry.Value()), kvClaimPrefix) &&
+		s.ClaimTimeout > 0 && now.Sub(time.Unix(0, claimedAt)) > s.ClaimTimeout
+
+	if !stale {
+		return false, nil
+	}
+
+	// revision check lets only one consumer take the stale claim over
+	if _, err = s.KV.Update(k, value, entry.Revision()); err != nil {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Release implements DedupClaimer.Release
+func (s *KVDedupStore) Release(_ context.Context, key string) error {
+	return s.KV.Delete(kvKey(key))
+}
+
+// Mark implements DedupStore.Mark
+func (s *KVDedupStore) Mark(_ context.Context, key string) error {
+	_, err := s.KV.PutString(kvKey(key), strconv.FormatInt(time.Now().Unix(), 10))
+	return err
+}
+
+// kvKey KV keys allow limited alphabet while source is URI
+func kvKey(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+var _ DedupStore = (*MemoryDedupStore)(nil)
+var _ DedupStore = (*KVDedupStore)(nil)
+var _ DedupClaimer = (*KVDedupStore)(nil)
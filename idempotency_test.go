@@ -0,0 +1,177 @@
+package protonats_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("lru", func(t *testing.T) {
+		s := protonats.NewMemoryDedupStore(2, 0)
+
+		require.NoError(t, s.Mark(ctx, "a"))
+		require.NoError(t, s.Mark(ctx, "b"))
+
+		// touch a so b becomes the oldest one
+		seen, _ := s.Seen(ctx, "a")
+		assert.True(t, seen)
+
+		require.NoError(t, s.Mark(ctx, "c"))
+		assert.Equal(t, 2, s.Len())
+
+		seen, _ = s.Seen(ctx, "b")
+		assert.False(t, seen)
+		seen, _ = s.Seen(ctx, "a")
+		assert.True(t, seen)
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		s := protonats.NewMemoryDedupStore(10, 10*time.Millisecond)
+		require.NoError(t, s.Mark(ctx, "a"))
+
+		seen, _ := s.Seen(ctx, "a")
+		assert.True(t, seen)
+
+		time.Sleep(20 * time.Millisecond)
+
+		seen, _ = s.Seen(ctx, "a")
+		assert.False(t, seen)
+	})
+}
+
+func TestIdempotent(t *testing.T) {
+	calls := 0
+
+	h := protonats.Chain(func(ctx context.Context, e cloudevents.Event) protocol.Result {
+		calls++
+		if e.Type() == "fail" {
+			return protocol.ResultNACK
+		}
+		return nil
+	}, protonats.Idempotent(protonats.NewMemoryDedupStore(10, time.Minute), nil))
+
+	ctx := context.Background()
+
+	e := cloudevents.NewEvent()
+	e.SetID("1")
+	e.SetSource("test")
+	e.SetType("ok")
+
+	assert.True(t, protocol.IsACK(h(ctx, e)))
+	assert.True(t, protocol.IsACK(h(ctx, e)))
+	assert.Equal(t, 1, calls)
+
+	// failed event is not remembered and redelivery reaches handler
+	e.SetID("2")
+	e.SetType("fail")
+
+	assert.True(t, protocol.IsNACK(h(ctx, e)))
+	assert.True(t, protocol.IsNACK(h(ctx, e)))
+	assert.Equal(t, 3, calls)
+}
+
+func TestKVDedupStore(t *testing.T) {
+	ctx := context.Background()
+	kv := newKV(t, runServer(t), "dedup")
+	s := protonats.NewKVDedupStore(kv)
+
+	seen, err := s.Seen(ctx, "src\n1")
+	require.NoError(t, err)
+	assert.False(t, seen)
+
+	// only one delivery claims the key, claimed key isn't processed yet
+	claimed, err := s.Claim(ctx, "src\n1")
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	claimed, err = s.Claim(ctx, "src\n1")
+	require.NoError(t, err)
+	assert.False(t, claimed)
+
+	seen, err = s.Seen(ctx, "src\n1")
+	require.NoError(t, err)
+	assert.False(t, seen)
+
+	require.NoError(t, s.Mark(ctx, "src\n1"))
+
+	seen, err = s.Seen(ctx, "src\n1")
+	require.NoError(t, err)
+	assert.True(t, seen)
+
+	claimed, err = s.Claim(ctx, "src\n1")
+	require.NoError(t, err)
+	assert.False(t, claimed)
+
+	// released key is claimed again
+	claimed, err = s.Claim(ctx, "src\n2")
+	require.NoError(t, err)
+	require.True(t, claimed)
+	require.NoError(t, s.Release(ctx, "src\n2"))
+
+	seen, err = s.Seen(ctx, "src\n2")
+	require.NoError(t, err)
+	assert.False(t, seen)
+
+	claimed, err = s.Claim(ctx, "src\n2")
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	// claim of crashed consumer is taken over after timeout
+	other := &protonats.KVDedupStore{KV: kv, ClaimTimeout: 10 * time.Millisecond}
+
+	claimed, err = other.Claim(ctx, "src\n2")
+	require.NoError(t, err)
+	assert.False(t, claimed)
+
+	time.Sleep(20 * time.Millisecond)
+
+	claimed, err = other.Claim(ctx, "src\n2")
+	require.NoError(t, err)
+	assert.True(t, claimed)
+}
+
+func TestIdempotentKVConcurrent(t *testing.T) {
+	store := protonats.NewKVDedupStore(newKV(t, runServer(t), "dedup"))
+
+	var calls int32
+	release := make(chan struct{})
+
+	h := protonats.Chain(func(ctx context.Context, e cloudevents.Event) protocol.Result {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil
+	}, protonats.Idempotent(store, nil))
+
+	e := cloudevents.NewEvent()
+	e.SetID("1")
+	e.SetSource("test")
+	e.SetType("ok")
+
+	results := make(chan protocol.Result, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- h(context.Background(), e) }()
+	}
+
+	// the second delivery doesn't wait for the first one
+	res := <-results
+	assert.True(t, errors.Is(res, protonats.ErrDedupInProgress), res)
+
+	close(release)
+	assert.True(t, protocol.IsACK(<-results))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// redelivery finds event processed
+	assert.True(t, protocol.IsACK(h(context.Background(), e)))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
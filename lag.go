@@ -0,0 +1,73 @@
+package protonats
+
+import (
+	"context"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+)
+
+// SendTimeExtension CloudEvent extension with time of publish set by RecordSendingEvent
+const SendTimeExtension = "sendtime"
+
+// sources of lag metric
+const (
+	LagSourceEventTime = "event_time"
+	LagSourceSendTime  = "send_time"
+)
+
+// DefaultLagClockSkew tolerated difference of producer and consumer clocks, see WithLagClockSkew
+const DefaultLagClockSkew = time.Second
+
+// EventSendTime returns SendTimeExtension of event
+func EventSendTime(e cloudevents.Event) (time.Time, bool) {
+	v, ok := e.Extensions()[SendTimeExtension]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := types.ToTime(v)
+	if err != nil || t.IsZero() {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+// recordLag reports time from event creation (time attribute) and from publish (SendTimeExtension) until now.
+// Producer clock ahead of consumer gives negative lag: within skew tolerance it is reported as zero,
+// beyond it lag isn't reported but counted as skewed.
+func (t *TeleObservability) recordLag(ctx context.Context, e cloudevents.Event, subject string, now time.Time) {
+	if subject == "" {
+		if msg := NatsMsgFrom(ctx); msg != nil {
+			subject = msg.Subject
+		}
+	}
+
+	if created := e.Time(); !created.IsZero() {
+		t.observeLag(e.Type(), subject, LagSourceEventTime, now.Sub(created))
+	}
+
+	if sent, ok := EventSendTime(e); ok {
+		t.observeLag(e.Type(), subject, LagSourceSendTime, now.Sub(sent))
+	}
+}
+
+func (t *TeleObservability) observeLag(typ, subject, source string, lag time.Duration) {
+	lm, ok := t.metrics.(LagMetrics)
+	if !ok {
+		return
+	}
+
+	if lag < -t.clockSkew {
+		lm.AddEventLagSkewed(typ, subject, source)
+		return
+	}
+
+	if lag < 0 {
+		lag = 0
+	}
+
+	lm.AddEventLag(typ, subject, source, lag)
+}
@@ -0,0 +1,96 @@
+package protonats_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/d7561985/protonats"
+	"github.com/d7561985/tel"
+	"github.com/d7561985/tel/monitoring/metrics"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	readerOnce sync.Once
+	reader     metrics.MetricsReader
+)
+
+// metricsReader registers tel collectors once per test binary
+func metricsReader() metrics.MetricsReader {
+	readerOnce.Do(func() { reader = metrics.NewCollectorMetricsReader() })
+	return reader
+}
+
+type lagMetrics struct {
+	mu     sync.Mutex
+	lags   map[string]time.Duration
+	skewed []string
+}
+
+func (m *lagMetrics) AddEventLag(typ, subject, source string, d time.Duration) protonats.LagMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lags[typ+"|"+subject+"|"+source] = d
+	return m
+}
+
+func (m *lagMetrics) AddEventLagSkewed(typ, subject, source string) protonats.LagMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.skewed = append(m.skewed, typ+"|"+subject+"|"+source)
+	return m
+}
+
+func TestEventLag(t *testing.T) {
+	m := &lagMetrics{lags: map[string]time.Duration{}}
+
+	tl := tel.NewNull()
+	obs := protonats.NewTeleObservability(&tl, metricsReader(),
+		protonats.WithObservabilityMetrics(m), protonats.WithLagClockSkew(time.Second)).(*protonats.TeleObservability)
+
+	ctx := protonats.WithNatsMsg(tl.Ctx(), &nats.Msg{Subject: "orders.eu"})
+
+	e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	e.SetTime(time.Now().Add(-2 * time.Second))
+	// producer clock is ahead within tolerance
+	e.SetExtension(protonats.SendTimeExtension, time.Now().Add(500*time.Millisecond))
+
+	_, cb := obs.RecordCallingInvoker(ctx, &e)
+	cb(nil)
+
+	lag := m.lags["orders.created|orders.eu|event_time"]
+	assert.True(t, lag >= 2*time.Second && lag < 3*time.Second, lag)
+
+	sendLag, ok := m.lags["orders.created|orders.eu|send_time"]
+	require.True(t, ok)
+	assert.Equal(t, time.Duration(0), sendLag)
+
+	// beyond tolerance
+	e.SetExtension(protonats.SendTimeExtension, time.Now().Add(time.Minute))
+
+	_, cb = obs.RecordCallingInvoker(context.Background(), &e)
+	cb(nil)
+
+	assert.Equal(t, []string{"orders.created||send_time"}, m.skewed)
+}
+
+func TestSendTimeExtension(t *testing.T) {
+	tl := tel.NewNull()
+	obs := protonats.NewTeleObservability(&tl, metricsReader())
+
+	e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	before := time.Now()
+
+	_, cb := obs.RecordSendingEvent(tl.Ctx(), e)
+	cb(nil)
+
+	sent, ok := protonats.EventSendTime(e)
+	require.True(t, ok)
+	assert.False(t, sent.Before(before))
+}
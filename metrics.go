@@ -0,0 +1,533 @@
+package protonats
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/d7561985/tel/monitoring/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsSubsystem = "protonats"
+
+	labelLimiter  = "limiter"
+	labelKind     = "kind"
+	labelKey      = "key"
+	labelBreaker  = "breaker"
+	labelSpool    = "spool"
+	labelTopic    = "topic"
+	labelCode     = "code"
+	labelTenant   = TenantAttr
+	labelRule     = "rule"
+	labelType     = "type"
+	labelPool     = "pool"
+	labelState    = "state"
+	labelDir      = "direction"
+	labelCluster  = "cluster"
+	labelFailover = "failover"
+	labelResult   = "result"
+	labelSubject  = "subject"
+	labelSource   = "source"
+)
+
+// Metrics collectors of TeleObservability which are not covered by tel metrics.MetricsReader.
+// One collector serves several features, so each of them reports only when Metrics implements its interface
+// (ReceiveMetrics, LagMetrics, BatchMetrics), the same way TeleObservability detects TenantMetricsReader.
+// Options of other components take their feature interface directly.
+type Metrics interface{}
+
+// CollectorMetrics implements every feature metrics interface
+type CollectorMetrics interface {
+	ThrottleMetrics
+	BreakerMetrics
+	SpoolMetrics
+	PolicyMetrics
+	PoolMetrics
+	ClusterMetrics
+	ReceiveMetrics
+	LagMetrics
+	BatchMetrics
+}
+
+// ThrottleMetrics reports RateLimiter waits and rejects
+type ThrottleMetrics interface {
+	AddThrottleWait(limiter, kind, key string, d time.Duration) ThrottleMetrics
+	AddThrottleRejected(limiter, kind, key string) ThrottleMetrics
+}
+
+// BreakerMetrics reports CircuitBreaker state and rejects
+type BreakerMetrics interface {
+	SetBreakerState(breaker string, state BreakerState) BreakerMetrics
+	AddBreakerRejected(breaker string) BreakerMetrics
+}
+
+// SpoolMetrics reports Spool depth and lost events
+type SpoolMetrics interface {
+	SetSpoolDepth(spool string, events int, bytes int64) SpoolMetrics
+	AddSpoolDropped(spool string, events int) SpoolMetrics
+}
+
+// PolicyMetrics reports events denied by consumer policy
+type PolicyMetrics interface {
+	AddPolicyDenied(rule, typ string) PolicyMetrics
+}
+
+// PoolMetrics reports ConnPool stats
+type PoolMetrics interface {
+	SetPoolStats(pool string, stats PoolStats) PoolMetrics
+}
+
+// ClusterMetrics reports publishes by cluster
+type ClusterMetrics interface {
+	AddClusterPublish(cluster string, failover bool, err error) ClusterMetrics
+}
+
+// ReceiveMetrics reports time from message receive until its handling starts
+type ReceiveMetrics interface {
+	AddReceiveLatency(typ string, d time.Duration) ReceiveMetrics
+}
+
+// LagMetrics reports end-to-end event lag
+type LagMetrics interface {
+	AddEventLag(typ, subject, source string, d time.Duration) LagMetrics
+	AddEventLagSkewed(typ, subject, source string) LagMetrics
+}
+
+// BatchMetrics reports distribution of pull batches
+type BatchMetrics interface {
+	AddBatch(subject string, size int, d time.Duration, err error) BatchMetrics
+}
+
+type mCollector struct {
+	// time spent waiting for rate limiter tokens
+	throttleWait *prometheus.HistogramVec
+	// requests rejected by rate limiter because of context deadline
+	throttleRejected *prometheus.CounterVec
+	// circuit breaker state: 0 closed, 1 open, 2 half-open
+	breakerState *prometheus.GaugeVec
+	// requests rejected by open circuit breaker
+	breakerRejected *prometheus.CounterVec
+	// not drained spool records
+	spoolEvents *prometheus.GaugeVec
+	spoolBytes  *prometheus.GaugeVec
+	// events lost because of spool overflow
+	spoolDropped *prometheus.CounterVec
+	// events denied by consumer policy
+	policyDenied *prometheus.CounterVec
+	// connection pool: connections by state, traffic by direction, reconnects
+	poolConns      *prometheus.GaugeVec
+	poolMsgs       *prometheus.GaugeVec
+	poolBytes      *prometheus.GaugeVec
+	poolReconnects *prometheus.GaugeVec
+	// publishes by cluster which served them
+	clusterPublish *prometheus.CounterVec
+	// time from message receive until its handling starts: receive buffer, decode, concurrency and rate limit waits
+	receiveLatency *prometheus.HistogramVec
+	// end-to-end time from event time or send time until handling starts
+	eventLag *prometheus.HistogramVec
+	// lags not reported because producer clock is ahead beyond tolerated skew
+	eventLagSkewed *prometheus.CounterVec
+	// events per pull batch and batch handling time by result
+	batchSize    *prometheus.HistogramVec
+	batchLatency *prometheus.HistogramVec
+}
+
+// NewCollectorMetrics creates and registers collectors inside prometheus.DefaultRegisterer
+func NewCollectorMetrics() CollectorMetrics {
+	throttleWait := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "throttle_wait_seconds",
+		Help:      "Time spent waiting for rate limiter",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{labelLimiter, labelKind, labelKey})
+
+	throttleRejected := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "throttle_rejected",
+		Help:      "Number of requests rejected by rate limiter",
+	}, []string{labelLimiter, labelKind, labelKey})
+
+	breakerState := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "circuit_breaker_state",
+		Help:      "Circuit breaker state: 0 closed, 1 open, 2 half-open",
+	}, []string{labelBreaker})
+
+	breakerRejected := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "circuit_breaker_rejected",
+		Help:      "Number of requests rejected by open circuit breaker",
+	}, []string{labelBreaker})
+
+	spoolEvents := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "spool_events",
+		Help:      "Number of events waiting in spool",
+	}, []string{labelSpool})
+
+	spoolBytes := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "spool_bytes",
+		Help:      "Size of events waiting in spool",
+	}, []string{labelSpool})
+
+	spoolDropped := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "spool_dropped",
+		Help:      "Number of events dropped by spool overflow",
+	}, []string{labelSpool})
+
+	policyDenied := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "policy_denied",
+		Help:      "Number of events denied by consumer policy",
+	}, []string{labelRule, labelType})
+
+	poolConns := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "pool_connections",
+		Help:      "Number of pool connections: total or connected",
+	}, []string{labelPool, labelState})
+
+	poolMsgs := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "pool_messages",
+		Help:      "Number of messages passed through pool connections: in or out",
+	}, []string{labelPool, labelDir})
+
+	poolBytes := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "pool_bytes",
+		Help:      "Size of messages passed through pool connections: in or out",
+	}, []string{labelPool, labelDir})
+
+	poolReconnects := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "pool_reconnects",
+		Help:      "Number of reconnects of pool connections",
+	}, []string{labelPool})
+
+	clusterPublish := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "cluster_publish",
+		Help:      "Number of publishes by cluster, failover and result",
+	}, []string{labelCluster, labelFailover, labelResult})
+
+	receiveLatency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "receive_latency_seconds",
+		Help:      "Time from message receive until handling starts",
+	}, []string{labelType})
+
+	eventLag := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "event_lag_seconds",
+		Help:      "Time from event time or send time until handling starts",
+		// 1ms up to ~70 minutes
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 12),
+	}, []string{labelType, labelSubject, labelSource})
+
+	eventLagSkewed := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "event_lag_skewed",
+		Help:      "Number of events which lag isn't reported because of producer clock skew",
+	}, []string{labelType, labelSubject, labelSource})
+
+	batchSize := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "batch_size",
+		Help:      "Number of events per pull batch",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 11),
+	}, []string{labelSubject})
+
+	batchLatency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: metricsSubsystem,
+		Name:      "batch_latency_seconds",
+		Help:      "Time of pull batch handling by result",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{labelSubject, labelResult})
+
+	prometheus.DefaultRegisterer.MustRegister(
+		throttleWait, throttleRejected,
+		breakerState, breakerRejected,
+		spoolEvents, spoolBytes, spoolDropped,
+		policyDenied,
+		poolConns, poolMsgs, poolBytes, poolReconnects,
+		clusterPublish,
+		receiveLatency,
+		eventLag, eventLagSkewed,
+		batchSize, batchLatency,
+	)
+
+	return &mCollector{
+		throttleWait:     throttleWait,
+		throttleRejected: throttleRejected,
+		breakerState:     breakerState,
+		breakerRejected:  breakerRejected,
+		spoolEvents:      spoolEvents,
+		spoolBytes:       spoolBytes,
+		spoolDropped:     spoolDropped,
+		policyDenied:     policyDenied,
+		poolConns:        poolConns,
+		poolMsgs:         poolMsgs,
+		poolBytes:        poolBytes,
+		poolReconnects:   poolReconnects,
+		clusterPublish:   clusterPublish,
+		receiveLatency:   receiveLatency,
+		eventLag:         eventLag,
+		eventLagSkewed:   eventLagSkewed,
+		batchSize:        batchSize,
+		batchLatency:     batchLatency,
+	}
+}
+
+func (m *mCollector) AddThrottleWait(limiter, kind, key string, d time.Duration) ThrottleMetrics {
+	m.throttleWait.With(map[string]string{
+		labelLimiter: limiter,
+		labelKind:    kind,
+		labelKey:     key,
+	}).Observe(d.Seconds())
+	return m
+}
+
+func (m *mCollector) AddThrottleRejected(limiter, kind, key string) ThrottleMetrics {
+	m.throttleRejected.With(map[string]string{
+		labelLimiter: limiter,
+		labelKind:    kind,
+		labelKey:     key,
+	}).Inc()
+	return m
+}
+
+func (m *mCollector) SetBreakerState(breaker string, state BreakerState) BreakerMetrics {
+	m.breakerState.WithLabelValues(breaker).Set(float64(state))
+	return m
+}
+
+func (m *mCollector) AddBreakerRejected(breaker string) BreakerMetrics {
+	m.breakerRejected.WithLabelValues(breaker).Inc()
+	return m
+}
+
+func (m *mCollector) SetSpoolDepth(spool string, events int, bytes int64) SpoolMetrics {
+	m.spoolEvents.WithLabelValues(spool).Set(float64(events))
+	m.spoolBytes.WithLabelValues(spool).Set(float64(bytes))
+	return m
+}
+
+func (m *mCollector) AddSpoolDropped(spool string, events int) SpoolMetrics {
+	m.spoolDropped.WithLabelValues(spool).Add(float64(events))
+	return m
+}
+
+func (m *mCollector) AddPolicyDenied(rule, typ string) PolicyMetrics {
+	m.policyDenied.WithLabelValues(rule, typ).Inc()
+	return m
+}
+
+func (m *mCollector) SetPoolStats(pool string, stats PoolStats) PoolMetrics {
+	m.poolConns.WithLabelValues(pool, "total").Set(float64(stats.Size))
+	m.poolConns.WithLabelValues(pool, "connected").Set(float64(stats.Connected))
+	m.poolMsgs.WithLabelValues(pool, "in").Set(float64(stats.InMsgs))
+	m.poolMsgs.WithLabelValues(pool, "out").Set(float64(stats.OutMsgs))
+	m.poolBytes.WithLabelValues(pool, "in").Set(float64(stats.InBytes))
+	m.poolBytes.WithLabelValues(pool, "out").Set(float64(stats.OutBytes))
+	m.poolReconnects.WithLabelValues(pool).Set(float64(stats.Reconnects))
+	return m
+}
+
+func (m *mCollector) AddClusterPublish(cluster string, failover bool, err error) ClusterMetrics {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	m.clusterPublish.WithLabelValues(cluster, strconv.FormatBool(failover), result).Inc()
+	return m
+}
+
+func (m *mCollector) AddReceiveLatency(typ string, d time.Duration) ReceiveMetrics {
+	m.receiveLatency.WithLabelValues(typ).Observe(d.Seconds())
+	return m
+}
+
+func (m *mCollector) AddEventLag(typ, subject, source string, d time.Duration) LagMetrics {
+	m.eventLag.WithLabelValues(typ, subject, source).Observe(d.Seconds())
+	return m
+}
+
+func (m *mCollector) AddEventLagSkewed(typ, subject, source string) LagMetrics {
+	m.eventLagSkewed.WithLabelValues(typ, subject, source).Inc()
+	return m
+}
+
+// AddBatch result is "ok", "partial" for BatchError or "error"
+func (m *mCollector) AddBatch(subject string, size int, d time.Duration, err error) BatchMetrics {
+	var be BatchError
+
+	result := "ok"
+	switch {
+	case errors.As(err, &be):
+		result = "partial"
+	case err != nil:
+		result = "error"
+	}
+
+	m.batchSize.WithLabelValues(subject).Observe(float64(size))
+	m.batchLatency.WithLabelValues(subject, result).Observe(d.Seconds())
+	return m
+}
+
+type nullMetrics struct{}
+
+// NewNullMetrics discards everything, default for features without metrics
+func NewNullMetrics() CollectorMetrics {
+	return nullMetrics{}
+}
+
+func (n nullMetrics) AddThrottleWait(string, string, string, time.Duration) ThrottleMetrics { return n }
+func (n nullMetrics) AddThrottleRejected(string, string, string) ThrottleMetrics            { return n }
+func (n nullMetrics) SetBreakerState(string, BreakerState) BreakerMetrics                   { return n }
+func (n nullMetrics) AddBreakerRejected(string) BreakerMetrics                              { return n }
+func (n nullMetrics) SetSpoolDepth(string, int, int64) SpoolMetrics                         { return n }
+func (n nullMetrics) AddSpoolDropped(string, int) SpoolMetrics                              { return n }
+func (n nullMetrics) AddPolicyDenied(string, string) PolicyMetrics                          { return n }
+func (n nullMetrics) SetPoolStats(string, PoolStats) PoolMetrics                            { return n }
+func (n nullMetrics) AddClusterPublish(string, bool, error) ClusterMetrics                  { return n }
+func (n nullMetrics) AddReceiveLatency(string, time.Duration) ReceiveMetrics                { return n }
+func (n nullMetrics) AddEventLag(string, string, string, time.Duration) LagMetrics          { return n }
+func (n nullMetrics) AddEventLagSkewed(string, string, string) LagMetrics                   { return n }
+func (n nullMetrics) AddBatch(string, int, time.Duration, error) BatchMetrics               { return n }
+
+// TenantMetricsReader is tel metrics.MetricsReader which collectors have tenant label.
+// TeleObservability reports events of tenant through ForTenant.
+type TenantMetricsReader interface {
+	metrics.MetricsReader
+
+	ForTenant(tenant string) metrics.MetricsReader
+}
+
+type mTenantReader struct {
+	tenant string
+
+	topicsInUse    *prometheus.GaugeVec
+	fatalErrors    *prometheus.CounterVec
+	processErrors  *prometheus.CounterVec
+	readEvents     *prometheus.CounterVec
+	commitEvents   *prometheus.CounterVec
+	decodeEvents   *prometheus.CounterVec
+	skippedEvents  *prometheus.CounterVec
+	errorEvents    *prometheus.CounterVec
+	handlingTime   *prometheus.GaugeVec
+	garbageRecords *prometheus.GaugeVec
+}
+
+// NewTenantMetricsReader creates and registers tenant labeled reader collectors inside prometheus.DefaultRegisterer.
+// Collectors have the same names as tel reader ones within protonats subsystem, so both readers can be registered.
+func NewTenantMetricsReader() TenantMetricsReader {
+	counter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: metricsSubsystem,
+			Name:      name,
+			Help:      help,
+		}, append(labels, labelTenant))
+	}
+
+	gauge := func(name, help string, labels ...string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: metricsSubsystem,
+			Name:      name,
+			Help:      help,
+		}, append(labels, labelTenant))
+	}
+
+	m := &mTenantReader{
+		topicsInUse:    gauge("consuming_topics", "Number of topics consumed now"),
+		fatalErrors:    counter("consuming_fatal_errors", "Number of topic critical errors", labelTopic, labelCode),
+		processErrors:  counter("consuming_process_error", "Number of process errors on topic", labelTopic),
+		readEvents:     counter("events_read", "Number of read events on topic", labelTopic),
+		commitEvents:   counter("events_commit", "Number of commit events on topic", labelTopic),
+		decodeEvents:   counter("events_decode", "Number of decode events on topic", labelTopic),
+		skippedEvents:  counter("events_skipped", "Number of skipped events on topic", labelTopic),
+		errorEvents:    counter("events_error", "Number of error events on topic", labelTopic),
+		handlingTime:   gauge("handling_time", "Processing time of received messages by topic processors in seconds", labelTopic),
+		garbageRecords: gauge("garbage_records_total", "Number of garbage records"),
+	}
+
+	prometheus.DefaultRegisterer.MustRegister(
+		m.topicsInUse, m.fatalErrors, m.processErrors, m.readEvents, m.commitEvents,
+		m.decodeEvents, m.skippedEvents, m.errorEvents, m.handlingTime, m.garbageRecords,
+	)
+
+	return m
+}
+
+// ForTenant returns reader which reports with tenant label, collectors are shared
+func (m *mTenantReader) ForTenant(tenant string) metrics.MetricsReader {
+	res := *m
+	res.tenant = tenant
+
+	return &res
+}
+
+func (m *mTenantReader) AddReaderTopicsInUse() metrics.MetricsReader {
+	m.topicsInUse.WithLabelValues(m.tenant).Inc()
+	return m
+}
+
+func (m *mTenantReader) RmReaderTopicsInUse() metrics.MetricsReader {
+	m.topicsInUse.WithLabelValues(m.tenant).Dec()
+	return m
+}
+
+func (m *mTenantReader) AddReaderTopicFatalError(topic string, code int) metrics.MetricsReader {
+	m.fatalErrors.WithLabelValues(topic, strconv.Itoa(code), m.tenant).Inc()
+	return m
+}
+
+func (m *mTenantReader) AddReaderTopicProcessError(topic string) metrics.MetricsReader {
+	m.processErrors.WithLabelValues(topic, m.tenant).Inc()
+	return m
+}
+
+func (m *mTenantReader) AddReaderTopicReadEvents(topic string, num int) metrics.MetricsReader {
+	m.readEvents.WithLabelValues(topic, m.tenant).Add(float64(num))
+	return m
+}
+
+func (m *mTenantReader) AddReaderTopicCommitEvents(topic string, num int) metrics.MetricsReader {
+	m.commitEvents.WithLabelValues(topic, m.tenant).Add(float64(num))
+	return m
+}
+
+func (m *mTenantReader) AddReaderTopicDecodeEvents(topic string, num int) metrics.MetricsReader {
+	m.decodeEvents.WithLabelValues(topic, m.tenant).Add(float64(num))
+	return m
+}
+
+func (m *mTenantReader) AddReaderTopicSkippedEvents(topic string, num int) metrics.MetricsReader {
+	m.skippedEvents.WithLabelValues(topic, m.tenant).Add(float64(num))
+	return m
+}
+
+func (m *mTenantReader) AddReaderTopicErrorEvents(topic string, num int) metrics.MetricsReader {
+	m.errorEvents.WithLabelValues(topic, m.tenant).Add(float64(num))
+	return m
+}
+
+func (m *mTenantReader) AddReaderTopicHandlingTime(topic string, d time.Duration) metrics.MetricsReader {
+	m.handlingTime.WithLabelValues(topic, m.tenant).Set(d.Seconds())
+	return m
+}
+
+func (m *mTenantReader) AddGarbageRecords(num int) metrics.MetricsReader {
+	m.garbageRecords.WithLabelValues(m.tenant).Add(float64(num))
+	return m
+}
+
+var (
+	_ CollectorMetrics = (*mCollector)(nil)
+	_ CollectorMetrics = nullMetrics{}
+)
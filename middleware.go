@@ -0,0 +1,34 @@
+package protonats
+
+import (
+	"context"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+)
+
+// Middleware wraps consumer Handler, e.g. logging, auth, validation, rate limiting or recovery
+type Middleware func(next Handler) Handler
+
+// SendHandler is the function signature of protocol.Sender Send
+type SendHandler func(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error
+
+// SendMiddleware wraps sender SendHandler
+type SendMiddleware func(next SendHandler) SendHandler
+
+// Chain wraps h with middlewares, the first one is the outermost
+func Chain(h Handler, mw ...Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+
+	return h
+}
+
+// ChainSend wraps h with send middlewares, the first one is the outermost
+func ChainSend(h SendHandler, mw ...SendMiddleware) SendHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+
+	return h
+}
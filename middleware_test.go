@@ -0,0 +1,119 @@
+package protonats_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cn "github.com/cloudevents/sdk-go/protocol/nats/v2"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/binding/format"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/d7561985/tel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+
+	mw := func(name string) protonats.Middleware {
+		return func(next protonats.Handler) protonats.Handler {
+			return func(ctx context.Context, e cloudevents.Event) protocol.Result {
+				calls = append(calls, name)
+				return next(ctx, e)
+			}
+		}
+	}
+
+	h := protonats.Chain(func(ctx context.Context, e cloudevents.Event) protocol.Result {
+		calls = append(calls, "handler")
+		return nil
+	}, mw("a"), mw("b"))
+
+	require.NoError(t, h(context.Background(), cloudevents.NewEvent()))
+	assert.Equal(t, []string{"a", "b", "handler"}, calls)
+}
+
+func TestChainSendOrder(t *testing.T) {
+	var calls []string
+
+	mw := func(name string) protonats.SendMiddleware {
+		return func(next protonats.SendHandler) protonats.SendHandler {
+			return func(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+				calls = append(calls, name)
+				return next(ctx, in, transformers...)
+			}
+		}
+	}
+
+	h := protonats.ChainSend(func(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+		calls = append(calls, "publish")
+		return nil
+	}, mw("a"), mw("b"))
+
+	e := cloudevents.NewEvent()
+	require.NoError(t, h(context.Background(), (*binding.EventMessage)(&e)))
+	assert.Equal(t, []string{"a", "b", "publish"}, calls)
+}
+
+// onceMsg structured message which body can be read only once, like a transport stream
+type onceMsg struct {
+	data     []byte
+	read     bool
+	finished []error
+}
+
+func (m *onceMsg) ReadEncoding() binding.Encoding { return binding.EncodingStructured }
+
+func (m *onceMsg) ReadStructured(ctx context.Context, w binding.StructuredWriter) error {
+	if m.read {
+		return errors.New("message is already read")
+	}
+
+	m.read = true
+
+	return w.SetStructuredEvent(ctx, format.JSON, bytes.NewReader(m.data))
+}
+
+func (m *onceMsg) ReadBinary(context.Context, binding.BinaryWriter) error {
+	return binding.ErrNotBinary
+}
+
+func (m *onceMsg) Finish(err error) error {
+	m.finished = append(m.finished, err)
+	return nil
+}
+
+func TestSendMiddlewareReadOnceMessage(t *testing.T) {
+	conn := runServer(t)
+
+	sub, err := conn.SubscribeSync("orders.created")
+	require.NoError(t, err)
+
+	tl := tel.NewNull()
+	obs := protonats.NewTeleObservability(&tl, metricsReader()).(*protonats.TeleObservability)
+
+	s, err := protonats.NewSenderFromConnWithOptions(conn, "orders.created", protonats.WithSendMiddleware(obs.SendMiddleware()))
+	require.NoError(t, err)
+
+	e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	data, err := format.JSON.Marshal(&e)
+	require.NoError(t, err)
+
+	in := &onceMsg{data: data}
+	require.NoError(t, s.Send(tl.Ctx(), in))
+	assert.Equal(t, []error{nil}, in.finished)
+
+	msg, err := sub.NextMsg(time.Second)
+	require.NoError(t, err)
+
+	got, err := binding.ToEvent(context.Background(), cn.NewMessage(msg))
+	require.NoError(t, err)
+	assert.Equal(t, e.ID(), got.ID())
+	assert.NotNil(t, got.Extensions()[protonats.SendTimeExtension])
+}
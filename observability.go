@@ -2,15 +2,20 @@ package protonats
 
 import (
 	"context"
+	"errors"
 	"runtime"
 	"strings"
 	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/binding/buffering"
+	"github.com/cloudevents/sdk-go/v2/binding/transformer"
 	"github.com/cloudevents/sdk-go/v2/client"
 	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/cloudevents/sdk-go/v2/extensions"
 	"github.com/cloudevents/sdk-go/v2/observability"
+	"github.com/cloudevents/sdk-go/v2/protocol"
 	"github.com/d7561985/tel"
 	"github.com/d7561985/tel/monitoring/metrics"
 	"github.com/opentracing/opentracing-go"
@@ -20,6 +25,12 @@ import (
 
 const componentName = "cloud.events.protocol.nats.observability"
 
+// codes of AddReaderTopicFatalError metric
+const (
+	FatalCodeError = 1
+	FatalCodePanic = 2
+)
+
 type SpanNameFormatter func(cloudevents.Event) string
 type SpanAttrGetter func(cloudevents.Event) opentracing.Tags
 
@@ -33,6 +44,8 @@ type TeleObservability struct {
 
 	Metrics metrics.MetricsReader
 
+	metrics              Metrics
+	clockSkew            time.Duration
 	spanAttributesGetter SpanAttrGetter
 	spanNameFormatter    SpanNameFormatter
 }
@@ -41,6 +54,8 @@ func NewTeleObservability(t *tel.Telemetry, m metrics.MetricsReader, opts ...Obs
 	res := &TeleObservability{
 		Telemetry:            t,
 		Metrics:              m,
+		metrics:              NewNullMetrics(),
+		clockSkew:            DefaultLagClockSkew,
 		spanAttributesGetter: nil,
 		spanNameFormatter:    defaultSpanNameFormatter,
 	}
@@ -56,6 +71,16 @@ func NewTeleObservability(t *tel.Telemetry, m metrics.MetricsReader, opts ...Obs
 // creates new tracing brunch from provided inside context OpenTracing or tel data
 func (t *TeleObservability) RecordSendingEvent(_ctx context.Context, e event.Event) (context.Context, func(errOrResult error)) {
 	attr := t.GetSpanAttributes(e, getFuncName())
+	for k, v := range correlationTags(_ctx, e) {
+		attr[k] = v
+	}
+	if tenant := tenantOf(_ctx, e); tenant != "" {
+		attr[TenantAttr] = tenant
+	}
+	if cluster := ClusterFrom(_ctx); cluster != "" {
+		attr[ClusterAttr] = cluster
+	}
+
 	span, ctx := tel.StartSpanFromContext(_ctx, t.getSpanName(&e, "send"), attr)
 
 	ext.Component.Set(span, componentName)
@@ -63,6 +88,7 @@ func (t *TeleObservability) RecordSendingEvent(_ctx context.Context, e event.Eve
 
 	// inject tracing
 	InjectDistributedTracingExtension(ctx, &e)
+	e.SetExtension(SendTimeExtension, time.Now())
 
 	cb := func(err error) {
 		defer span.Finish()
@@ -86,19 +112,17 @@ func (t *TeleObservability) RecordCallingInvoker(_ctx context.Context, e *event.
 	opt := make([]opentracing.StartSpanOption, 0, 2)
 	opt = append(opt, t.GetSpanAttributes(*e, getFuncName()))
 
-	spanCtx, err := ExtractDistributedTracingExtension(t.Ctx(), e)
-	if err != nil {
+	m := t.tenantMetrics(tenantOf(_ctx, *e))
+
+	// reference extracted by inbound decorator from message, otherwise from decoded event
+	if ref, ok := _ctx.Value(opentracing.SpanReference{}).(opentracing.SpanReference); ok {
+		opt = append(opt, ref)
+	} else if spanCtx, err := ExtractDistributedTracingExtension(t.Ctx(), e); err != nil {
 		tel.FromCtx(_ctx).Error("extract distributed trace", zap.Error(err))
 	} else {
 		opt = append(opt, opentracing.ChildOf(spanCtx))
 	}
 
-	if ref := _ctx.Value(opentracing.SpanReference{}); ref != nil {
-		if v, ok := ref.(opentracing.SpanReference); ok {
-			opt = append(opt, v)
-		}
-	}
-
 	tr, start := t.Copy(), time.Now()
 	span, ctx := tr.StartSpan(t.getSpanName(e, "process"), opt...)
 
@@ -106,33 +130,126 @@ func (t *TeleObservability) RecordCallingInvoker(_ctx context.Context, e *event.
 	ext.SpanKindConsumer.Set(span)
 	tel.UpdateTraceFields(ctx)
 
+	t.recordLag(_ctx, *e, "", start)
+
+	if received, ok := _ctx.Value(receivedKey{}).(time.Time); ok {
+		latency := start.Sub(received)
+
+		if rm, ok := t.metrics.(ReceiveMetrics); ok {
+			rm.AddReceiveLatency(e.Type(), latency)
+		}
+
+		span.PutFields(zap.String("receive_latency", latency.String()))
+	}
+
 	cb := func(err error) {
 		defer span.Finish()
 
-		t.Metrics.AddReaderTopicHandlingTime(e.Type(), time.Since(start))
+		m.AddReaderTopicHandlingTime(e.Type(), time.Since(start))
 		span.PutFields(zap.String("duration", time.Since(start).String()))
 
+		var pe *PanicError
+		if errors.As(err, &pe) {
+			m.AddReaderTopicFatalError(e.Type(), FatalCodePanic)
+			m.AddReaderTopicProcessError(e.Type())
+			m.AddReaderTopicErrorEvents(e.Type(), 1)
+
+			span.Error("handler panic", zap.Error(err), zap.String("stack", string(pe.Stack)))
+			return
+		}
+
 		if err != nil {
-			t.Metrics.AddReaderTopicFatalError(e.Type(), 1)
-			t.Metrics.AddReaderTopicProcessError(e.Type())
-			t.Metrics.AddReaderTopicErrorEvents(e.Type(), 1)
+			m.AddReaderTopicFatalError(e.Type(), FatalCodeError)
+			m.AddReaderTopicProcessError(e.Type())
+			m.AddReaderTopicErrorEvents(e.Type(), 1)
 
 			span.PutFields(zap.Error(err))
 			return
 		}
 
-		t.Metrics.AddReaderTopicDecodeEvents(e.Type(), 1)
+		m.AddReaderTopicDecodeEvents(e.Type(), 1)
 	}
 
-	t.Metrics.AddReaderTopicReadEvents(e.Type(), 1)
+	m.AddReaderTopicReadEvents(e.Type(), 1)
 
-	return ctx, cb
+	return WithCausingEvent(inherit(_ctx, ctx), *e), cb
+}
+
+// RecordBatch consumer batch interceptor, batch span follows from every event trace.
+// Batch size is reported as read events and latency as handling time of the subject,
+// their distributions go to Metrics implementing BatchMetrics.
+func (t *TeleObservability) RecordBatch(_ctx context.Context, subject string, events []cloudevents.Event) (context.Context, func(errOrResult error)) {
+	opt := make([]opentracing.StartSpanOption, 0, len(events)+1)
+	tags := opentracing.Tags{"batch.size": len(events), "batch.subject": subject}
+
+	tenant := TenantFrom(_ctx)
+	if tenant == "" && len(events) > 0 {
+		tenant = EventTenant(events[0])
+	}
+	if tenant != "" {
+		tags[TenantAttr] = tenant
+	}
+
+	opt = append(opt, tags)
+	m := t.tenantMetrics(tenant)
+
+	for i := range events {
+		if spanCtx, err := ExtractDistributedTracingExtension(t.Ctx(), &events[i]); err == nil {
+			opt = append(opt, opentracing.FollowsFrom(spanCtx))
+		}
+	}
+
+	tr, start := t.Copy(), time.Now()
+	span, ctx := tr.StartSpan(observability.ClientSpanName+"."+subject+" batch process", opt...)
+
+	ext.Component.Set(span, componentName)
+	ext.SpanKindConsumer.Set(span)
+	tel.UpdateTraceFields(ctx)
+
+	m.AddReaderTopicReadEvents(subject, len(events))
+
+	for i := range events {
+		t.recordLag(_ctx, events[i], subject, start)
+	}
+
+	cb := func(err error) {
+		defer span.Finish()
+
+		m.AddReaderTopicHandlingTime(subject, time.Since(start))
+		span.PutFields(zap.String("duration", time.Since(start).String()))
+
+		if bm, ok := t.metrics.(BatchMetrics); ok {
+			bm.AddBatch(subject, len(events), time.Since(start), err)
+		}
+
+		var be BatchError
+		switch {
+		case err == nil:
+			m.AddReaderTopicCommitEvents(subject, len(events))
+		case errors.As(err, &be):
+			m.AddReaderTopicCommitEvents(subject, len(events)-len(be))
+			m.AddReaderTopicErrorEvents(subject, len(be))
+			span.PutFields(zap.Error(err))
+		default:
+			m.AddReaderTopicProcessError(subject)
+			m.AddReaderTopicErrorEvents(subject, len(events))
+			span.Error("batch handler", zap.Error(err))
+		}
+	}
+
+	return inherit(_ctx, ctx), cb
 }
 
-// RecordReceivedMalformedEvent if content is unpredictable
+// RecordReceivedMalformedEvent if content is unpredictable.
+// Span is child of producer trace when context is decorated by InboundContextDecorators.
 func (t *TeleObservability) RecordReceivedMalformedEvent(ctx context.Context, err error) {
+	var opt []opentracing.StartSpanOption
+	if ref, ok := ctx.Value(opentracing.SpanReference{}).(opentracing.SpanReference); ok {
+		opt = append(opt, ref)
+	}
+
 	spanName := observability.ClientSpanName + ".malformed receive"
-	span, _ := tel.FromCtx(ctx).StartSpan(spanName)
+	span, _ := tel.FromCtx(ctx).StartSpan(spanName, opt...)
 	defer span.Finish()
 
 	ext.Component.Set(span, componentName)
@@ -145,6 +262,96 @@ func (t TeleObservability) RecordRequestEvent(ctx context.Context, _ event.Event
 	return ctx, func(errOrResult error, e *event.Event) {}
 }
 
+// Middleware offers RecordCallingInvoker as consumer Middleware.
+// Use it when events are dispatched by Consumer.StartReceiver rather than by cloudevents client with this service,
+// WithObservability adds it together with inbound decorators.
+func (t *TeleObservability) Middleware() Middleware {
+	return invokerMiddleware(t)
+}
+
+func invokerMiddleware(obs client.ObservabilityService) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, e cloudevents.Event) protocol.Result {
+			ctx, cb := obs.RecordCallingInvoker(ctx, &e)
+
+			res := next(ctx, e)
+			cb(res)
+
+			return res
+		}
+	}
+}
+
+// SendMiddleware offers RecordSendingEvent as sender SendMiddleware.
+// Trace carrier is delivered with transformer. Message which isn't binding.EventMessage may be readable only once,
+// so it is buffered before it is read as event, buffered message finishes the original one.
+func (t *TeleObservability) SendMiddleware() SendMiddleware {
+	return func(next SendHandler) SendHandler {
+		return func(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+			if in.ReadEncoding() != binding.EncodingEvent {
+				buffered, err := buffering.BufferMessage(ctx, in)
+				if err != nil {
+					_ = in.Finish(err)
+					return err
+				}
+
+				in = buffered
+			}
+
+			e, err := binding.ToEvent(ctx, in)
+			if err != nil {
+				tel.FromCtx(ctx).Warn("send middleware read event", zap.Error(err))
+				return next(ctx, in, transformers...)
+			}
+
+			ctx, cb := t.RecordSendingEvent(ctx, *e)
+
+			for _, name := range []string{extensions.TraceStateExtension, SendTimeExtension} {
+				if v, ok := e.Extensions()[name]; ok {
+					transformers = append(transformers, transformer.SetExtension(name,
+						func(interface{}) (interface{}, error) { return v, nil }))
+				}
+			}
+
+			err = next(ctx, in, transformers...)
+			cb(err)
+
+			return err
+		}
+	}
+}
+
+// tenantMetrics labels metrics by tenant when Metrics is TenantMetricsReader
+func (t *TeleObservability) tenantMetrics(tenant string) metrics.MetricsReader {
+	if tm, ok := t.Metrics.(TenantMetricsReader); ok && tenant != "" {
+		return tm.ForTenant(tenant)
+	}
+
+	return t.Metrics
+}
+
+// inheritedCtx resolves values of span context first, then values of the parent.
+// Deadline and cancellation belong to the parent.
+type inheritedCtx struct {
+	context.Context
+
+	span context.Context
+}
+
+func (c inheritedCtx) Value(key interface{}) interface{} {
+	if v := c.span.Value(key); v != nil {
+		return v
+	}
+
+	return c.Context.Value(key)
+}
+
+// inherit keeps values put into handler context by Consumer (metadata, tenant etc.) within span context,
+// otherwise handlers behind observability middleware lose them
+func inherit(parent, span context.Context) context.Context {
+	return inheritedCtx{Context: parent, span: span}
+}
+
 // getSpanName Returns the name of the span.
 //
 // When no spanNameFormatter is present in OTelObservabilityService,
@@ -163,9 +370,41 @@ func (t TeleObservability) getSpanName(e *cloudevents.Event, suffix string) stri
 	return name
 }
 
-// Extracts the traceparent from the msg and enriches the context to enable propagation
+type receivedKey struct{}
+
+// Extracts the traceparent from the msg and enriches the context to enable propagation.
+// Event isn't decoded: carrier is read by MessageTraceCarrier, so malformed events keep producer trace as well.
+// Receive time is kept for receive latency of RecordCallingInvoker.
 func (t *TeleObservability) tracePropagatorContextDecorator(ctx context.Context, msg binding.Message) context.Context {
-	return t.Copy().Ctx()
+	tr := t.Copy()
+	res := context.WithValue(inherit(ctx, tr.Ctx()), receivedKey{}, receivedAt(msg))
+
+	// subject of event lag for events dispatched by cloudevents client
+	if m := natsMsgOf(msg); m != nil && NatsMsgFrom(ctx) == nil {
+		res = WithNatsMsg(res, m)
+	}
+
+	carrier := MessageTraceCarrier(msg)
+	if carrier == "" {
+		return res
+	}
+
+	spanCtx, err := DecodeSpanContext(tr.Ctx(), carrier)
+	if err != nil {
+		tr.Warn("extract message trace", zap.Error(err))
+		return res
+	}
+
+	return context.WithValue(res, opentracing.SpanReference{}, opentracing.ChildOf(spanCtx))
+}
+
+// receivedAt time when Receiver got the message, now for other messages
+func receivedAt(msg binding.Message) time.Time {
+	if m, ok := msg.(*Message); ok && !m.received.IsZero() {
+		return m.received
+	}
+
+	return time.Now()
 }
 
 func getFuncName() string {
@@ -199,6 +438,12 @@ func (t *TeleObservability) GetSpanAttributes(e cloudevents.Event, method string
 	if dct := e.DataContentType(); dct != "" {
 		attr[observability.DatacontenttypeAttr] = dct
 	}
+	for k, v := range correlationTags(context.Background(), e) {
+		attr[k] = v
+	}
+	if tenant := EventTenant(e); tenant != "" {
+		attr[TenantAttr] = tenant
+	}
 	if t.spanAttributesGetter != nil {
 		a := t.spanAttributesGetter(e)
 		for k, v := range a {
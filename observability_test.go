@@ -0,0 +1,41 @@
+package protonats_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/d7561985/protonats"
+	"github.com/d7561985/tel"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+type ctxKey struct{}
+
+func TestRecordCallingInvokerContext(t *testing.T) {
+	tl := tel.NewNull()
+	obs := protonats.NewTeleObservability(&tl, metricsReader()).(*protonats.TeleObservability)
+
+	meta := &nats.MsgMetadata{Stream: "ORDERS"}
+	msg := &nats.Msg{Subject: "orders.created"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = protonats.WithMsgMetadata(protonats.WithNatsMsg(protonats.WithTenant(ctx, "acme"), msg), meta)
+	ctx = context.WithValue(ctx, ctxKey{}, "value")
+
+	e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+
+	res, cb := obs.RecordCallingInvoker(ctx, &e)
+	defer cb(nil)
+
+	// values of the consumer context stay visible behind span
+	assert.Equal(t, meta, protonats.MsgMetadataFrom(res))
+	assert.Equal(t, msg, protonats.NatsMsgFrom(res))
+	assert.Equal(t, "acme", protonats.TenantFrom(res))
+	assert.Equal(t, "value", res.Value(ctxKey{}))
+	assert.NotNil(t, tel.FromCtx(res))
+
+	// cancellation belongs to the consumer context
+	cancel()
+	assert.Error(t, res.Err())
+}
@@ -2,8 +2,13 @@ package protonats
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
-	"github.com/cloudevents/sdk-go/protocol/nats/v2"
+	cn "github.com/cloudevents/sdk-go/protocol/nats/v2"
+	"github.com/cloudevents/sdk-go/v2/client"
+	"github.com/d7561985/tel/monitoring/metrics"
+	"github.com/nats-io/nats.go"
 )
 
 var ErrEmptySubject = errors.New("empty subject list")
@@ -12,7 +17,7 @@ var ErrEmptySubject = errors.New("empty subject list")
 func WithQueueSubscriber(queue string) ConsumerOption {
 	return func(c *Consumer) error {
 		if queue == "" {
-			return nats.ErrInvalidQueueName
+			return cn.ErrInvalidQueueName
 		}
 		c.Subscriber = &QueueSubscriber{Queue: queue}
 		return nil
@@ -23,7 +28,7 @@ func WithQueueSubscriber(queue string) ConsumerOption {
 func WithQueuePoolSubscriber(queue string, subject ...string) ConsumerOption {
 	return func(c *Consumer) error {
 		if queue == "" {
-			return nats.ErrInvalidQueueName
+			return cn.ErrInvalidQueueName
 		}
 
 		if len(subject) == 0 {
@@ -35,6 +40,175 @@ func WithQueuePoolSubscriber(queue string, subject ...string) ConsumerOption {
 	}
 }
 
+// WithReceiveBuffer sets capacity of the channel subscriptions deliver into.
+// NATS drops messages as slow consumer when the channel is full, so bursty subjects require a buffer.
+func WithReceiveBuffer(size int) ConsumerOption {
+	return func(c *Consumer) error {
+		if size > 0 {
+			c.ch = make(chan *nats.Msg, size)
+		}
+		return nil
+	}
+}
+
+// WithJetStreamSubscriber configures the Consumer to use JetStream push subscription with manual acknowledgement
+func WithJetStreamSubscriber(queue string, opts ...nats.SubOpt) ConsumerOption {
+	return func(c *Consumer) error {
+		c.Subscriber = &JetStreamSubscriber{Queue: queue, SubOptions: opts}
+		return nil
+	}
+}
+
+// WithFailureHandler configures how messages not acknowledged by handler are settled, NakOnFailure by default.
+// Malformed messages are never redelivered: they are terminated or published to WithDeadLetter subject.
+func WithFailureHandler(fn FailureHandler) ConsumerOption {
+	return func(c *Consumer) error {
+		if fn != nil {
+			c.onFailure = fn
+		}
+		return nil
+	}
+}
+
+// WithDeadLetter publishes messages failed by handler and malformed messages to the subject
+func WithDeadLetter(subject string) ConsumerOption {
+	return func(c *Consumer) error {
+		if subject == "" {
+			return ErrEmptySubject
+		}
+
+		c.onFailure = DeadLetterOnFailure(c.Conn, subject)
+		c.malformed = c.onFailure
+		return nil
+	}
+}
+
+// WithIdempotency drops already processed events, see Idempotent
+func WithIdempotency(store DedupStore, m metrics.MetricsReader) ConsumerOption {
+	return func(c *Consumer) error {
+		c.middlewares = append(c.middlewares, Idempotent(store, m))
+		return nil
+	}
+}
+
+// WithPolicy authorizes events before any other middleware, see Authorize.
+// Denied JetStream messages are terminated or published to WithPolicyDeadLetter subject.
+func WithPolicy(p Policy, opts ...PolicyOption) ConsumerOption {
+	return func(c *Consumer) error {
+		cfg := policyConfig{metrics: nullMetrics{}}
+		for _, fn := range opts {
+			fn(&cfg)
+		}
+
+		c.denied = TermOnFailure()
+		if cfg.deadLetter != "" {
+			c.denied = DeadLetterOnFailure(c.Conn, cfg.deadLetter)
+		}
+
+		c.middlewares = append([]Middleware{Authorize(p, cfg.metrics)}, c.middlewares...)
+		return nil
+	}
+}
+
+// WithMiddleware appends middlewares to the Consumer handler chain, the first one is the outermost
+func WithMiddleware(mw ...Middleware) ConsumerOption {
+	return func(c *Consumer) error {
+		c.middlewares = append(c.middlewares, mw...)
+		return nil
+	}
+}
+
+// WithObservability records consumer with obs: its inbound context decorators run before event is decoded,
+// so malformed events are recorded within producer trace, and RecordCallingInvoker middleware is appended.
+func WithObservability(obs client.ObservabilityService) ConsumerOption {
+	return func(c *Consumer) error {
+		c.obs = obs
+		c.middlewares = append(c.middlewares, invokerMiddleware(obs))
+		return nil
+	}
+}
+
+// WithConcurrency limits number of handlers StartReceiver runs at once, unlimited by default.
+// Concurrency 1 handles messages one by one in delivery order.
+func WithConcurrency(n int) ConsumerOption {
+	return func(c *Consumer) error {
+		if n < 0 {
+			return fmt.Errorf("concurrency should not be negative, got %d", n)
+		}
+
+		c.concurrency = n
+		return nil
+	}
+}
+
+// WithReceiveRateLimit slows Receive down by message subject and event type, see RateLimiter.
+// Message rejected by limiter (zero burst, consumer stopping) goes to the failure handler, receiving continues.
+// Only JetStream keeps rejected messages for redelivery, rejected core NATS messages are logged and dropped.
+func WithReceiveRateLimit(l *RateLimiter) ConsumerOption {
+	return func(c *Consumer) error {
+		c.limiter = l
+		return nil
+	}
+}
+
+// WithSendMiddleware appends middlewares to the Sender send chain, the first one is the outermost
+func WithSendMiddleware(mw ...SendMiddleware) SenderOption {
+	return func(s *Sender) error {
+		s.middlewares = append(s.middlewares, mw...)
+		return nil
+	}
+}
+
+// WithNatsSenderOptions applies cloudevents NATS sender options to the underlying sender
+func WithNatsSenderOptions(opts ...cn.SenderOption) SenderOption {
+	return func(s *Sender) error {
+		for _, fn := range opts {
+			if err := fn(s.Sender); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// WithSendRateLimit throttles Send by subject and event type, see RateLimiter.
+// Send blocks for a token or fails fast with ErrRateLimited when ctx deadline comes earlier.
+func WithSendRateLimit(l *RateLimiter) SenderOption {
+	return func(s *Sender) error {
+		s.middlewares = append(s.middlewares, RateLimitSend(l, s.Subject))
+		return nil
+	}
+}
+
+// WithCircuitBreaker fails Send fast with CircuitOpenError while NATS publishes keep failing, see CircuitBreaker
+func WithCircuitBreaker(b *CircuitBreaker) SenderOption {
+	return func(s *Sender) error {
+		s.middlewares = append(s.middlewares, BreakSend(b))
+		return nil
+	}
+}
+
+// WithSpool queues events into disk spool while NATS is disconnected, Sender.RunSpool publishes them after reconnect
+func WithSpool(sp *Spool) SenderOption {
+	return func(s *Sender) error {
+		s.spool = sp
+		return nil
+	}
+}
+
+// WithJetStreamPublish publishes into JetStream and returns Send only after stream stored the event, PubAck error fails Send
+func WithJetStreamPublish(opts ...nats.JSOpt) SenderOption {
+	return func(s *Sender) error {
+		js, err := s.Conn.JetStream(opts...)
+		if err != nil {
+			return err
+		}
+
+		s.js = js
+		return nil
+	}
+}
+
 type ObservabilityOption func(*TeleObservability)
 
 // WithSpanAttributesGetter appends the returned attributes from the function to the span.
@@ -46,6 +220,26 @@ func WithSpanAttributesGetter(attrGetter SpanAttrGetter) ObservabilityOption {
 	}
 }
 
+// WithObservabilityMetrics reports receive latency, event lag and pull batches
+// into m implementing ReceiveMetrics, LagMetrics and BatchMetrics
+func WithObservabilityMetrics(m Metrics) ObservabilityOption {
+	return func(os *TeleObservability) {
+		if m != nil {
+			os.metrics = m
+		}
+	}
+}
+
+// WithLagClockSkew tolerated producer clock skew of event lag, DefaultLagClockSkew by default.
+// Lag more negative than -d isn't reported, see LagMetrics.AddEventLagSkewed.
+func WithLagClockSkew(d time.Duration) ObservabilityOption {
+	return func(os *TeleObservability) {
+		if d >= 0 {
+			os.clockSkew = d
+		}
+	}
+}
+
 // WithSpanNameFormatter replaces the default span name with the string returned from the function
 func WithSpanNameFormatter(nameFormatter SpanNameFormatter) ObservabilityOption {
 	return func(os *TeleObservability) {
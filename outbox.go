@@ -0,0 +1,364 @@
+package protonats
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/tel"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var ErrOutboxNoSubject = errors.New("outbox: subject is not set neither by context topic nor by default")
+
+// OutboxRecord event waiting for publish
+type OutboxRecord struct {
+	ID      string
+	Subject string
+	// MsgID is JetStream Nats-Msg-Id which prevents duplicates when relay publishes record more than once
+	MsgID string
+	// Data is structured JSON event
+	Data []byte
+
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// Execer is satisfied by both *sql.Tx and *sql.DB
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// OutboxStore persists events together with business data and hands them to Relay
+type OutboxStore interface {
+	// Add stores record using caller transaction
+	Add(ctx context.Context, tx Execer, r OutboxRecord) error
+	// Pending returns up to limit not sent and not parked records in creation order
+	Pending(ctx context.Context, limit int) ([]OutboxRecord, error)
+	// MarkSent excludes record from Pending
+	MarkSent(ctx context.Context, id string) error
+	// MarkFailed notes unsuccessful publish attempt
+	MarkFailed(ctx context.Context, id string, cause error) error
+	// Park excludes record which failed too many times from Pending, it's kept for inspection
+	Park(ctx context.Context, id string) error
+}
+
+// Outbox writes events into OutboxStore instead of sending them directly
+type Outbox struct {
+	Store OutboxStore
+
+	// Subject is used when context has no topic, see cecontext.WithTopic
+	Subject string
+}
+
+func NewOutbox(store OutboxStore, subject string) *Outbox {
+	return &Outbox{Store: store, Subject: subject}
+}
+
+// Add stores event inside caller transaction tx, so event is published only when transaction commits
+func (o *Outbox) Add(ctx context.Context, tx Execer, e cloudevents.Event) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+
+	subject := o.Subject
+	if topic := cecontext.TopicFrom(ctx); topic != "" {
+		subject = topic
+	}
+
+	if subject == "" {
+		return ErrOutboxNoSubject
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("outbox encode event: %w", err)
+	}
+
+	return o.Store.Add(ctx, tx, OutboxRecord{
+		ID:        uuid.New().String(),
+		Subject:   subject,
+		MsgID:     e.Source() + "/" + e.ID(),
+		Data:      data,
+		CreatedAt: time.Now(),
+	})
+}
+
+// Relay publishes pending outbox records through sender and marks them sent once Send succeeds.
+// Records are published in creation order, on failure the rest of the batch waits for the next run.
+// Record failed by maxAttempts runs is parked, so it doesn't block later records.
+type Relay struct {
+	store  OutboxStore
+	sender protocol.Sender
+
+	interval    time.Duration
+	batch       int
+	attempts    int
+	backoff     time.Duration
+	maxAttempts int
+}
+
+type RelayOption func(*Relay)
+
+// WithRelayInterval sets pause between store polls
+func WithRelayInterval(d time.Duration) RelayOption {
+	return func(r *Relay) {
+		if d > 0 {
+			r.interval = d
+		}
+	}
+}
+
+// WithRelayBatchSize sets max records fetched from store per poll
+func WithRelayBatchSize(n int) RelayOption {
+	return func(r *Relay) {
+		if n > 0 {
+			r.batch = n
+		}
+	}
+}
+
+// WithRelayRetry sets publish attempts per record inside single poll with linear backoff
+func WithRelayRetry(attempts int, backoff time.Duration) RelayOption {
+	return func(r *Relay) {
+		if attempts > 0 {
+			r.attempts = attempts
+		}
+		r.backoff = backoff
+	}
+}
+
+// WithRelayMaxAttempts sets number of failed runs after which record is parked, 10 by default
+func WithRelayMaxAttempts(n int) RelayOption {
+	return func(r *Relay) {
+		if n > 0 {
+			r.maxAttempts = n
+		}
+	}
+}
+
+// NewRelay publishes through sender, Sender with WithJetStreamPublish marks records sent only after PubAck.
+// Subjects of records should be covered by a stream, so Nats-Msg-Id drops duplicates.
+func NewRelay(store OutboxStore, sender protocol.Sender, opts ...RelayOption) *Relay {
+	r := &Relay{
+		store:       store,
+		sender:      sender,
+		interval:    time.Second,
+		batch:       100,
+		attempts:    3,
+		backoff:     100 * time.Millisecond,
+		maxAttempts: 10,
+	}
+
+	for _, fn := range opts {
+		fn(r)
+	}
+
+	return r
+}
+
+// Run polls store until ctx done
+func (r *Relay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.Flush(ctx); err != nil && ctx.Err() == nil {
+			tel.FromCtx(ctx).Warn("outbox relay flush", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Flush publishes single batch of pending records and returns number of sent ones
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	records, err := r.store.Pending(ctx, r.batch)
+	if err != nil {
+		return 0, fmt.Errorf("outbox pending: %w", err)
+	}
+
+	for i, rec := range records {
+		if err = r.publish(ctx, rec); err != nil {
+			if mErr := r.store.MarkFailed(ctx, rec.ID, err); mErr != nil {
+				tel.FromCtx(ctx).Warn("outbox mark failed", zap.Error(mErr), zap.String("id", rec.ID))
+			}
+
+			if rec.Attempts+1 >= r.maxAttempts {
+				tel.FromCtx(ctx).Error("outbox park record", zap.Error(err), zap.String("id", rec.ID))
+
+				if pErr := r.store.Park(ctx, rec.ID); pErr != nil {
+					tel.FromCtx(ctx).Warn("outbox park", zap.Error(pErr), zap.String("id", rec.ID))
+				}
+			}
+
+			return i, fmt.Errorf("outbox publish %s: %w", rec.ID, err)
+		}
+
+		if err = r.store.MarkSent(ctx, rec.ID); err != nil {
+			// record would be published again, JetStream drops it by Nats-Msg-Id
+			return i, fmt.Errorf("outbox mark sent %s: %w", rec.ID, err)
+		}
+	}
+
+	return len(records), nil
+}
+
+// publish sends event of record into its subject with record Nats-Msg-Id
+func (r *Relay) publish(ctx context.Context, rec OutboxRecord) (err error) {
+	e := cloudevents.NewEvent()
+	if err = json.Unmarshal(rec.Data, &e); err != nil {
+		return fmt.Errorf("decode event: %w", err)
+	}
+
+	ctx = WithMsgID(cecontext.WithTopic(ctx, rec.Subject), rec.MsgID)
+
+	for i := 0; i < r.attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(i) * r.backoff):
+			}
+		}
+
+		if err = r.sender.Send(ctx, (*binding.EventMessage)(&e)); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// SQLOutboxStore database/sql OutboxStore reference implementation, DDL is portable between SQLite and PostgreSQL.
+// It expects single Relay instance per table.
+type SQLOutboxStore struct {
+	DB    *sql.DB
+	Table string
+
+	// Placeholder renders n-th (1 based) query argument, QuestionPlaceholder by default
+	Placeholder func(n int) string
+}
+
+// QuestionPlaceholder SQLite and MySQL style
+func QuestionPlaceholder(int) string { return "?" }
+
+// DollarPlaceholder PostgreSQL style
+func DollarPlaceholder(n int) string { return "$" + strconv.Itoa(n) }
+
+func NewSQLOutboxStore(db *sql.DB, table string) *SQLOutboxStore {
+	return &SQLOutboxStore{DB: db, Table: table, Placeholder: QuestionPlaceholder}
+}
+
+// CreateTable creates outbox table if not exists
+func (s *SQLOutboxStore) CreateTable(ctx context.Context) error {
+	_, err := s.DB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+s.Table+` (
+	id         VARCHAR(36) PRIMARY KEY,
+	subject    TEXT NOT NULL,
+	msg_id     TEXT NOT NULL,
+	data       TEXT NOT NULL,
+	attempts   INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	created_at BIGINT NOT NULL,
+	sent_at    BIGINT,
+	parked_at  BIGINT
+)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS `+s.Table+`_pending ON `+s.Table+` (sent_at, parked_at, created_at)`)
+	return err
+}
+
+// Add implements OutboxStore.Add
+func (s *SQLOutboxStore) Add(ctx context.Context, tx Execer, r OutboxRecord) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO `+s.Table+` (id, subject, msg_id, data, created_at) VALUES (`+s.args(1, 5)+`)`,
+		r.ID, r.Subject, r.MsgID, string(r.Data), r.CreatedAt.UnixNano())
+
+	return err
+}
+
+// Pending implements OutboxStore.Pending
+func (s *SQLOutboxStore) Pending(ctx context.Context, limit int) ([]OutboxRecord, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, subject, msg_id, data, attempts, created_at FROM `+s.Table+
+			` WHERE sent_at IS NULL AND parked_at IS NULL ORDER BY created_at LIMIT `+s.args(1, 1), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	res := make([]OutboxRecord, 0, limit)
+	for rows.Next() {
+		var (
+			r       OutboxRecord
+			data    string
+			created int64
+		)
+
+		if err = rows.Scan(&r.ID, &r.Subject, &r.MsgID, &data, &r.Attempts, &created); err != nil {
+			return nil, err
+		}
+
+		r.Data, r.CreatedAt = []byte(data), time.Unix(0, created)
+		res = append(res, r)
+	}
+
+	return res, rows.Err()
+}
+
+// MarkSent implements OutboxStore.MarkSent
+func (s *SQLOutboxStore) MarkSent(ctx context.Context, id string) error {
+	_, err := s.DB.ExecContext(ctx,
+		`UPDATE `+s.Table+` SET sent_at = `+s.Placeholder(1)+` WHERE id = `+s.Placeholder(2),
+		time.Now().UnixNano(), id)
+
+	return err
+}
+
+// MarkFailed implements OutboxStore.MarkFailed
+func (s *SQLOutboxStore) MarkFailed(ctx context.Context, id string, cause error) error {
+	_, err := s.DB.ExecContext(ctx,
+		`UPDATE `+s.Table+` SET attempts = attempts + 1, last_error = `+s.Placeholder(1)+` WHERE id = `+s.Placeholder(2),
+		cause.Error(), id)
+
+	return err
+}
+
+// Park implements OutboxStore.Park
+func (s *SQLOutboxStore) Park(ctx context.Context, id string) error {
+	_, err := s.DB.ExecContext(ctx,
+		`UPDATE `+s.Table+` SET parked_at = `+s.Placeholder(1)+` WHERE id = `+s.Placeholder(2),
+		time.Now().UnixNano(), id)
+
+	return err
+}
+
+// args renders n placeholders starting from 'from'
+func (s *SQLOutboxStore) args(from, n int) string {
+	res := make([]string, 0, n)
+	for i := from; i < from+n; i++ {
+		res = append(res, s.Placeholder(i))
+	}
+
+	return strings.Join(res, ", ")
+}
+
+var _ OutboxStore = (*SQLOutboxStore)(nil)
@@ -0,0 +1,223 @@
+package protonats_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/d7561985/protonats"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// relaySender records sends unless subject fails
+type relaySender struct {
+	mu       sync.Mutex
+	subjects []string
+	msgIDs   []string
+	fails    map[string]int // subject => number of failing sends, -1 forever
+}
+
+func (f *relaySender) Send(ctx context.Context, in binding.Message, _ ...binding.Transformer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subject := cecontext.TopicFrom(ctx)
+	if n := f.fails[subject]; n != 0 {
+		f.fails[subject] = n - 1
+		return nats.ErrNoResponders
+	}
+
+	f.subjects = append(f.subjects, subject)
+	f.msgIDs = append(f.msgIDs, protonats.MsgIDFrom(ctx))
+
+	return nil
+}
+
+func (f *relaySender) sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string{}, f.subjects...)
+}
+
+func newSQLOutbox(t *testing.T) (*sql.DB, *protonats.SQLOutboxStore) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "outbox.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	store := protonats.NewSQLOutboxStore(db, "outbox")
+	require.NoError(t, store.CreateTable(context.Background()))
+
+	return db, store
+}
+
+func addOutbox(t *testing.T, db *sql.DB, store *protonats.SQLOutboxStore, subject, id string) {
+	ctx := context.Background()
+
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, protonats.NewOutbox(store, subject).Add(ctx, tx, newEvent(t, "orders.created", orderCreated{ID: id})))
+	require.NoError(t, tx.Commit())
+
+	// created_at keeps order
+	time.Sleep(time.Millisecond)
+}
+
+func TestSQLOutboxStore(t *testing.T) {
+	ctx := context.Background()
+	db, store := newSQLOutbox(t)
+
+	addOutbox(t, db, store, "orders.a", "o1")
+	addOutbox(t, db, store, "orders.b", "o2")
+
+	// rolled back record is never pending
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, protonats.NewOutbox(store, "orders.c").Add(ctx, tx, newEvent(t, "orders.created", orderCreated{ID: "o3"})))
+	require.NoError(t, tx.Rollback())
+
+	recs, err := store.Pending(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	assert.Equal(t, "orders.a", recs[0].Subject)
+	assert.Equal(t, "orders.b", recs[1].Subject)
+
+	require.NoError(t, store.MarkFailed(ctx, recs[0].ID, errors.New("boom")))
+	require.NoError(t, store.MarkSent(ctx, recs[1].ID))
+
+	recs, err = store.Pending(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	assert.Equal(t, 1, recs[0].Attempts)
+
+	require.NoError(t, store.Park(ctx, recs[0].ID))
+
+	recs, err = store.Pending(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, recs)
+}
+
+func TestRelayFlush(t *testing.T) {
+	ctx := context.Background()
+	db, store := newSQLOutbox(t)
+
+	addOutbox(t, db, store, "orders.a", "o1")
+	addOutbox(t, db, store, "orders.b", "o2")
+
+	sender := &relaySender{fails: map[string]int{}}
+
+	n, err := protonats.NewRelay(store, sender).Flush(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"orders.a", "orders.b"}, sender.sent())
+
+	// duplicates are dropped by stream
+	assert.NotEmpty(t, sender.msgIDs[0])
+
+	n, err = protonats.NewRelay(store, sender).Flush(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestRelayRetry(t *testing.T) {
+	ctx := context.Background()
+	db, store := newSQLOutbox(t)
+
+	addOutbox(t, db, store, "orders.a", "o1")
+
+	// two failures are covered by retries of single run
+	sender := &relaySender{fails: map[string]int{"orders.a": 2}}
+
+	n, err := protonats.NewRelay(store, sender, protonats.WithRelayRetry(3, time.Millisecond)).Flush(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestRelayParksPoisonRecord(t *testing.T) {
+	ctx := context.Background()
+	db, store := newSQLOutbox(t)
+
+	addOutbox(t, db, store, "orders.poison", "o1")
+	addOutbox(t, db, store, "orders.b", "o2")
+
+	sender := &relaySender{fails: map[string]int{"orders.poison": -1}}
+	relay := protonats.NewRelay(store, sender, protonats.WithRelayRetry(1, 0), protonats.WithRelayMaxAttempts(2))
+
+	// order is kept while record has attempts left
+	_, err := relay.Flush(ctx)
+	assert.Error(t, err)
+	assert.Empty(t, sender.sent())
+
+	_, err = relay.Flush(ctx)
+	assert.Error(t, err)
+
+	// parked record doesn't block the rest
+	n, err := relay.Flush(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"orders.b"}, sender.sent())
+}
+
+func TestRelayJetStream(t *testing.T) {
+	ctx := context.Background()
+	conn := runServer(t)
+	db, store := newSQLOutbox(t)
+
+	addOutbox(t, db, store, "orders.a", "o1")
+	addOutbox(t, db, store, "payments.a", "o2")
+
+	var sent []string
+	sender, err := protonats.NewSenderFromConnWithOptions(conn, "orders", protonats.WithJetStreamPublish(),
+		protonats.WithSendMiddleware(func(next protonats.SendHandler) protonats.SendHandler {
+			return func(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+				sent = append(sent, protonats.MsgIDFrom(ctx))
+				return next(ctx, in, transformers...)
+			}
+		}))
+	require.NoError(t, err)
+
+	relay := protonats.NewRelay(store, sender, protonats.WithRelayRetry(1, 0))
+
+	// subject outside of stream has no PubAck, record stays pending
+	n, err := relay.Flush(ctx)
+	assert.ErrorIs(t, err, nats.ErrNoStreamResponse)
+	assert.Equal(t, 1, n)
+	require.Len(t, sent, 2)
+
+	recs, err := store.Pending(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	assert.Equal(t, "payments.a", recs[0].Subject)
+
+	js, err := conn.JetStream()
+	require.NoError(t, err)
+
+	msg, err := js.GetMsg("ORDERS", 1)
+	require.NoError(t, err)
+	assert.Equal(t, sent[0], msg.Header.Get(nats.MsgIdHdr))
+
+	// republished record is dropped by stream
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, store.Add(ctx, tx, protonats.OutboxRecord{ID: "dup", Subject: "orders.a", MsgID: sent[0], Data: msg.Data}))
+	require.NoError(t, tx.Commit())
+	require.NoError(t, store.Park(ctx, recs[0].ID))
+
+	n, err = relay.Flush(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	info, err := js.StreamInfo("ORDERS")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), info.State.Msgs)
+}
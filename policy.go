@@ -0,0 +1,375 @@
+package protonats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/tel"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+// HeaderUserJWT message header with NATS user JWT of the publisher.
+// Header is set by the publisher and isn't bound to the connection which actually published the message:
+// user JWT is public bearer data, so anyone able to publish can replay JWT of another user.
+// Rely on it only together with subject permissions of NATS accounts.
+const HeaderUserJWT = "Protonats-User-Jwt"
+
+var (
+	ErrPolicyDenied = errors.New("policy: event denied")
+	// ErrPolicyUntrusted rules relying on user JWT require trusted accounts
+	ErrPolicyUntrusted = errors.New("policy: Issuers and Tags rules require trusted accounts")
+)
+
+// Policy authorizes consumed event, any error denies it
+type Policy func(ctx context.Context, e cloudevents.Event) error
+
+// PolicyDeniedError tells which rule denied the event
+type PolicyDeniedError struct {
+	Rule   string
+	Reason string
+}
+
+func (e *PolicyDeniedError) Error() string {
+	if e.Rule == "" {
+		return fmt.Sprintf("%s: %s", ErrPolicyDenied, e.Reason)
+	}
+
+	return fmt.Sprintf("%s by rule %q: %s", ErrPolicyDenied, e.Rule, e.Reason)
+}
+
+func (e *PolicyDeniedError) Unwrap() error { return ErrPolicyDenied }
+
+// PolicyRule matches event when every not empty condition matches.
+// Sources and Types are path.Match patterns, Subjects are NATS subject patterns with * and > wildcards.
+// Issuers and Tags require publisher user JWT in HeaderUserJWT.
+type PolicyRule struct {
+	Name string
+	// Deny denies matched events, otherwise they are allowed
+	Deny bool
+
+	Sources  []string
+	Types    []string
+	Subjects []string
+
+	// Issuers accounts or signing keys one of which issued user JWT
+	Issuers []string
+	// Tags user JWT must have all of them
+	Tags []string
+}
+
+// PolicyEngine built-in Policy: the first matched rule decides, events matching no rule are denied by default.
+//
+// User JWT from HeaderUserJWT is always verified when present: signature, expiration,
+// trusted issuer and publish permission for the message subject.
+type PolicyEngine struct {
+	rules        []PolicyRule
+	defaultAllow bool
+	requireJWT   bool
+	// trusted issuer keys to their account
+	trusted map[string]string
+	err     error
+}
+
+type PolicyEngineOption func(*PolicyEngine)
+
+// WithPolicyDefaultAllow allows events matching no rule
+func WithPolicyDefaultAllow() PolicyEngineOption {
+	return func(p *PolicyEngine) { p.defaultAllow = true }
+}
+
+// WithPolicyRequireJWT denies events without user JWT
+func WithPolicyRequireJWT() PolicyEngineOption {
+	return func(p *PolicyEngine) { p.requireJWT = true }
+}
+
+// WithPolicyTrustedAccounts accepts only user JWT issued directly by accounts
+func WithPolicyTrustedAccounts(keys ...string) PolicyEngineOption {
+	return func(p *PolicyEngine) {
+		for _, k := range keys {
+			p.trusted[k] = k
+		}
+	}
+}
+
+// WithPolicyTrustedAccountJWTs accepts user JWT issued by accounts or their signing keys.
+// Account JWT is configuration, it's decoded but its operator isn't verified.
+func WithPolicyTrustedAccountJWTs(tokens ...string) PolicyEngineOption {
+	return func(p *PolicyEngine) {
+		for _, token := range tokens {
+			claims, err := jwt.DecodeAccountClaims(token)
+			if err != nil {
+				p.err = fmt.Errorf("policy account jwt: %w", err)
+				return
+			}
+
+			p.trusted[claims.Subject] = claims.Subject
+			for key := range claims.SigningKeys {
+				p.trusted[key] = claims.Subject
+			}
+		}
+	}
+}
+
+// NewPolicyEngine fails with ErrPolicyUntrusted when rules have Issuers or Tags without trusted accounts:
+// any self-signed user JWT would satisfy them.
+func NewPolicyEngine(rules []PolicyRule, opts ...PolicyEngineOption) (*PolicyEngine, error) {
+	p := &PolicyEngine{
+		rules:   rules,
+		trusted: make(map[string]string),
+	}
+
+	for _, fn := range opts {
+		fn(p)
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	for _, r := range rules {
+		if (len(r.Issuers) > 0 || len(r.Tags) > 0) && len(p.trusted) == 0 {
+			return nil, fmt.Errorf("%w: rule %q", ErrPolicyUntrusted, r.Name)
+		}
+	}
+
+	return p, nil
+}
+
+// Check implements Policy
+func (p *PolicyEngine) Check(ctx context.Context, e cloudevents.Event) error {
+	var subject string
+	var header nats.Header
+
+	if msg := NatsMsgFrom(ctx); msg != nil {
+		subject, header = msg.Subject, msg.Header
+	}
+
+	claims, err := p.userClaims(header, subject)
+	if err != nil {
+		return &PolicyDeniedError{Reason: err.Error()}
+	}
+
+	for _, r := range p.rules {
+		if !r.match(e, subject, claims, p.account) {
+			continue
+		}
+
+		if r.Deny {
+			return &PolicyDeniedError{Rule: r.Name, Reason: fmt.Sprintf("event %s of type %s", e.ID(), e.Type())}
+		}
+
+		return nil
+	}
+
+	if p.defaultAllow {
+		return nil
+	}
+
+	return &PolicyDeniedError{Reason: fmt.Sprintf("no rule allows event %s of type %s", e.ID(), e.Type())}
+}
+
+// userClaims returns verified claims of header JWT, nil claims when there is no JWT
+func (p *PolicyEngine) userClaims(header nats.Header, subject string) (*jwt.UserClaims, error) {
+	token := header.Get(HeaderUserJWT)
+	if token == "" {
+		if p.requireJWT {
+			return nil, errors.New("user jwt required")
+		}
+
+		return nil, nil
+	}
+
+	// signature is verified by decode
+	claims, err := jwt.DecodeUserClaims(token)
+	if err != nil {
+		return nil, fmt.Errorf("user jwt: %w", err)
+	}
+
+	if claims.Expires > 0 && time.Now().Unix() > claims.Expires {
+		return nil, fmt.Errorf("user jwt %s expired", claims.Subject)
+	}
+
+	if len(p.trusted) > 0 && p.account(claims) == "" {
+		return nil, fmt.Errorf("user jwt %s issuer %s isn't trusted", claims.Subject, claims.Issuer)
+	}
+
+	if subject != "" && !canPublish(claims.Pub, subject) {
+		return nil, fmt.Errorf("user jwt %s has no publish permission for %s", claims.Subject, subject)
+	}
+
+	return claims, nil
+}
+
+// account returns trusted account of verified issuer, empty when issuer isn't trusted.
+// IssuerAccount is set by the token itself, so it's only checked against the account of issuer.
+func (p *PolicyEngine) account(claims *jwt.UserClaims) string {
+	acc, ok := p.trusted[claims.Issuer]
+	if !ok {
+		return ""
+	}
+
+	if claims.IssuerAccount != "" && claims.IssuerAccount != acc {
+		return ""
+	}
+
+	return acc
+}
+
+func (r PolicyRule) match(e cloudevents.Event, subject string, claims *jwt.UserClaims, account func(*jwt.UserClaims) string) bool {
+	if !matchGlob(r.Sources, e.Source()) || !matchGlob(r.Types, e.Type()) {
+		return false
+	}
+
+	if len(r.Subjects) > 0 && !matchSubjectAny(r.Subjects, subject) {
+		return false
+	}
+
+	if len(r.Issuers) == 0 && len(r.Tags) == 0 {
+		return true
+	}
+
+	if claims == nil {
+		return false
+	}
+
+	if len(r.Issuers) > 0 && !contains(r.Issuers, claims.Issuer) && !contains(r.Issuers, account(claims)) {
+		return false
+	}
+
+	for _, tag := range r.Tags {
+		if !claims.Tags.Contains(tag) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// canPublish applies NATS permission semantics: deny wins, empty allow list allows everything
+func canPublish(perm jwt.Permission, subject string) bool {
+	if matchSubjectAny(perm.Deny, subject) {
+		return false
+	}
+
+	return len(perm.Allow) == 0 || matchSubjectAny(perm.Allow, subject)
+}
+
+func matchGlob(patterns []string, v string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, v); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchSubjectAny(patterns []string, subject string) bool {
+	for _, p := range patterns {
+		if matchSubject(p, subject) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchSubject NATS wildcards: * matches one token, > matches the rest
+func matchSubject(pattern, subject string) bool {
+	pt, st := strings.Split(pattern, "."), strings.Split(subject, ".")
+
+	for i, tok := range pt {
+		if tok == ">" {
+			return len(st) > i
+		}
+
+		if i >= len(st) || (tok != "*" && tok != st[i]) {
+			return false
+		}
+	}
+
+	return len(pt) == len(st)
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v && v != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+type policyConfig struct {
+	metrics    PolicyMetrics
+	deadLetter string
+}
+
+// PolicyOption configures WithPolicy
+type PolicyOption func(*policyConfig)
+
+// WithPolicyMetrics reports denied events into m
+func WithPolicyMetrics(m PolicyMetrics) PolicyOption {
+	return func(c *policyConfig) {
+		if m != nil {
+			c.metrics = m
+		}
+	}
+}
+
+// WithPolicyDeadLetter publishes denied events to subject instead of dropping them
+func WithPolicyDeadLetter(subject string) PolicyOption {
+	return func(c *policyConfig) { c.deadLetter = subject }
+}
+
+// Authorize checks every event with policy before the handler, denied events aren't handled.
+// Denied events are counted by m, nil m discards them.
+func Authorize(p Policy, m PolicyMetrics) Middleware {
+	pm := m
+	if pm == nil {
+		pm = nullMetrics{}
+	}
+
+	return func(next Handler) Handler {
+		return func(ctx context.Context, e cloudevents.Event) protocol.Result {
+			err := p(ctx, e)
+			if err == nil {
+				return next(ctx, e)
+			}
+
+			var de *PolicyDeniedError
+			if !errors.As(err, &de) {
+				de = &PolicyDeniedError{Reason: err.Error()}
+			}
+
+			pm.AddPolicyDenied(de.Rule, e.Type())
+			tel.FromCtx(ctx).Warn("policy denied", zap.Error(de))
+
+			return de
+		}
+	}
+}
+
+// denyOnFailure denied events are terminated or dead-lettered, other failures follow next
+func denyOnFailure(denied, next FailureHandler) FailureHandler {
+	return func(msg *nats.Msg, result error) error {
+		if errors.Is(result, ErrPolicyDenied) {
+			return denied(msg, result)
+		}
+
+		return next(msg, result)
+	}
+}
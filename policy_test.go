@@ -0,0 +1,163 @@
+package protonats_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func msgCtx(subject, token string) context.Context {
+	msg := nats.NewMsg(subject)
+	if token != "" {
+		msg.Header.Set(protonats.HeaderUserJWT, token)
+	}
+
+	return protonats.WithNatsMsg(context.Background(), msg)
+}
+
+func TestPolicyEngineRules(t *testing.T) {
+	p, err := protonats.NewPolicyEngine([]protonats.PolicyRule{
+		{Name: "internal", Deny: true, Types: []string{"orders.internal.*"}},
+		{Name: "orders", Sources: []string{"/orders/*"}, Subjects: []string{"orders.>"}},
+	})
+	require.NoError(t, err)
+
+	e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	e.SetSource("/orders/api")
+	assert.NoError(t, p.Check(msgCtx("orders.eu.created", ""), e))
+
+	// subject rule doesn't match
+	assert.True(t, errors.Is(p.Check(msgCtx("payments.created", ""), e), protonats.ErrPolicyDenied))
+
+	e.SetType("orders.internal.rebuild")
+
+	var de *protonats.PolicyDeniedError
+	require.True(t, errors.As(p.Check(msgCtx("orders.eu.created", ""), e), &de))
+	assert.Equal(t, "internal", de.Rule)
+}
+
+func TestPolicyEngineUserJWT(t *testing.T) {
+	account, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	accountKey, err := account.PublicKey()
+	require.NoError(t, err)
+
+	user, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	userKey, err := user.PublicKey()
+	require.NoError(t, err)
+
+	claims := jwt.NewUserClaims(userKey)
+	claims.Pub.Allow.Add("orders.>")
+	claims.Tags.Add("billing")
+
+	token, err := claims.Encode(account)
+	require.NoError(t, err)
+
+	stranger, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	strangerToken, err := claims.Encode(stranger)
+	require.NoError(t, err)
+
+	p, err := protonats.NewPolicyEngine([]protonats.PolicyRule{
+		{Name: "billing", Tags: []string{"billing"}},
+	}, protonats.WithPolicyTrustedAccounts(accountKey), protonats.WithPolicyRequireJWT())
+	require.NoError(t, err)
+
+	// signed by attacker's own account claiming to be issued on behalf of the trusted one
+	forgedClaims := jwt.NewUserClaims(userKey)
+	forgedClaims.Tags.Add("billing")
+	forgedClaims.IssuerAccount = accountKey
+	forgedToken, err := forgedClaims.Encode(stranger)
+	require.NoError(t, err)
+
+	e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+
+	assert.NoError(t, p.Check(msgCtx("orders.created", token), e))
+
+	for name, ctx := range map[string]context.Context{
+		"no permission":  msgCtx("payments.created", token),
+		"untrusted":      msgCtx("orders.created", strangerToken),
+		"forged":         msgCtx("orders.created", token[:len(token)-4]+"AAAA"),
+		"issuer account": msgCtx("orders.created", forgedToken),
+		"no jwt":         msgCtx("orders.created", ""),
+	} {
+		assert.True(t, errors.Is(p.Check(ctx, e), protonats.ErrPolicyDenied), name)
+	}
+}
+
+func TestPolicyEngineSigningKey(t *testing.T) {
+	operator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+
+	account, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	accountKey, _ := account.PublicKey()
+
+	signing, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	signingKey, _ := signing.PublicKey()
+
+	accountClaims := jwt.NewAccountClaims(accountKey)
+	accountClaims.SigningKeys.Add(signingKey)
+	accountToken, err := accountClaims.Encode(operator)
+	require.NoError(t, err)
+
+	user, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	userKey, _ := user.PublicKey()
+
+	claims := jwt.NewUserClaims(userKey)
+	claims.IssuerAccount = accountKey
+	token, err := claims.Encode(signing)
+	require.NoError(t, err)
+
+	p, err := protonats.NewPolicyEngine([]protonats.PolicyRule{
+		{Name: "account", Issuers: []string{accountKey}},
+	}, protonats.WithPolicyTrustedAccountJWTs(accountToken))
+	require.NoError(t, err)
+
+	e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	assert.NoError(t, p.Check(msgCtx("orders.created", token), e))
+
+	// signing key of the trusted account can't issue on behalf of another account
+	other, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	claims.IssuerAccount, _ = other.PublicKey()
+	token, err = claims.Encode(signing)
+	require.NoError(t, err)
+	assert.True(t, errors.Is(p.Check(msgCtx("orders.created", token), e), protonats.ErrPolicyDenied))
+}
+
+func TestPolicyEngineUntrusted(t *testing.T) {
+	_, err := protonats.NewPolicyEngine([]protonats.PolicyRule{{Name: "billing", Tags: []string{"billing"}}})
+	assert.True(t, errors.Is(err, protonats.ErrPolicyUntrusted))
+
+	_, err = protonats.NewPolicyEngine([]protonats.PolicyRule{{Name: "admins", Issuers: []string{"A"}}})
+	assert.True(t, errors.Is(err, protonats.ErrPolicyUntrusted))
+}
+
+func TestAuthorize(t *testing.T) {
+	var handled bool
+
+	h := protonats.Chain(func(ctx context.Context, e cloudevents.Event) protocol.Result {
+		handled = true
+		return nil
+	}, protonats.Authorize(func(ctx context.Context, e cloudevents.Event) error {
+		return errors.New("nope")
+	}, protonats.NewNullMetrics()))
+
+	res := h(context.Background(), newEvent(t, "orders.created", orderCreated{ID: "o1"}))
+	assert.True(t, errors.Is(res, protonats.ErrPolicyDenied))
+	assert.False(t, protocol.IsACK(res))
+	assert.False(t, handled)
+}
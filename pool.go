@@ -0,0 +1,286 @@
+package protonats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+var ErrPoolEmpty = errors.New("conn pool: no connections")
+
+// PoolStats aggregated statistics of pool connections
+type PoolStats struct {
+	nats.Statistics
+
+	Size      int
+	Connected int
+}
+
+// ConnPool spreads publishing over several NATS connections.
+// Subject is always served by the same connection chosen with consistent hashing,
+// so order of events within subject is kept.
+type ConnPool struct {
+	name  string
+	conns []*nats.Conn
+	owned bool
+
+	metrics  PoolMetrics
+	interval time.Duration
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+type ConnPoolOption func(*ConnPool)
+
+// WithPoolName names pool in metrics and connections as name-0, name-1...
+func WithPoolName(name string) ConnPoolOption {
+	return func(p *ConnPool) { p.name = name }
+}
+
+// WithPoolMetrics reports PoolStats into m every interval until pool is closed
+func WithPoolMetrics(m PoolMetrics, interval time.Duration) ConnPoolOption {
+	return func(p *ConnPool) {
+		if m != nil {
+			p.metrics = m
+			p.interval = interval
+		}
+	}
+}
+
+// NewConnPool opens size connections to url, pool owns them
+func NewConnPool(url string, size int, natsOpts []nats.Option, opts ...ConnPoolOption) (*ConnPool, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("conn pool size should be positive, got %d", size)
+	}
+
+	p := newConnPool(opts...)
+	p.owned = true
+
+	for i := 0; i < size; i++ {
+		connOpts := append(append([]nats.Option{}, natsOpts...), nats.Name(fmt.Sprintf("%s-%d", p.name, i)))
+
+		conn, err := nats.Connect(url, connOpts...)
+		if err != nil {
+			for _, c := range p.conns {
+				c.Close()
+			}
+
+			return nil, fmt.Errorf("conn pool connect %d: %w", i, err)
+		}
+
+		p.conns = append(p.conns, conn)
+	}
+
+	p.start()
+
+	return p, nil
+}
+
+// NewConnPoolFromConns makes pool of connections which are closed by the caller
+func NewConnPoolFromConns(conns []*nats.Conn, opts ...ConnPoolOption) (*ConnPool, error) {
+	if len(conns) == 0 {
+		return nil, ErrPoolEmpty
+	}
+
+	p := newConnPool(opts...)
+	p.conns = conns
+	p.start()
+
+	return p, nil
+}
+
+func newConnPool(opts ...ConnPoolOption) *ConnPool {
+	p := &ConnPool{
+		name:    "protonats",
+		metrics: nullMetrics{},
+		done:    make(chan struct{}),
+	}
+
+	for _, fn := range opts {
+		fn(p)
+	}
+
+	return p
+}
+
+// Size number of pool connections
+func (p *ConnPool) Size() int { return len(p.conns) }
+
+// Conns pool connections, the first one is used by consumers of the pool Protocol
+func (p *ConnPool) Conns() []*nats.Conn { return p.conns }
+
+// Index of connection serving subject
+func (p *ConnPool) Index(subject string) int {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(subject))
+
+	return jumpHash(h.Sum64(), len(p.conns))
+}
+
+// Conn serving subject
+func (p *ConnPool) Conn(subject string) *nats.Conn {
+	return p.conns[p.Index(subject)]
+}
+
+// Stats sums statistics of all connections
+func (p *ConnPool) Stats() PoolStats {
+	res := PoolStats{Size: len(p.conns)}
+
+	for _, c := range p.conns {
+		if c.IsConnected() {
+			res.Connected++
+		}
+
+		s := c.Stats()
+		res.InMsgs += s.InMsgs
+		res.OutMsgs += s.OutMsgs
+		res.InBytes += s.InBytes
+		res.OutBytes += s.OutBytes
+		res.Reconnects += s.Reconnects
+	}
+
+	return res
+}
+
+// Close stops metrics and drains owned connections at once, waiting until all of them are closed.
+// When ctx is done before, rest connections are closed immediately.
+func (p *ConnPool) Close(ctx context.Context) error {
+	var errs []string
+
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.wg.Wait()
+
+		if !p.owned {
+			return
+		}
+
+		for _, c := range p.conns {
+			if err := c.Drain(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+				errs = append(errs, err.Error())
+			}
+		}
+
+		tick := time.NewTicker(10 * time.Millisecond)
+		defer tick.Stop()
+
+		for _, c := range p.conns {
+			for !c.IsClosed() {
+				select {
+				case <-tick.C:
+				case <-ctx.Done():
+					c.Close()
+				}
+			}
+		}
+
+		p.metrics.SetPoolStats(p.name, p.Stats())
+	})
+
+	if len(errs) > 0 {
+		return fmt.Errorf("conn pool close: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (p *ConnPool) start() {
+	if p.interval <= 0 {
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		tick := time.NewTicker(p.interval)
+		defer tick.Stop()
+
+		for {
+			p.metrics.SetPoolStats(p.name, p.Stats())
+
+			select {
+			case <-tick.C:
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// jumpHash Lamping and Veach jump consistent hash: growing pool moves only 1/n of subjects
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
+
+// PoolSender publishes every subject through its pool connection, one Sender is created per connection.
+// Senders share options, so rate limiters and circuit breakers are shared by the whole pool as well.
+type PoolSender struct {
+	Pool    *ConnPool
+	Subject string
+
+	senders []*Sender
+}
+
+func NewPoolSender(pool *ConnPool, subject string, opts ...SenderOption) (*PoolSender, error) {
+	res := &PoolSender{Pool: pool, Subject: subject}
+
+	for _, conn := range pool.Conns() {
+		s, err := NewSenderFromConnWithOptions(conn, subject, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		res.senders = append(res.senders, s)
+	}
+
+	return res, nil
+}
+
+// Send implements protocol.Sender, subject is context topic or the default one
+func (s *PoolSender) Send(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+	subject := s.Subject
+	if topic := cecontext.TopicFrom(ctx); topic != "" {
+		subject = topic
+	}
+
+	return s.senders[s.Pool.Index(subject)].Send(ctx, in, transformers...)
+}
+
+// Close closes senders, pool is closed by its owner
+func (s *PoolSender) Close(ctx context.Context) error {
+	var errs []string
+
+	for _, sender := range s.senders {
+		if err := sender.Close(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("pool sender close: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+var _ protocol.SendCloser = (*PoolSender)(nil)
@@ -0,0 +1,237 @@
+package protonats_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cn "github.com/cloudevents/sdk-go/protocol/nats/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/d7561985/protonats"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pool(t *testing.T, size int) *protonats.ConnPool {
+	conns := make([]*nats.Conn, size)
+	for i := range conns {
+		conns[i] = &nats.Conn{}
+	}
+
+	p, err := protonats.NewConnPoolFromConns(conns)
+	require.NoError(t, err)
+
+	return p
+}
+
+func TestConnPoolIndex(t *testing.T) {
+	four, five := pool(t, 4), pool(t, 5)
+
+	used := map[int]int{}
+	moved := 0
+
+	for i := 0; i < 1000; i++ {
+		subject := fmt.Sprintf("orders.%d", i)
+
+		idx := four.Index(subject)
+		assert.Equal(t, idx, four.Index(subject))
+		used[idx]++
+
+		// growing pool moves subjects only to the new connection
+		if grown := five.Index(subject); grown != idx {
+			assert.Equal(t, 4, grown)
+			moved++
+		}
+	}
+
+	assert.Len(t, used, 4)
+	assert.InDelta(t, 200, moved, 60)
+}
+
+type poolMetrics struct {
+	mu    sync.Mutex
+	stats []protonats.PoolStats
+}
+
+func (m *poolMetrics) SetPoolStats(_ string, stats protonats.PoolStats) protonats.PoolMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stats = append(m.stats, stats)
+	return m
+}
+
+func TestPoolSender(t *testing.T) {
+	s := startServer(t)
+
+	p, err := protonats.NewConnPool(s.ClientURL(), 3, nil, protonats.WithPoolName("orders"))
+	require.NoError(t, err)
+	defer p.Close(context.Background())
+
+	conn, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sub, err := conn.SubscribeSync("orders.>")
+	require.NoError(t, err)
+	require.NoError(t, conn.Flush())
+
+	sender, err := protonats.NewPoolSender(p, "orders.default")
+	require.NoError(t, err)
+	defer sender.Close(context.Background())
+
+	subjects := []string{"orders.default"}
+	for i := 0; i < 8; i++ {
+		subjects = append(subjects, fmt.Sprintf("orders.%d", i))
+	}
+
+	perConn := make([]uint64, p.Size())
+	for _, subject := range subjects {
+		perConn[p.Index(subject)] += 3
+	}
+
+	for seq := 0; seq < 3; seq++ {
+		for _, subject := range subjects {
+			ctx := context.Background()
+			if subject != "orders.default" {
+				ctx = cecontext.WithTopic(ctx, subject)
+			}
+
+			e := newEvent(t, "orders.created", orderCreated{ID: subject})
+			e.SetID(fmt.Sprint(seq))
+			require.NoError(t, sender.Send(ctx, (*binding.EventMessage)(&e)))
+		}
+	}
+
+	// every subject is published by its connection only
+	for i, c := range p.Conns() {
+		require.NoError(t, c.Flush())
+		assert.Equal(t, perConn[i], c.Stats().OutMsgs, "connection %d", i)
+	}
+
+	// order within subject is kept
+	received := map[string][]string{}
+	for range subjects {
+		for seq := 0; seq < 3; seq++ {
+			msg, err := sub.NextMsg(time.Second)
+			require.NoError(t, err)
+
+			e, err := binding.ToEvent(context.Background(), cn.NewMessage(msg))
+			require.NoError(t, err)
+
+			received[msg.Subject] = append(received[msg.Subject], e.ID())
+		}
+	}
+
+	for _, subject := range subjects {
+		assert.Equal(t, []string{"0", "1", "2"}, received[subject], subject)
+	}
+}
+
+func TestConnPoolClose(t *testing.T) {
+	s := startServer(t)
+
+	m := &poolMetrics{}
+	p, err := protonats.NewConnPool(s.ClientURL(), 2, nil, protonats.WithPoolMetrics(m, time.Hour))
+	require.NoError(t, err)
+
+	// pending messages are handled before connections are closed
+	var handled int32
+	for _, c := range p.Conns() {
+		_, err = c.Subscribe("orders", func(*nats.Msg) {
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&handled, 1)
+		})
+		require.NoError(t, err)
+		require.NoError(t, c.Flush())
+	}
+
+	conn, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, conn.Publish("orders", nil))
+	}
+	require.NoError(t, conn.Flush())
+
+	require.Eventually(t, func() bool {
+		for _, c := range p.Conns() {
+			if c.Stats().InMsgs != 5 {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, p.Close(context.Background()))
+	assert.Equal(t, int32(10), atomic.LoadInt32(&handled))
+
+	for _, c := range p.Conns() {
+		assert.True(t, c.IsClosed())
+	}
+
+	// the last stats are reported on close
+	m.mu.Lock()
+	require.Len(t, m.stats, 2)
+	assert.Equal(t, 2, m.stats[1].Size)
+	assert.Equal(t, 0, m.stats[1].Connected)
+	assert.Equal(t, uint64(10), m.stats[1].InMsgs)
+	m.mu.Unlock()
+
+	// repeated close is noop
+	require.NoError(t, p.Close(context.Background()))
+}
+
+func TestConnPoolCloseTimeout(t *testing.T) {
+	s := startServer(t)
+
+	p, err := protonats.NewConnPool(s.ClientURL(), 2, nil)
+	require.NoError(t, err)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	_, err = p.Conns()[0].Subscribe("orders", func(*nats.Msg) { <-release })
+	require.NoError(t, err)
+	require.NoError(t, p.Conns()[0].Flush())
+
+	conn, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.Publish("orders", nil))
+	require.NoError(t, conn.Flush())
+
+	require.Eventually(t, func() bool { return p.Conns()[0].Stats().InMsgs == 1 }, time.Second, 5*time.Millisecond)
+
+	// drain waits for the blocked handler, ctx deadline closes connections at once
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	require.NoError(t, p.Close(ctx))
+	assert.Less(t, time.Since(start), time.Second)
+
+	for _, c := range p.Conns() {
+		assert.True(t, c.IsClosed())
+	}
+}
+
+func TestConnPoolFromConnsClose(t *testing.T) {
+	conn, err := nats.Connect(startServer(t).ClientURL())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	p, err := protonats.NewConnPoolFromConns([]*nats.Conn{conn})
+	require.NoError(t, err)
+
+	// connections belong to the caller
+	require.NoError(t, p.Close(context.Background()))
+	assert.False(t, conn.IsClosed())
+}
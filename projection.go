@@ -0,0 +1,197 @@
+package protonats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	ErrProjectionConflict = errors.New("projection: state was changed concurrently")
+	ErrProjectionNoKey    = errors.New("projection: event has no state key")
+)
+
+// KeyFunc returns KV key of the state event belongs to, e.g. aggregate id
+type KeyFunc func(e cloudevents.Event) string
+
+// SubjectKey uses event subject attribute as state key
+func SubjectKey(e cloudevents.Event) string { return e.Subject() }
+
+// Reducer applies typed event data to state
+type Reducer[S, T any] func(ctx context.Context, state S, data T, e cloudevents.Event) (S, error)
+
+// ProjectionState KV value of projection key
+type ProjectionState[S any] struct {
+	// Sequence is the last applied stream sequence, zero when events came without JetStream metadata
+	Sequence uint64 `json:"seq"`
+	State    S      `json:"state"`
+}
+
+// Projection builds read model inside JetStream KV bucket from events.
+// Every key is updated with KV revision check, conflicting update is re-applied on the fresh state.
+// Key keeps the last applied stream sequence, so redelivered or replayed events aren't applied twice.
+// Events of the same key should be handled in stream order, e.g. Consumer with WithConcurrency(1).
+type Projection[S any] struct {
+	KV  nats.KeyValue
+	Key KeyFunc
+
+	// Attempts of conflicting update before ErrProjectionConflict
+	Attempts int
+
+	mx       sync.RWMutex
+	reducers map[string]func(ctx context.Context, state S, e cloudevents.Event) (S, error)
+}
+
+func NewProjection[S any](kv nats.KeyValue, key KeyFunc) *Projection[S] {
+	return &Projection[S]{
+		KV:       kv,
+		Key:      key,
+		Attempts: 5,
+		reducers: make(map[string]func(ctx context.Context, state S, e cloudevents.Event) (S, error)),
+	}
+}
+
+// On registers reducer for event type, data is decoded the same way as Router does
+func On[S, T any](p *Projection[S], typ string, fn Reducer[S, T]) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	p.reducers[typ] = func(ctx context.Context, state S, e cloudevents.Event) (S, error) {
+		data, err := decodeAs[T](e)
+		if err != nil {
+			return state, fmt.Errorf("projection %s decode %T: %w", typ, data, err)
+		}
+
+		return fn(ctx, state, data, e)
+	}
+}
+
+// Get returns state of key and its last applied stream sequence
+func (p *Projection[S]) Get(key string) (ProjectionState[S], error) {
+	st, _, err := p.load(key)
+	return st, err
+}
+
+// Receive implements Handler, events without reducer are acknowledged
+func (p *Projection[S]) Receive(ctx context.Context, e cloudevents.Event) protocol.Result {
+	p.mx.RLock()
+	reduce, ok := p.reducers[e.Type()]
+	p.mx.RUnlock()
+
+	if !ok {
+		return protocol.ResultACK
+	}
+
+	key := p.Key(e)
+	if key == "" {
+		return protocol.NewReceipt(false, "%s: %s %s", ErrProjectionNoKey, e.Type(), e.ID())
+	}
+
+	var seq uint64
+	if meta := MsgMetadataFrom(ctx); meta != nil {
+		seq = meta.Sequence.Stream
+	}
+
+	for i := 0; i < p.Attempts; i++ {
+		st, rev, err := p.load(key)
+		if err != nil {
+			return err
+		}
+
+		// already applied
+		if seq > 0 && st.Sequence >= seq {
+			return protocol.ResultACK
+		}
+
+		if st.State, err = reduce(ctx, st.State, e); err != nil {
+			return err
+		}
+
+		if seq > 0 {
+			st.Sequence = seq
+		}
+
+		data, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+
+		if rev == 0 {
+			_, err = p.KV.Create(key, data)
+		} else {
+			_, err = p.KV.Update(key, data, rev)
+		}
+
+		if err == nil {
+			return protocol.ResultACK
+		}
+
+		// revision check failed, reduce again on fresh state
+		if _, current, lErr := p.load(key); lErr != nil || current == rev {
+			return err
+		}
+	}
+
+	return fmt.Errorf("%w: key %s", ErrProjectionConflict, key)
+}
+
+// Rebuild purges projection and replays subject from the beginning of the stream through Receive.
+// Live consumers of the projection should be stopped during rebuild.
+func (p *Projection[S]) Rebuild(ctx context.Context, conn *nats.Conn, subject string, opts ...ReplayOption) (ReplayStats, error) {
+	if err := p.Reset(); err != nil {
+		return ReplayStats{}, err
+	}
+
+	r, err := NewReplay(conn, subject, opts...)
+	if err != nil {
+		return ReplayStats{}, err
+	}
+
+	return r.Run(ctx, p.Receive)
+}
+
+// Reset purges all projection keys
+func (p *Projection[S]) Reset() error {
+	keys, err := p.KV.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err = p.KV.Purge(key); err != nil {
+			return fmt.Errorf("projection purge %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// load returns state and its revision, zero revision means key doesn't exist
+func (p *Projection[S]) load(key string) (ProjectionState[S], uint64, error) {
+	var st ProjectionState[S]
+
+	entry, err := p.KV.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrKeyDeleted) {
+		return st, 0, nil
+	}
+
+	if err != nil {
+		return st, 0, err
+	}
+
+	if err = json.Unmarshal(entry.Value(), &st); err != nil {
+		return st, 0, fmt.Errorf("projection decode %s: %w", key, err)
+	}
+
+	return st, entry.Revision(), nil
+}
@@ -0,0 +1,137 @@
+package protonats_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type customer struct {
+	Orders int      `json:"orders"`
+	IDs    []string `json:"ids"`
+}
+
+func newProjection(kv nats.KeyValue) *protonats.Projection[customer] {
+	p := protonats.NewProjection[customer](kv, protonats.SubjectKey)
+	protonats.On(p, "orders.created", func(ctx context.Context, st customer, o *orderCreated, e cloudevents.Event) (customer, error) {
+		st.Orders++
+		st.IDs = append(st.IDs, o.ID)
+		return st, nil
+	})
+
+	return p
+}
+
+func customerEvent(t *testing.T, id string) cloudevents.Event {
+	e := newEvent(t, "orders.created", orderCreated{ID: id})
+	e.SetID(id)
+	e.SetSubject("c1")
+
+	return e
+}
+
+func TestProjection(t *testing.T) {
+	conn := runServer(t)
+	p := newProjection(newKV(t, conn, "customers"))
+
+	s, err := protonats.NewSenderFromConnWithOptions(conn, "orders.created")
+	require.NoError(t, err)
+
+	for _, id := range []string{"o1", "o2", "o3"} {
+		e := customerEvent(t, id)
+		require.NoError(t, s.Send(context.Background(), (*binding.EventMessage)(&e)))
+	}
+
+	c, err := protonats.NewConsumerFromConn(conn, "orders.created",
+		protonats.WithJetStreamSubscriber("", nats.Durable("customers")), protonats.WithReceiveBuffer(16), protonats.WithConcurrency(1))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() { _ = c.StartReceiver(ctx, p.Receive) }()
+
+	require.Eventually(t, func() bool {
+		st, err := p.Get("c1")
+		return err == nil && st.Sequence == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	st, err := p.Get("c1")
+	require.NoError(t, err)
+	assert.Equal(t, customer{Orders: 3, IDs: []string{"o1", "o2", "o3"}}, st.State)
+
+	// redelivered event isn't applied twice
+	redelivered := protonats.WithMsgMetadata(context.Background(), &nats.MsgMetadata{Sequence: nats.SequencePair{Stream: 2}})
+	assert.True(t, protocol.IsACK(p.Receive(redelivered, customerEvent(t, "o2"))))
+
+	st, err = p.Get("c1")
+	require.NoError(t, err)
+	assert.Equal(t, 3, st.State.Orders)
+
+	// events without reducer are acknowledged
+	assert.True(t, protocol.IsACK(p.Receive(context.Background(), newEvent(t, "orders.paid", orderCreated{ID: "o1"}))))
+
+	// event without key
+	res := p.Receive(context.Background(), newEvent(t, "orders.created", orderCreated{ID: "o4"}))
+	assert.False(t, protocol.IsACK(res))
+	assert.Contains(t, res.Error(), protonats.ErrProjectionNoKey.Error())
+
+	// data of wrong shape returns decode error
+	bad := customerEvent(t, "o5")
+	require.NoError(t, bad.SetData(cloudevents.ApplicationJSON, []string{"o5"}))
+
+	res = p.Receive(context.Background(), bad)
+	require.Error(t, res)
+	assert.Contains(t, res.Error(), "cannot unmarshal array")
+	assert.False(t, errors.Is(res, protonats.ErrDataTypeUnsupported))
+
+	// rebuild replays the stream into empty bucket
+	stats, err := p.Rebuild(context.Background(), conn, "orders.created")
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Processed)
+
+	st, err = p.Get("c1")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), st.Sequence)
+	assert.Equal(t, 3, st.State.Orders)
+}
+
+func TestProjectionConflict(t *testing.T) {
+	p := newProjection(newKV(t, runServer(t), "customers"))
+
+	// state is changed by another writer while the first one reduces
+	protonats.On(p, "orders.paid", func(ctx context.Context, st customer, o *orderCreated, e cloudevents.Event) (customer, error) {
+		cur, err := p.Get(e.Subject())
+		require.NoError(t, err)
+
+		data, err := json.Marshal(protonats.ProjectionState[customer]{State: customer{Orders: cur.State.Orders + 1}})
+		require.NoError(t, err)
+
+		_, err = p.KV.Put(e.Subject(), data)
+		require.NoError(t, err)
+
+		return st, nil
+	})
+
+	require.True(t, protocol.IsACK(p.Receive(context.Background(), customerEvent(t, "o1"))))
+
+	paid := newEvent(t, "orders.paid", orderCreated{ID: "o1"})
+	paid.SetSubject("c1")
+
+	res := p.Receive(context.Background(), paid)
+	assert.True(t, errors.Is(res, protonats.ErrProjectionConflict), res)
+
+	st, err := p.Get("c1")
+	require.NoError(t, err)
+	assert.Equal(t, 1+p.Attempts, st.State.Orders)
+}
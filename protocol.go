@@ -2,13 +2,15 @@ package protonats
 
 import (
 	"context"
+	"errors"
 
-	cn "github.com/cloudevents/sdk-go/protocol/nats/v2"
 	"github.com/cloudevents/sdk-go/v2/binding"
 	"github.com/cloudevents/sdk-go/v2/protocol"
 	"github.com/nats-io/nats.go"
 )
 
+var ErrStartReceiverUnsupported = errors.New("protocol consumer does not support StartReceiver")
+
 type OpenerReceiverCloser interface {
 	protocol.Opener
 	protocol.ReceiveCloser
@@ -24,6 +26,29 @@ func WithConsumerOptions(opts ...ConsumerOption) ProtocolOption {
 	}
 }
 
+func WithSenderOptions(opts ...SenderOption) ProtocolOption {
+	return func(p *Protocol) error {
+		p.senderOptions = opts
+		return nil
+	}
+}
+
+// AppendConsumerOptions adds options to protocol Consumer, unlike WithConsumerOptions it keeps already set ones
+func AppendConsumerOptions(opts ...ConsumerOption) ProtocolOption {
+	return func(p *Protocol) error {
+		p.consumerOptions = append(p.consumerOptions, opts...)
+		return nil
+	}
+}
+
+// AppendSenderOptions adds options to protocol Sender, unlike WithSenderOptions it keeps already set ones
+func AppendSenderOptions(opts ...SenderOption) ProtocolOption {
+	return func(p *Protocol) error {
+		p.senderOptions = append(p.senderOptions, opts...)
+		return nil
+	}
+}
+
 // Protocol is a reference implementation for using the CloudEvents binding
 // integration. Protocol acts as both a NATS client and a NATS handler.
 type Protocol struct {
@@ -33,9 +58,11 @@ type Protocol struct {
 	consumerOptions []ConsumerOption
 
 	Sender        protocol.SendCloser
-	senderOptions []cn.SenderOption
+	senderOptions []SenderOption
 
 	connOwned bool // whether this protocol created the stan connection
+
+	auth *Auth
 }
 
 // NewProtocol creates a new NATS protocol.
@@ -70,7 +97,57 @@ func NewProtocolFromConn(conn *nats.Conn, sendSubject, receiveSubject string, op
 		return nil, err
 	}
 
-	if p.Sender, err = NewSenderFromConn(conn, sendSubject, p.senderOptions...); err != nil {
+	if p.Sender, err = NewSenderFromConnWithOptions(conn, sendSubject, p.senderOptions...); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// NewProtocolFromPool creates protocol which Sender spreads subjects over pool connections,
+// consumer uses the first one. Pool is closed by the caller after the protocol.
+func NewProtocolFromPool(pool *ConnPool, sendSubject, receiveSubject string, opts ...ProtocolOption) (*Protocol, error) {
+	var err error
+	p := &Protocol{
+		Conn: pool.Conns()[0],
+	}
+
+	if err := p.applyOptions(opts...); err != nil {
+		return nil, err
+	}
+
+	if p.Consumer, err = NewConsumerFromConn(p.Conn, receiveSubject, p.consumerOptions...); err != nil {
+		return nil, err
+	}
+
+	if p.Sender, err = NewPoolSender(pool, sendSubject, p.senderOptions...); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// NewProtocolFromClusters creates protocol which Sender publishes to clusters with failover or dual-write,
+// consumer uses the most preferred connected cluster. Clusters are closed by the caller after the protocol.
+func NewProtocolFromClusters(clusters *Clusters, sendSubject, receiveSubject string, opts ...ProtocolOption) (*Protocol, error) {
+	active, err := clusters.Active()
+	if err != nil {
+		active = clusters.All()[0]
+	}
+
+	p := &Protocol{
+		Conn: active.Conn,
+	}
+
+	if err := p.applyOptions(opts...); err != nil {
+		return nil, err
+	}
+
+	if p.Consumer, err = NewConsumerFromConn(p.Conn, receiveSubject, p.consumerOptions...); err != nil {
+		return nil, err
+	}
+
+	if p.Sender, err = NewClusterSender(clusters, sendSubject, p.senderOptions...); err != nil {
 		return nil, err
 	}
 
@@ -91,6 +168,23 @@ func (p *Protocol) Receive(ctx context.Context) (binding.Message, error) {
 	return p.Consumer.Receive(ctx)
 }
 
+// StartReceiver dispatches events through consumer middleware chain when consumer supports it, see Consumer.StartReceiver
+func (p *Protocol) StartReceiver(ctx context.Context, fn Handler) error {
+	c, ok := p.Consumer.(interface {
+		StartReceiver(context.Context, Handler) error
+	})
+	if !ok {
+		return ErrStartReceiverUnsupported
+	}
+
+	return c.StartReceiver(ctx, fn)
+}
+
+// Health reports connection state, auth file state is known for protocol of NewProtocolFromConfig
+func (p *Protocol) Health() ConnHealth {
+	return Health(p.Conn, p.auth)
+}
+
 // Close implements Closer.Close
 func (p *Protocol) Close(ctx context.Context) error {
 	if p.connOwned {
@@ -0,0 +1,291 @@
+package protonats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	cn "github.com/cloudevents/sdk-go/protocol/nats/v2"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/client"
+	"github.com/d7561985/tel"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+// BatchHandler processes fetched events at once.
+// nil acks the whole batch, BatchError acks all items except failed ones, any other error fails the whole batch.
+type BatchHandler func(ctx context.Context, events []cloudevents.Event) error
+
+// BatchError failed batch items by index
+type BatchError map[int]error
+
+func (e BatchError) Error() string {
+	idx := make([]int, 0, len(e))
+	for i := range e {
+		idx = append(idx, i)
+	}
+
+	sort.Ints(idx)
+
+	parts := make([]string, 0, len(idx))
+	for _, i := range idx {
+		parts = append(parts, fmt.Sprintf("#%d: %s", i, e[i]))
+	}
+
+	return fmt.Sprintf("batch items failed: %s", strings.Join(parts, "; "))
+}
+
+// PullConsumer fetches batches from durable JetStream pull consumer.
+// Durable is created when it doesn't exist and is kept on server after Run, so the next Run continues from its position.
+// Failed items follow failure handler, NakOnFailure by default;
+// malformed events are terminated or dead-lettered, the same way as Consumer settles them.
+type PullConsumer struct {
+	Conn    *nats.Conn
+	Stream  string
+	Durable string
+	Subject string
+
+	batch   int
+	maxWait time.Duration
+
+	config nats.ConsumerConfig
+	jsOpts []nats.JSOpt
+
+	onFailure FailureHandler
+	malformed FailureHandler
+	obs       client.ObservabilityService
+}
+
+// batchRecorder observability recording whole batches, implemented by TeleObservability
+type batchRecorder interface {
+	RecordBatch(ctx context.Context, subject string, events []cloudevents.Event) (context.Context, func(errOrResult error))
+}
+
+type PullOption func(*PullConsumer) error
+
+// WithPullBatch sets max events per batch and max wait time for batch to fill up
+func WithPullBatch(size int, maxWait time.Duration) PullOption {
+	return func(p *PullConsumer) error {
+		if size <= 0 || maxWait <= 0 {
+			return fmt.Errorf("pull batch: size and max wait should be positive, got %d and %s", size, maxWait)
+		}
+
+		p.batch, p.maxWait = size, maxWait
+		return nil
+	}
+}
+
+// WithPullConsumerConfig sets config of durable consumer if it doesn't exist yet,
+// Durable, FilterSubject and AckPolicy are overridden by PullConsumer
+func WithPullConsumerConfig(cfg nats.ConsumerConfig) PullOption {
+	return func(p *PullConsumer) error {
+		p.config = cfg
+		return nil
+	}
+}
+
+// WithPullJSOptions passes options into JetStream context, e.g. nats.Domain
+func WithPullJSOptions(opts ...nats.JSOpt) PullOption {
+	return func(p *PullConsumer) error {
+		p.jsOpts = append(p.jsOpts, opts...)
+		return nil
+	}
+}
+
+// WithPullFailureHandler replaces NakOnFailure for failed items
+func WithPullFailureHandler(fn FailureHandler) PullOption {
+	return func(p *PullConsumer) error {
+		if fn == nil {
+			return errors.New("pull failure handler is nil")
+		}
+
+		p.onFailure = fn
+		return nil
+	}
+}
+
+// WithPullDeadLetter publishes items failed by handler and malformed messages to the subject
+func WithPullDeadLetter(subject string) PullOption {
+	return func(p *PullConsumer) error {
+		if subject == "" {
+			return ErrEmptySubject
+		}
+
+		p.onFailure = DeadLetterOnFailure(p.Conn, subject)
+		p.malformed = p.onFailure
+		return nil
+	}
+}
+
+// WithPullObservability records malformed events within producer trace as WithObservability does,
+// batch span, size and latency are recorded when obs implements RecordBatch, see TeleObservability.RecordBatch
+func WithPullObservability(obs client.ObservabilityService) PullOption {
+	return func(p *PullConsumer) error {
+		p.obs = obs
+		return nil
+	}
+}
+
+func NewPullConsumer(conn *nats.Conn, stream, durable, subject string, opts ...PullOption) (*PullConsumer, error) {
+	p := &PullConsumer{
+		Conn:      conn,
+		Stream:    stream,
+		Durable:   durable,
+		Subject:   subject,
+		batch:     100,
+		maxWait:   time.Second,
+		onFailure: NakOnFailure(),
+		malformed: TermOnFailure(),
+	}
+
+	for _, fn := range opts {
+		if err := fn(p); err != nil {
+			return nil, err
+		}
+	}
+
+	p.onFailure = malformedOnFailure(p.malformed, p.onFailure)
+
+	return p, nil
+}
+
+// Run fetches batches and passes them into h until ctx done
+func (p *PullConsumer) Run(ctx context.Context, h BatchHandler) error {
+	js, err := p.Conn.JetStream(p.jsOpts...)
+	if err != nil {
+		return err
+	}
+
+	if _, err = js.ConsumerInfo(p.Stream, p.Durable); errors.Is(err, nats.ErrConsumerNotFound) {
+		cfg := p.config
+		cfg.Durable, cfg.FilterSubject, cfg.AckPolicy = p.Durable, p.Subject, nats.AckExplicitPolicy
+
+		_, err = js.AddConsumer(p.Stream, &cfg)
+	}
+
+	if err != nil {
+		return fmt.Errorf("pull consumer %s/%s: %w", p.Stream, p.Durable, err)
+	}
+
+	// bound subscription doesn't delete durable on unsubscribe
+	sub, err := js.PullSubscribe(p.Subject, p.Durable, nats.Bind(p.Stream, p.Durable))
+	if err != nil {
+		return fmt.Errorf("pull subscribe: %w", err)
+	}
+
+	defer func() { _ = sub.Unsubscribe() }()
+
+	for ctx.Err() == nil {
+		msgs, err := p.fetch(ctx, sub)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+
+			return fmt.Errorf("pull fetch: %w", err)
+		}
+
+		if len(msgs) > 0 {
+			p.handle(ctx, h, msgs)
+		}
+	}
+
+	return nil
+}
+
+func (p *PullConsumer) fetch(ctx context.Context, sub *nats.Subscription) ([]*nats.Msg, error) {
+	fetchCtx, cancel := context.WithTimeout(ctx, p.maxWait)
+	defer cancel()
+
+	msgs, err := sub.Fetch(p.batch, nats.Context(fetchCtx))
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) {
+		return nil, nil
+	}
+
+	return msgs, err
+}
+
+func (p *PullConsumer) handle(ctx context.Context, h BatchHandler, msgs []*nats.Msg) {
+	events := make([]cloudevents.Event, 0, len(msgs))
+	valid := make([]*nats.Msg, 0, len(msgs))
+
+	for _, msg := range msgs {
+		e, err := binding.ToEvent(ctx, cn.NewMessage(msg))
+		if err == nil {
+			err = e.Validate()
+		}
+
+		if err != nil {
+			err = &MalformedEventError{Err: err}
+			tel.FromCtx(ctx).Error("pull malformed event", zap.Error(err))
+
+			if p.obs != nil {
+				mctx := ctx
+				for _, fn := range p.obs.InboundContextDecorators() {
+					mctx = fn(mctx, cn.NewMessage(msg))
+				}
+
+				p.obs.RecordReceivedMalformedEvent(mctx, err)
+			}
+
+			p.fail(ctx, msg, err)
+			continue
+		}
+
+		events = append(events, *e)
+		valid = append(valid, msg)
+	}
+
+	if len(events) == 0 {
+		return
+	}
+
+	cb := func(error) {}
+	if br, ok := p.obs.(batchRecorder); ok {
+		ctx, cb = br.RecordBatch(ctx, p.Subject, events)
+	}
+
+	err := safeBatch(ctx, h, events)
+	cb(err)
+
+	var be BatchError
+	if err != nil && !errors.As(err, &be) {
+		for _, msg := range valid {
+			p.fail(ctx, msg, err)
+		}
+
+		return
+	}
+
+	for i, msg := range valid {
+		if itemErr, ok := be[i]; ok {
+			p.fail(ctx, msg, itemErr)
+			continue
+		}
+
+		if ackErr := msg.Ack(); ackErr != nil {
+			tel.FromCtx(ctx).Warn("pull ack", zap.Error(ackErr), zap.String("subject", msg.Subject))
+		}
+	}
+}
+
+func (p *PullConsumer) fail(ctx context.Context, msg *nats.Msg, err error) {
+	if fErr := p.onFailure(msg, err); fErr != nil {
+		tel.FromCtx(ctx).Warn("pull failure handler", zap.Error(fErr), zap.NamedError("cause", err))
+	}
+}
+
+func safeBatch(ctx context.Context, h BatchHandler, events []cloudevents.Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewPanicError(r)
+		}
+	}()
+
+	return h(ctx, events)
+}
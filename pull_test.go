@@ -0,0 +1,227 @@
+package protonats_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/d7561985/protonats"
+	"github.com/d7561985/tel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type batchMetrics struct {
+	mu      sync.Mutex
+	sizes   []int
+	results []error
+}
+
+func (m *batchMetrics) AddBatch(subject string, size int, d time.Duration, err error) protonats.BatchMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sizes = append(m.sizes, size)
+	m.results = append(m.results, err)
+	return m
+}
+
+func TestPullConsumer(t *testing.T) {
+	conn := runServer(t)
+	js, err := conn.JetStream()
+	require.NoError(t, err)
+
+	s, err := protonats.NewSenderFromConnWithOptions(conn, "orders.created")
+	require.NoError(t, err)
+
+	for _, id := range []string{"o1", "o2", "o3"} {
+		e := newEvent(t, "orders.created", orderCreated{ID: id})
+		e.SetID(id)
+		require.NoError(t, s.Send(context.Background(), (*binding.EventMessage)(&e)))
+	}
+
+	_, err = js.Publish("orders.created", []byte("garbage"))
+	require.NoError(t, err)
+
+	m := &batchMetrics{}
+	tl := tel.NewNull()
+	obs := protonats.NewTeleObservability(&tl, metricsReader(), protonats.WithObservabilityMetrics(m)).(*protonats.TeleObservability)
+
+	p, err := protonats.NewPullConsumer(conn, "ORDERS", "etl", "orders.created",
+		protonats.WithPullBatch(10, 200*time.Millisecond), protonats.WithPullObservability(obs))
+	require.NoError(t, err)
+
+	errBoom := errors.New("boom")
+	partial := protonats.BatchError{1: errBoom}
+
+	// every batch result settles items of the batch: partial naks failed item only,
+	// error and panic nak the whole batch, nil acks it
+	results := []func() error{
+		func() error { return partial },
+		func() error { return errBoom },
+		func() error { panic("boom") },
+		func() error { return nil },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var batches [][]string
+	done := make(chan error, 1)
+
+	go func() {
+		done <- p.Run(ctx, func(ctx context.Context, events []cloudevents.Event) error {
+			ids := make([]string, 0, len(events))
+			for _, e := range events {
+				ids = append(ids, e.ID())
+			}
+
+			batches = append(batches, ids)
+			if len(batches) == len(results) {
+				cancel()
+			}
+
+			return results[len(batches)-1]()
+		})
+	}()
+
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("batches aren't handled")
+	}
+
+	// malformed event is terminated and never handled
+	assert.Equal(t, [][]string{{"o1", "o2", "o3"}, {"o2"}, {"o2"}, {"o2"}}, batches)
+
+	require.Eventually(t, func() bool {
+		info, err := js.ConsumerInfo("ORDERS", "etl")
+		require.NoError(t, err)
+
+		return info.NumAckPending == 0 && info.AckFloor.Stream == 4
+	}, time.Second, 10*time.Millisecond)
+
+	info, err := js.ConsumerInfo("ORDERS", "etl")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), info.NumPending)
+	assert.Equal(t, uint64(7), info.Delivered.Consumer)
+
+	assert.Equal(t, []int{3, 1, 1, 1}, m.sizes)
+	require.Len(t, m.results, 4)
+	assert.Equal(t, partial, m.results[0])
+	assert.Equal(t, errBoom, m.results[1])
+	var pe *protonats.PanicError
+	assert.True(t, errors.As(m.results[2], &pe), m.results[2])
+	assert.NoError(t, m.results[3])
+}
+
+func TestPullConsumerContext(t *testing.T) {
+	conn := runServer(t)
+
+	s, err := protonats.NewSenderFromConnWithOptions(conn, "orders.created")
+	require.NoError(t, err)
+
+	e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	require.NoError(t, s.Send(context.Background(), (*binding.EventMessage)(&e)))
+
+	tl := tel.NewNull()
+	obs := protonats.NewTeleObservability(&tl, metricsReader()).(*protonats.TeleObservability)
+
+	p, err := protonats.NewPullConsumer(conn, "ORDERS", "etl", "orders.created",
+		protonats.WithPullBatch(10, 200*time.Millisecond), protonats.WithPullObservability(obs))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.WithValue(protonats.WithTenant(context.Background(), "acme"), ctxKey{}, "v"))
+	defer cancel()
+
+	started := make(chan struct{})
+	handled := make(chan error, 1)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- p.Run(ctx, func(ctx context.Context, events []cloudevents.Event) error {
+			assert.Equal(t, "v", ctx.Value(ctxKey{}))
+			assert.Equal(t, "acme", protonats.TenantFrom(ctx))
+
+			close(started)
+
+			select {
+			case <-ctx.Done():
+				handled <- ctx.Err()
+			case <-time.After(5 * time.Second):
+				handled <- errors.New("handler context isn't cancelled")
+			}
+
+			return ctx.Err()
+		})
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch isn't handled")
+	}
+
+	// cancelling Run reaches the batch handler
+	cancel()
+	assert.ErrorIs(t, <-handled, context.Canceled)
+	require.NoError(t, <-done)
+}
+
+func TestPullConsumerDeadLetter(t *testing.T) {
+	conn := runServer(t)
+	js, err := conn.JetStream()
+	require.NoError(t, err)
+
+	dlq, err := conn.SubscribeSync("dlq")
+	require.NoError(t, err)
+
+	_, err = js.Publish("orders.created", []byte("garbage"))
+	require.NoError(t, err)
+
+	s, err := protonats.NewSenderFromConnWithOptions(conn, "orders.created")
+	require.NoError(t, err)
+
+	e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	require.NoError(t, s.Send(context.Background(), (*binding.EventMessage)(&e)))
+
+	p, err := protonats.NewPullConsumer(conn, "ORDERS", "etl", "orders.created",
+		protonats.WithPullBatch(10, 200*time.Millisecond), protonats.WithPullDeadLetter("dlq"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(ctx, func(ctx context.Context, events []cloudevents.Event) error {
+			return errors.New("boom")
+		})
+	}()
+
+	// malformed and failed messages follow the consumer dead letter, the same way as with Consumer
+	msg, err := dlq.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "garbage", string(msg.Data))
+	assert.Contains(t, msg.Header.Get(protonats.HeaderError), protonats.ErrMalformedEvent.Error())
+	assert.Equal(t, "orders.created", msg.Header.Get(protonats.HeaderOriginSubject))
+
+	msg, err = dlq.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "boom", msg.Header.Get(protonats.HeaderError))
+
+	cancel()
+	require.NoError(t, <-done)
+
+	require.Eventually(t, func() bool {
+		info, err := js.ConsumerInfo("ORDERS", "etl")
+		require.NoError(t, err)
+
+		return info.NumAckPending == 0 && info.NumPending == 0
+	}, time.Second, 10*time.Millisecond)
+}
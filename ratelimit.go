@@ -0,0 +1,277 @@
+package protonats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/binding/spec"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/d7561985/tel"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// headerType NATS message header of event type, CloudEvents binary mode name of the attribute
+const headerType = "ce-type"
+
+// kinds of rate limiter buckets, used as metrics label
+const (
+	LimitKindGlobal  = "global"
+	LimitKindSubject = "subject"
+	LimitKindType    = "type"
+)
+
+// RateLimit token bucket parameters, zero Rate means unlimited
+type RateLimit struct {
+	// Rate events per second
+	Rate  float64
+	Burst int
+}
+
+// RateLimiter token bucket limiter with global, per subject and per event type buckets.
+// Request takes token from every bucket it matches and waits for the slowest one.
+// Wait fails fast with ErrRateLimited when the delay exceeds context deadline.
+type RateLimiter struct {
+	name string
+
+	global   RateLimit
+	subjects map[string]RateLimit
+	types    map[string]RateLimit
+
+	metrics ThrottleMetrics
+
+	mx       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+type RateLimiterOption func(*RateLimiter)
+
+// WithSubjectLimit limits events published to or received from subject
+func WithSubjectLimit(subject string, l RateLimit) RateLimiterOption {
+	return func(r *RateLimiter) {
+		r.subjects[subject] = l
+	}
+}
+
+// WithTypeLimit limits events of type
+func WithTypeLimit(typ string, l RateLimit) RateLimiterOption {
+	return func(r *RateLimiter) {
+		r.types[typ] = l
+	}
+}
+
+// WithLimiterMetrics exports throttle waits and rejects into m
+func WithLimiterMetrics(m ThrottleMetrics) RateLimiterOption {
+	return func(r *RateLimiter) {
+		if m != nil {
+			r.metrics = m
+		}
+	}
+}
+
+// NewRateLimiter creates limiter, name is used as metrics label and global is applied for every request
+func NewRateLimiter(name string, global RateLimit, opts ...RateLimiterOption) *RateLimiter {
+	r := &RateLimiter{
+		name:     name,
+		global:   global,
+		subjects: make(map[string]RateLimit),
+		types:    make(map[string]RateLimit),
+		metrics:  nullMetrics{},
+		limiters: make(map[string]*rate.Limiter),
+	}
+
+	for _, fn := range opts {
+		fn(r)
+	}
+
+	return r
+}
+
+type reservation struct {
+	kind, key string
+	r         *rate.Reservation
+}
+
+// Wait blocks until every bucket matching subject and type allows the request
+func (r *RateLimiter) Wait(ctx context.Context, subject, typ string) error {
+	reservations := make([]reservation, 0, 3)
+	cancel := func() {
+		for _, res := range reservations {
+			res.r.Cancel()
+		}
+	}
+
+	var delay time.Duration
+
+	for _, b := range []struct {
+		kind, key string
+		limit     RateLimit
+		ok        bool
+	}{
+		{LimitKindGlobal, "", r.global, true},
+		{LimitKindSubject, subject, r.subjects[subject], subject != ""},
+		{LimitKindType, typ, r.types[typ], typ != ""},
+	} {
+		if !b.ok || b.limit.Rate <= 0 {
+			continue
+		}
+
+		res := r.limiter(b.kind, b.key, b.limit).Reserve()
+		if !res.OK() {
+			cancel()
+			r.metrics.AddThrottleRejected(r.name, b.kind, b.key)
+			return fmt.Errorf("%w: %s %s burst is zero", ErrRateLimited, b.kind, b.key)
+		}
+
+		reservations = append(reservations, reservation{kind: b.kind, key: b.key, r: res})
+
+		if d := res.Delay(); d > delay {
+			delay = d
+		}
+	}
+
+	if delay == 0 {
+		return nil
+	}
+
+	slowest := reservations[0]
+	for _, res := range reservations {
+		if res.r.Delay() >= slowest.r.Delay() {
+			slowest = res
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		cancel()
+		r.metrics.AddThrottleRejected(r.name, slowest.kind, slowest.key)
+		return fmt.Errorf("%w: %s %s requires %s wait", ErrRateLimited, slowest.kind, slowest.key, delay)
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		r.metrics.AddThrottleWait(r.name, slowest.kind, slowest.key, delay)
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	}
+}
+
+func (r *RateLimiter) limiter(kind, key string, l RateLimit) *rate.Limiter {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	id := kind + ":" + key
+
+	lim, ok := r.limiters[id]
+	if !ok {
+		lim = rate.NewLimiter(rate.Limit(l.Rate), l.Burst)
+		r.limiters[id] = lim
+	}
+
+	return lim
+}
+
+// RateLimitSend limits sender by subject (context topic or defaultSubject) and event type
+func RateLimitSend(l *RateLimiter, defaultSubject string) SendMiddleware {
+	return func(next SendHandler) SendHandler {
+		return func(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+			subject := defaultSubject
+			if topic := cecontext.TopicFrom(ctx); topic != "" {
+				subject = topic
+			}
+
+			var typ string
+			if mr, ok := in.(binding.MessageMetadataReader); ok {
+				if _, v := mr.GetAttribute(spec.Type); v != nil {
+					typ, _ = v.(string)
+				}
+			}
+
+			if err := l.Wait(ctx, subject, typ); err != nil {
+				_ = in.Finish(err)
+				return err
+			}
+
+			return next(ctx, in, transformers...)
+		}
+	}
+}
+
+// NewRateLimitedReceiver slows Receive of r down according to the limiter, see WithReceiveRateLimit
+func NewRateLimitedReceiver(r NatsReceiver, l *RateLimiter) NatsReceiver {
+	return &limitedReceiver{NatsReceiver: r, limiter: l}
+}
+
+// limitedReceiver slows Receive down according to the limiter
+type limitedReceiver struct {
+	NatsReceiver
+
+	limiter *RateLimiter
+}
+
+// Receive returns io.EOF only when ctx is done, message rejected by limiter (zero burst, short deadline)
+// goes to failure path and the next one is received. Failure path can't return core NATS message,
+// so it's lost: the drop is logged and counted by limiter rejects.
+func (r *limitedReceiver) Receive(ctx context.Context) (binding.Message, error) {
+	for {
+		msg, err := r.NatsReceiver.Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var subject, typ string
+		if m, ok := msg.(*Message); ok {
+			subject = m.Msg.Subject
+
+			if len(r.limiter.types) > 0 {
+				typ = peekType(m.Msg)
+			}
+		}
+
+		err = r.limiter.Wait(ctx, subject, typ)
+		if err == nil {
+			return msg, nil
+		}
+
+		if fErr := msg.Finish(err); fErr != nil {
+			tel.FromCtx(ctx).Warn("finish rate limited message", zap.Error(fErr), zap.NamedError("cause", err))
+		}
+
+		if m, ok := msg.(*Message); ok && !isJetStream(m.Msg) && ctx.Err() == nil {
+			tel.FromCtx(ctx).Warn("rate limited message dropped", zap.Error(err),
+				zap.String("subject", subject), zap.String("type", typ))
+		}
+
+		if ctx.Err() != nil {
+			return nil, io.EOF
+		}
+	}
+}
+
+// peekType reads type header of binary event, otherwise only type attribute of structured event
+func peekType(msg *nats.Msg) string {
+	if typ := msg.Header.Get(headerType); typ != "" {
+		return typ
+	}
+
+	var v struct {
+		Type string `json:"type"`
+	}
+
+	_ = json.Unmarshal(msg.Data, &v)
+
+	return v.Type
+}
@@ -0,0 +1,112 @@
+package protonats_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/d7561985/protonats"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterFailFast(t *testing.T) {
+	l := protonats.NewRateLimiter("test", protonats.RateLimit{Rate: 1, Burst: 1})
+
+	require.NoError(t, l.Wait(context.Background(), "orders", "order.created"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := l.Wait(ctx, "orders", "order.created")
+	assert.True(t, errors.Is(err, protonats.ErrRateLimited))
+}
+
+func TestRateLimiterTypeBucket(t *testing.T) {
+	l := protonats.NewRateLimiter("test", protonats.RateLimit{},
+		protonats.WithTypeLimit("order.created", protonats.RateLimit{Rate: 20, Burst: 1}))
+
+	ctx := context.Background()
+
+	// other types are unlimited
+	for i := 0; i < 10; i++ {
+		require.NoError(t, l.Wait(ctx, "orders", "order.paid"))
+	}
+
+	start := time.Now()
+	require.NoError(t, l.Wait(ctx, "orders", "order.created"))
+	require.NoError(t, l.Wait(ctx, "orders", "order.created"))
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestRateLimitedReceiverContinues(t *testing.T) {
+	ch := make(chan *nats.Msg, 3)
+	for _, subject := range []string{"orders.a", "orders.b", "payments.a"} {
+		ch <- &nats.Msg{Subject: subject, Data: []byte(`{}`)}
+	}
+
+	var failed []error
+	r := protonats.NewReceiverWithFailureHandler(ch, func(msg *nats.Msg, result error) error {
+		failed = append(failed, result)
+		return nil
+	})
+
+	// zero burst rejects orders at once
+	l := protonats.NewRateLimiter("test", protonats.RateLimit{},
+		protonats.WithSubjectLimit("orders.a", protonats.RateLimit{Rate: 1}),
+		protonats.WithSubjectLimit("orders.b", protonats.RateLimit{Rate: 1}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	lr := protonats.NewRateLimitedReceiver(r, l)
+
+	msg, err := lr.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "payments.a", msg.(*protonats.Message).Msg.Subject)
+	require.Len(t, failed, 2)
+	assert.True(t, errors.Is(failed[0], protonats.ErrRateLimited))
+
+	// stopped consumer
+	_, err = lr.Receive(ctx)
+	assert.Equal(t, io.EOF, err)
+}
+
+type throttleMetrics struct {
+	rejected []string
+}
+
+func (m *throttleMetrics) AddThrottleWait(string, string, string, time.Duration) protonats.ThrottleMetrics {
+	return m
+}
+
+func (m *throttleMetrics) AddThrottleRejected(_, kind, key string) protonats.ThrottleMetrics {
+	m.rejected = append(m.rejected, kind+":"+key)
+	return m
+}
+
+func TestRateLimitedReceiverBinaryType(t *testing.T) {
+	ch := make(chan *nats.Msg, 2)
+	ch <- &nats.Msg{Subject: "orders", Header: nats.Header{"ce-type": []string{"order.created"}}, Data: []byte(`binary data`)}
+	ch <- &nats.Msg{Subject: "orders", Data: []byte(`{"type":"order.paid"}`)}
+
+	var failed int
+	r := protonats.NewReceiverWithFailureHandler(ch, func(msg *nats.Msg, result error) error {
+		failed++
+		return nil
+	})
+
+	m := &throttleMetrics{}
+	l := protonats.NewRateLimiter("test", protonats.RateLimit{},
+		protonats.WithTypeLimit("order.created", protonats.RateLimit{Rate: 1}), protonats.WithLimiterMetrics(m))
+
+	// type of binary event is read from header, dropped core NATS message is counted
+	msg, err := protonats.NewRateLimitedReceiver(r, l).Receive(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, `{"type":"order.paid"}`, string(msg.(*protonats.Message).Msg.Data))
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, []string{"type:order.created"}, m.rejected)
+}
@@ -9,11 +9,15 @@ import (
 	"context"
 	"io"
 	"sync"
+	"time"
 
 	cn "github.com/cloudevents/sdk-go/protocol/nats/v2"
 	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/client"
 	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/tel"
 	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
 )
 
 type NatsReceiver interface {
@@ -23,12 +27,19 @@ type NatsReceiver interface {
 var _ protocol.Receiver = (*Receiver)(nil)
 
 type Receiver struct {
-	incoming <-chan *nats.Msg
+	incoming  <-chan *nats.Msg
+	onFailure FailureHandler
 }
 
 func NewReceiver(ch <-chan *nats.Msg) NatsReceiver {
+	return NewReceiverWithFailureHandler(ch, NakOnFailure())
+}
+
+// NewReceiverWithFailureHandler creates receiver which messages use fn for not acknowledged results
+func NewReceiverWithFailureHandler(ch <-chan *nats.Msg, fn FailureHandler) NatsReceiver {
 	return &Receiver{
-		incoming: ch,
+		incoming:  ch,
+		onFailure: fn,
 	}
 }
 
@@ -39,12 +50,34 @@ func (r *Receiver) Receive(ctx context.Context) (binding.Message, error) {
 			return nil, io.EOF
 		}
 
-		return cn.NewMessage(in), nil
+		return &Message{Message: cn.NewMessage(in), onFailure: r.onFailure, received: time.Now()}, nil
 	case <-ctx.Done():
 		return nil, io.EOF
 	}
 }
 
+// Message binds handler result to the NATS message acknowledgement.
+// JetStream message is acked on success, otherwise message follows the failure handler.
+type Message struct {
+	*cn.Message
+
+	onFailure FailureHandler
+	received  time.Time
+}
+
+// Finish implements binding.Message.Finish
+func (m *Message) Finish(err error) error {
+	if protocol.IsACK(err) {
+		if !isJetStream(m.Msg) {
+			return nil
+		}
+
+		return m.Msg.Ack()
+	}
+
+	return m.onFailure(m.Msg, err)
+}
+
 type Consumer struct {
 	NatsReceiver
 
@@ -55,6 +88,14 @@ type Consumer struct {
 	Subject    string
 	Subscriber Subscriber
 
+	middlewares []Middleware
+	obs         client.ObservabilityService
+	onFailure   FailureHandler
+	malformed   FailureHandler
+	denied      FailureHandler
+	limiter     *RateLimiter
+	concurrency int
+
 	subMtx        sync.Mutex
 	internalClose chan struct{}
 	connOwned     bool
@@ -78,14 +119,13 @@ func NewConsumer(url, subject string, natsOpts []nats.Option, opts ...ConsumerOp
 }
 
 func NewConsumerFromConn(conn *nats.Conn, subject string, opts ...ConsumerOption) (*Consumer, error) {
-	ch := make(chan *nats.Msg)
-
 	c := &Consumer{
-		ch:            ch,
-		NatsReceiver:  NewReceiver(ch),
+		ch:            make(chan *nats.Msg),
 		Conn:          conn,
 		Subject:       subject,
 		Subscriber:    &RegularSubscriber{},
+		onFailure:     NakOnFailure(),
+		malformed:     TermOnFailure(),
 		internalClose: make(chan struct{}, 1),
 	}
 
@@ -94,6 +134,16 @@ func NewConsumerFromConn(conn *nats.Conn, subject string, opts ...ConsumerOption
 		return nil, err
 	}
 
+	onFailure := malformedOnFailure(c.malformed, c.onFailure)
+	if c.denied != nil {
+		onFailure = denyOnFailure(c.denied, onFailure)
+	}
+
+	c.NatsReceiver = NewReceiverWithFailureHandler(c.ch, onFailure)
+	if c.limiter != nil {
+		c.NatsReceiver = NewRateLimitedReceiver(c.NatsReceiver, c.limiter)
+	}
+
 	return c, nil
 }
 
@@ -135,6 +185,155 @@ func (c *Consumer) Close(_ context.Context) error {
 	return nil
 }
 
+// Wrap returns fn wrapped with consumer middlewares, Recoverer is always the innermost one.
+// Useful when events are dispatched by cloudevents client instead of StartReceiver:
+//
+//	ce.StartReceiver(ctx, consumer.Wrap(fn))
+func (c *Consumer) Wrap(fn Handler) Handler {
+	mw := make([]Middleware, 0, len(c.middlewares)+1)
+	mw = append(mw, c.middlewares...)
+
+	return Chain(fn, append(mw, Recoverer())...)
+}
+
+// StartReceiver opens inbound and dispatches every received event through middleware chain to fn.
+// Each message is handled in own goroutine and finished with handler result,
+// number of concurrent handlers is limited by WithConcurrency.
+// Blocks until ctx is done or consumer closed.
+func (c *Consumer) StartReceiver(ctx context.Context, fn Handler) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	h := c.Wrap(fn)
+
+	var sem chan struct{}
+	if c.concurrency > 0 {
+		sem = make(chan struct{}, c.concurrency)
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			msg, err := c.Receive(ctx)
+			if err == io.EOF {
+				return
+			}
+
+			if err != nil {
+				tel.FromCtx(ctx).Warn("receive message", zap.Error(err))
+				continue
+			}
+
+			if sem != nil {
+				sem <- struct{}{}
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.invoke(ctx, h, msg)
+
+				if sem != nil {
+					<-sem
+				}
+			}()
+		}
+	}()
+
+	err := c.OpenInbound(ctx)
+	if err != nil {
+		cancel()
+	}
+
+	wg.Wait()
+
+	return err
+}
+
+func (c *Consumer) invoke(ctx context.Context, h Handler, msg binding.Message) {
+	// middlewares could panic as well
+	defer func() {
+		if r := recover(); r != nil {
+			err := NewPanicError(r)
+			tel.FromCtx(ctx).Error("consumer invoke", zap.Error(err), zap.String("stack", string(err.Stack)))
+
+			if err := msg.Finish(err); err != nil {
+				tel.FromCtx(ctx).Warn("finish message", zap.Error(err))
+			}
+		}
+	}()
+
+	if c.obs != nil {
+		for _, fn := range c.obs.InboundContextDecorators() {
+			ctx = fn(ctx, msg)
+		}
+	}
+
+	e, err := binding.ToEvent(ctx, msg)
+	if err == nil {
+		err = e.Validate()
+	}
+
+	if err != nil {
+		err = &MalformedEventError{Err: err}
+		tel.FromCtx(ctx).Error("malformed event", zap.Error(err))
+
+		if c.obs != nil {
+			c.obs.RecordReceivedMalformedEvent(ctx, err)
+		}
+
+		if err = msg.Finish(err); err != nil {
+			tel.FromCtx(ctx).Warn("finish malformed message", zap.Error(err))
+		}
+
+		return
+	}
+
+	ctx = WithCausingEvent(ctx, *e)
+
+	if m, ok := msg.(*Message); ok {
+		ctx = WithNatsMsg(ctx, m.Msg)
+
+		if meta, err := m.Msg.Metadata(); err == nil {
+			ctx = WithMsgMetadata(ctx, meta)
+		}
+	}
+
+	if err = msg.Finish(h(ctx, *e)); err != nil {
+		tel.FromCtx(ctx).Warn("finish message", zap.Error(err))
+	}
+}
+
+type msgMetadataKey struct{}
+
+// WithMsgMetadata puts JetStream metadata of the handled message into context
+func WithMsgMetadata(ctx context.Context, meta *nats.MsgMetadata) context.Context {
+	return context.WithValue(ctx, msgMetadataKey{}, meta)
+}
+
+// MsgMetadataFrom returns JetStream metadata of the handled message, nil for core NATS message
+func MsgMetadataFrom(ctx context.Context) *nats.MsgMetadata {
+	meta, _ := ctx.Value(msgMetadataKey{}).(*nats.MsgMetadata)
+	return meta
+}
+
+type natsMsgKey struct{}
+
+// WithNatsMsg puts NATS message of the handled event into context
+func WithNatsMsg(ctx context.Context, msg *nats.Msg) context.Context {
+	return context.WithValue(ctx, natsMsgKey{}, msg)
+}
+
+// NatsMsgFrom returns NATS message of the event handled by Consumer, e.g. to read its subject or headers
+func NatsMsgFrom(ctx context.Context) *nats.Msg {
+	msg, _ := ctx.Value(natsMsgKey{}).(*nats.Msg)
+	return msg
+}
+
 type ConsumerOption func(*Consumer) error
 
 func (c *Consumer) applyOptions(opts ...ConsumerOption) error {
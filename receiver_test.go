@@ -0,0 +1,179 @@
+package protonats_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/d7561985/tel"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendOrders publishes n orders.created events
+func sendOrders(t *testing.T, conn *nats.Conn, n int) {
+	s, err := protonats.NewSenderFromConnWithOptions(conn, "orders.created")
+	require.NoError(t, err)
+
+	for i := 0; i < n; i++ {
+		e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+		require.NoError(t, s.Send(context.Background(), (*binding.EventMessage)(&e)))
+	}
+}
+
+func TestWithConcurrency(t *testing.T) {
+	_, err := protonats.NewConsumerFromConn(nil, "orders.created", protonats.WithConcurrency(-1))
+	assert.Error(t, err)
+
+	for _, limit := range []int{1, 3} {
+		conn := runServer(t)
+
+		c, err := protonats.NewConsumerFromConn(conn, "orders.created", protonats.WithReceiveBuffer(32), protonats.WithConcurrency(limit))
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var (
+			running, max int32
+			wg           sync.WaitGroup
+		)
+
+		wg.Add(12)
+		go func() {
+			_ = c.StartReceiver(ctx, func(ctx context.Context, e cloudevents.Event) protocol.Result {
+				defer wg.Done()
+
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+
+				for {
+					cur := atomic.LoadInt32(&max)
+					if n <= cur || atomic.CompareAndSwapInt32(&max, cur, n) {
+						break
+					}
+				}
+
+				time.Sleep(20 * time.Millisecond)
+				return nil
+			})
+		}()
+
+		require.NoError(t, conn.Flush())
+		time.Sleep(50 * time.Millisecond)
+		sendOrders(t, conn, 12)
+
+		wg.Wait()
+		cancel()
+
+		assert.Equal(t, int32(limit), atomic.LoadInt32(&max), "limit %d", limit)
+	}
+}
+
+func TestMsgMetadataFrom(t *testing.T) {
+	assert.Nil(t, protonats.MsgMetadataFrom(context.Background()))
+
+	for name, opts := range map[string][]protonats.ConsumerOption{
+		"core":      nil,
+		"jetstream": {protonats.WithJetStreamSubscriber("", nats.Durable("meta"))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := runServer(t)
+
+			c, err := protonats.NewConsumerFromConn(conn, "orders.created", append(opts, protonats.WithReceiveBuffer(8), protonats.WithConcurrency(1))...)
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			metas := make(chan *nats.MsgMetadata, 2)
+			go func() {
+				_ = c.StartReceiver(ctx, func(ctx context.Context, e cloudevents.Event) protocol.Result {
+					metas <- protonats.MsgMetadataFrom(ctx)
+					return nil
+				})
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+			sendOrders(t, conn, 2)
+
+			for seq := uint64(1); seq <= 2; seq++ {
+				var meta *nats.MsgMetadata
+				select {
+				case meta = <-metas:
+				case <-time.After(time.Second):
+					t.Fatal("event isn't handled")
+				}
+
+				if name == "core" {
+					assert.Nil(t, meta)
+					continue
+				}
+
+				require.NotNil(t, meta)
+				assert.Equal(t, "ORDERS", meta.Stream)
+				assert.Equal(t, seq, meta.Sequence.Stream)
+				assert.Equal(t, uint64(1), meta.NumDelivered)
+			}
+		})
+	}
+}
+
+type receiveMetrics struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+}
+
+func (m *receiveMetrics) AddReceiveLatency(typ string, d time.Duration) protonats.ReceiveMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.latencies[typ] = append(m.latencies[typ], d)
+	return m
+}
+
+func TestReceiveLatencyConcurrency(t *testing.T) {
+	conn := runServer(t)
+
+	m := &receiveMetrics{latencies: map[string][]time.Duration{}}
+	tl := tel.NewNull()
+	obs := protonats.NewTeleObservability(&tl, metricsReader(), protonats.WithObservabilityMetrics(m)).(*protonats.TeleObservability)
+
+	c, err := protonats.NewConsumerFromConn(conn, "orders.created",
+		protonats.WithReceiveBuffer(8), protonats.WithConcurrency(1), protonats.WithObservability(obs))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	go func() {
+		_ = c.StartReceiver(ctx, func(ctx context.Context, e cloudevents.Event) protocol.Result {
+			defer wg.Done()
+
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	sendOrders(t, conn, 3)
+	wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// received events wait for the previous handler
+	latencies := m.latencies["orders.created"]
+	require.Len(t, latencies, 3)
+	assert.True(t, latencies[1] >= 40*time.Millisecond, latencies)
+	assert.True(t, latencies[2] >= 40*time.Millisecond, latencies)
+}
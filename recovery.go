@@ -0,0 +1,43 @@
+package protonats
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+)
+
+// PanicError is handler panic converted into handler error
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func NewPanicError(v interface{}) *PanicError {
+	return &PanicError{Value: v, Stack: debug.Stack()}
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", p.Value)
+}
+
+// Recoverer converts handler panic into *PanicError result,
+// so it passes through middlewares as regular error and message follows the failure path.
+// Consumer always puts it as the innermost middleware.
+// cloudevents client doesn't recover handler panics, so handler passed to client.StartReceiver
+// should be wrapped with Consumer.Wrap or Chain(fn, Recoverer()), otherwise panic crashes the process.
+func Recoverer() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, e cloudevents.Event) (res protocol.Result) {
+			defer func() {
+				if r := recover(); r != nil {
+					res = NewPanicError(r)
+				}
+			}()
+
+			return next(ctx, e)
+		}
+	}
+}
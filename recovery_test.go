@@ -0,0 +1,58 @@
+package protonats_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/d7561985/tel"
+	"github.com/d7561985/tel/monitoring/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverer(t *testing.T) {
+	h := protonats.Chain(func(ctx context.Context, e cloudevents.Event) protocol.Result {
+		panic("boom")
+	}, protonats.Recoverer())
+
+	res := h(context.Background(), cloudevents.NewEvent())
+
+	var pe *protonats.PanicError
+	require.True(t, errors.As(res, &pe))
+	assert.Equal(t, "boom", pe.Value)
+	assert.NotEmpty(t, pe.Stack)
+	assert.False(t, protocol.IsACK(res))
+}
+
+// processErrors counts process errors by topic
+type processErrors struct {
+	metrics.MetricsReader
+
+	topics []string
+}
+
+func (m *processErrors) AddReaderTopicProcessError(topic string) metrics.MetricsReader {
+	m.topics = append(m.topics, topic)
+	return m
+}
+
+func TestRecordCallingInvokerPanic(t *testing.T) {
+	m := &processErrors{MetricsReader: metricsReader()}
+
+	tl := tel.NewNull()
+	obs := protonats.NewTeleObservability(&tl, m).(*protonats.TeleObservability)
+
+	h := protonats.Chain(func(ctx context.Context, e cloudevents.Event) protocol.Result {
+		panic("boom")
+	}, obs.Middleware(), protonats.Recoverer())
+
+	res := h(tl.Ctx(), newEvent(t, "orders.created", orderCreated{ID: "o1"}))
+
+	var pe *protonats.PanicError
+	require.True(t, errors.As(res, &pe))
+	assert.Equal(t, []string{"orders.created"}, m.topics)
+}
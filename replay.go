@@ -0,0 +1,278 @@
+package protonats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	cn "github.com/cloudevents/sdk-go/protocol/nats/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/tel"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+var ErrReplayStartConflict = errors.New("replay: start time and start sequence are mutually exclusive")
+
+// ReplayStats result of replay run
+type ReplayStats struct {
+	Processed int
+	Skipped   int
+	Failed    int
+	Malformed int
+
+	LastSequence uint64
+}
+
+// Replay re-runs handler over historical JetStream events using ordered ephemeral consumer.
+// Replay stops at end sequence / time or when it reaches the stream tail, it never waits for new events.
+type Replay struct {
+	Conn    *nats.Conn
+	Subject string
+
+	stream    string
+	startTime time.Time
+	startSeq  uint64
+	endTime   time.Time
+	endSeq    uint64
+	types     []string
+	interval  time.Duration
+
+	dryRun io.Writer
+}
+
+type ReplayOption func(*Replay) error
+
+// WithReplayStream binds replay to the stream instead of stream lookup by subject
+func WithReplayStream(stream string) ReplayOption {
+	return func(r *Replay) error {
+		r.stream = stream
+		return nil
+	}
+}
+
+// WithReplayStartTime starts replay from the first message stored at or after t
+func WithReplayStartTime(t time.Time) ReplayOption {
+	return func(r *Replay) error {
+		if r.startSeq > 0 {
+			return ErrReplayStartConflict
+		}
+		r.startTime = t
+		return nil
+	}
+}
+
+// WithReplayStartSequence starts replay from stream sequence
+func WithReplayStartSequence(seq uint64) ReplayOption {
+	return func(r *Replay) error {
+		if !r.startTime.IsZero() {
+			return ErrReplayStartConflict
+		}
+		r.startSeq = seq
+		return nil
+	}
+}
+
+// WithReplayEndTime stops replay on the first message stored after t
+func WithReplayEndTime(t time.Time) ReplayOption {
+	return func(r *Replay) error {
+		r.endTime = t
+		return nil
+	}
+}
+
+// WithReplayEndSequence stops replay after stream sequence
+func WithReplayEndSequence(seq uint64) ReplayOption {
+	return func(r *Replay) error {
+		r.endSeq = seq
+		return nil
+	}
+}
+
+// WithReplayTypes replays only events which type matches any of patterns, path.Match syntax
+func WithReplayTypes(patterns ...string) ReplayOption {
+	return func(r *Replay) error {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("replay type pattern %q: %w", p, err)
+			}
+		}
+
+		r.types = append(r.types, patterns...)
+		return nil
+	}
+}
+
+// WithReplayRate limits handled events per second
+func WithReplayRate(perSecond float64) ReplayOption {
+	return func(r *Replay) error {
+		if perSecond > 0 {
+			r.interval = time.Duration(float64(time.Second) / perSecond)
+		}
+		return nil
+	}
+}
+
+// WithReplayDryRun prints events into w instead of handler call
+func WithReplayDryRun(w io.Writer) ReplayOption {
+	return func(r *Replay) error {
+		r.dryRun = w
+		return nil
+	}
+}
+
+func NewReplay(conn *nats.Conn, subject string, opts ...ReplayOption) (*Replay, error) {
+	r := &Replay{Conn: conn, Subject: subject}
+
+	for _, fn := range opts {
+		if err := fn(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Run feeds replayed events into h in stream order.
+// Pass Consumer.Wrap(h) to replay through the same middlewares as live consumer.
+// Handler errors are counted and don't stop replay.
+func (r *Replay) Run(ctx context.Context, h Handler) (ReplayStats, error) {
+	var stats ReplayStats
+
+	js, err := r.Conn.JetStream()
+	if err != nil {
+		return stats, err
+	}
+
+	sub, err := js.SubscribeSync(r.Subject, r.subOptions()...)
+	if err != nil {
+		return stats, fmt.Errorf("replay subscribe: %w", err)
+	}
+
+	defer func() { _ = sub.Unsubscribe() }()
+
+	// nothing to replay, don't wait for new events
+	if info, err := sub.ConsumerInfo(); err == nil && info.NumPending == 0 && info.Delivered.Consumer == 0 {
+		return stats, nil
+	}
+
+	var next time.Time
+
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return stats, nil
+			}
+
+			return stats, err
+		}
+
+		meta, err := msg.Metadata()
+		if err != nil {
+			return stats, err
+		}
+
+		if r.isEnd(meta) {
+			return stats, nil
+		}
+
+		stats.LastSequence = meta.Sequence.Stream
+
+		if err = r.handle(ctx, h, msg, meta, &stats, &next); err != nil {
+			return stats, err
+		}
+
+		// tail of the stream at the moment of delivery
+		if meta.NumPending == 0 {
+			return stats, nil
+		}
+	}
+}
+
+func (r *Replay) handle(ctx context.Context, h Handler, msg *nats.Msg, meta *nats.MsgMetadata, stats *ReplayStats, next *time.Time) error {
+	e, err := binding.ToEvent(ctx, cn.NewMessage(msg))
+	if err != nil {
+		stats.Malformed++
+		tel.FromCtx(ctx).Warn("replay malformed event", zap.Error(err), zap.Uint64("seq", meta.Sequence.Stream))
+		return nil
+	}
+
+	if !r.match(e.Type()) {
+		stats.Skipped++
+		return nil
+	}
+
+	if r.interval > 0 {
+		if wait := time.Until(*next); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		*next = time.Now().Add(r.interval)
+	}
+
+	if r.dryRun != nil {
+		stats.Processed++
+		_, err = fmt.Fprintf(r.dryRun, "#%d %s %s\n%s\n", meta.Sequence.Stream, meta.Timestamp.Format(time.RFC3339Nano), msg.Subject, e)
+		return err
+	}
+
+	if res := h(WithMsgMetadata(ctx, meta), *e); !protocol.IsACK(res) {
+		stats.Failed++
+		tel.FromCtx(ctx).Warn("replay handler", zap.Error(res), zap.Uint64("seq", meta.Sequence.Stream), zap.String("id", e.ID()))
+		return nil
+	}
+
+	stats.Processed++
+
+	return nil
+}
+
+func (r *Replay) subOptions() []nats.SubOpt {
+	opts := []nats.SubOpt{nats.OrderedConsumer()}
+
+	if r.stream != "" {
+		opts = append(opts, nats.BindStream(r.stream))
+	}
+
+	switch {
+	case !r.startTime.IsZero():
+		opts = append(opts, nats.StartTime(r.startTime))
+	case r.startSeq > 0:
+		opts = append(opts, nats.StartSequence(r.startSeq))
+	default:
+		opts = append(opts, nats.DeliverAll())
+	}
+
+	return opts
+}
+
+func (r *Replay) isEnd(meta *nats.MsgMetadata) bool {
+	if r.endSeq > 0 && meta.Sequence.Stream > r.endSeq {
+		return true
+	}
+
+	return !r.endTime.IsZero() && meta.Timestamp.After(r.endTime)
+}
+
+func (r *Replay) match(typ string) bool {
+	if len(r.types) == 0 {
+		return true
+	}
+
+	for _, p := range r.types {
+		if ok, _ := path.Match(p, typ); ok {
+			return true
+		}
+	}
+
+	return false
+}
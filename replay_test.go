@@ -0,0 +1,131 @@
+package protonats_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replayStream stores orders.created o1, orders.paid o1, garbage, orders.created o2, orders.created o3
+func replayStream(t *testing.T) *nats.Conn {
+	conn := runServer(t)
+	js, err := conn.JetStream()
+	require.NoError(t, err)
+
+	s, err := protonats.NewSenderFromConnWithOptions(conn, "orders.created")
+	require.NoError(t, err)
+
+	send := func(typ, id string) {
+		e := newEvent(t, typ, orderCreated{ID: id})
+		e.SetID(typ + "/" + id)
+		require.NoError(t, s.Send(context.Background(), (*binding.EventMessage)(&e)))
+	}
+
+	send("orders.created", "o1")
+	send("orders.paid", "o1")
+
+	_, err = js.Publish("orders.created", []byte("garbage"))
+	require.NoError(t, err)
+
+	send("orders.created", "o2")
+	send("orders.created", "o3")
+
+	return conn
+}
+
+// runReplay returns ids of handled events with their stream sequence
+func runReplay(t *testing.T, conn *nats.Conn, fail string, opts ...protonats.ReplayOption) (map[string]uint64, protonats.ReplayStats) {
+	r, err := protonats.NewReplay(conn, "orders.>", opts...)
+	require.NoError(t, err)
+
+	handled := map[string]uint64{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stats, err := r.Run(ctx, func(ctx context.Context, e cloudevents.Event) protocol.Result {
+		meta := protonats.MsgMetadataFrom(ctx)
+		require.NotNil(t, meta)
+
+		handled[e.ID()] = meta.Sequence.Stream
+		if e.ID() == fail {
+			return errors.New("boom")
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, ctx.Err(), "replay should stop at the stream tail")
+
+	return handled, stats
+}
+
+func TestReplay(t *testing.T) {
+	conn := replayStream(t)
+
+	handled, stats := runReplay(t, conn, "orders.paid/o1")
+	assert.Equal(t, map[string]uint64{"orders.created/o1": 1, "orders.paid/o1": 2, "orders.created/o2": 4, "orders.created/o3": 5}, handled)
+	assert.Equal(t, protonats.ReplayStats{Processed: 3, Failed: 1, Malformed: 1, LastSequence: 5}, stats)
+
+	// sequence range and type filter
+	handled, stats = runReplay(t, conn, "",
+		protonats.WithReplayStartSequence(2), protonats.WithReplayEndSequence(4), protonats.WithReplayTypes("*.created"))
+	assert.Equal(t, map[string]uint64{"orders.created/o2": 4}, handled)
+	assert.Equal(t, protonats.ReplayStats{Processed: 1, Skipped: 1, Malformed: 1, LastSequence: 4}, stats)
+
+	// time range
+	js, err := conn.JetStream()
+	require.NoError(t, err)
+
+	third, err := js.GetMsg("ORDERS", 3)
+	require.NoError(t, err)
+
+	handled, _ = runReplay(t, conn, "", protonats.WithReplayStartTime(third.Time), protonats.WithReplayEndTime(third.Time))
+	assert.Empty(t, handled)
+
+	handled, _ = runReplay(t, conn, "", protonats.WithReplayStartTime(third.Time.Add(-time.Nanosecond)))
+	assert.Len(t, handled, 2)
+
+	_, err = protonats.NewReplay(conn, "orders.>", protonats.WithReplayStartSequence(1), protonats.WithReplayStartTime(time.Now()))
+	assert.True(t, errors.Is(err, protonats.ErrReplayStartConflict))
+}
+
+func TestReplayDryRun(t *testing.T) {
+	conn := replayStream(t)
+
+	var out bytes.Buffer
+	handled, stats := runReplay(t, conn, "", protonats.WithReplayDryRun(&out), protonats.WithReplayTypes("orders.paid"))
+	assert.Empty(t, handled)
+	assert.Equal(t, 1, stats.Processed)
+	assert.Contains(t, out.String(), "#2 ")
+	assert.Contains(t, out.String(), "orders.paid")
+}
+
+func TestReplayRate(t *testing.T) {
+	conn := replayStream(t)
+
+	start := time.Now()
+	_, stats := runReplay(t, conn, "", protonats.WithReplayRate(20))
+	assert.Equal(t, 4, stats.Processed)
+
+	// the first event isn't delayed
+	assert.True(t, time.Since(start) >= 150*time.Millisecond, time.Since(start))
+}
+
+func TestReplayEmptyStream(t *testing.T) {
+	conn := runServer(t)
+
+	handled, stats := runReplay(t, conn, "")
+	assert.Empty(t, handled)
+	assert.Equal(t, protonats.ReplayStats{}, stats)
+}
@@ -0,0 +1,130 @@
+package protonats
+
+import (
+	"context"
+	"path"
+	"reflect"
+	"sync"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/opentracing/opentracing-go"
+)
+
+// RouteAttr span tag containing matched router pattern
+const RouteAttr = "cloudevents.route"
+
+// Handler is the function signature which cloudevents client accepts as receiver
+type Handler func(ctx context.Context, e cloudevents.Event) protocol.Result
+
+// TypedHandler receives event with data already decoded into T
+type TypedHandler[T any] func(ctx context.Context, e cloudevents.Event, data T) error
+
+type route struct {
+	pattern string
+	h       Handler
+}
+
+// Router dispatches events to handlers by event type.
+// Exact type registrations take precedence over glob patterns, patterns are matched in registration order.
+//
+// Router.Receive is Handler and could be passed directly to cloudevents client:
+//
+//	ce.StartReceiver(ctx, router.Receive)
+type Router struct {
+	mx sync.RWMutex
+
+	exact    map[string]route
+	patterns []route
+}
+
+func NewRouter() *Router {
+	return &Router{exact: make(map[string]route)}
+}
+
+// Handle registers typed handler for event type pattern.
+// Pattern syntax is the same as path.Match, e.g. "orders.*" or "orders.created".
+// Event data decoded with event.DataAs into T, pointer types are allocated automatically.
+func Handle[T any](r *Router, pattern string, fn TypedHandler[T]) {
+	r.HandleEvent(pattern, func(ctx context.Context, e cloudevents.Event) protocol.Result {
+		data, err := decodeAs[T](e)
+		if err != nil {
+			return protocol.NewReceipt(false, "route %q decode %T: %w", pattern, data, err)
+		}
+
+		return fn(ctx, e, data)
+	})
+}
+
+// HandleEvent registers raw Handler for event type pattern
+func (r *Router) HandleEvent(pattern string, h Handler) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		panic("protonats: bad route pattern " + pattern + ": " + err.Error())
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	rt := route{pattern: pattern, h: h}
+	if isGlob(pattern) {
+		r.patterns = append(r.patterns, rt)
+		return
+	}
+
+	r.exact[pattern] = rt
+}
+
+// Receive dispatches event to matched handler and tags current span with matched route.
+// Events without route are NACKed.
+func (r *Router) Receive(ctx context.Context, e cloudevents.Event) protocol.Result {
+	rt, ok := r.match(e.Type())
+	if !ok {
+		return protocol.NewReceipt(false, "no route for event type %q", e.Type())
+	}
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span.SetTag(RouteAttr, rt.pattern)
+	}
+
+	return rt.h(ctx, e)
+}
+
+func (r *Router) match(typ string) (route, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if rt, ok := r.exact[typ]; ok {
+		return rt, true
+	}
+
+	for _, rt := range r.patterns {
+		if ok, _ := path.Match(rt.pattern, typ); ok {
+			return rt, true
+		}
+	}
+
+	return route{}, false
+}
+
+func isGlob(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+
+	return false
+}
+
+func decodeAs[T any](e cloudevents.Event) (T, error) {
+	var v T
+
+	// pointer types like protobuf messages require allocated value
+	if t := reflect.TypeOf(v); t != nil && t.Kind() == reflect.Ptr {
+		v = reflect.New(t.Elem()).Interface().(T)
+		return v, e.DataAs(v)
+	}
+
+	return v, e.DataAs(&v)
+}
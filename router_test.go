@@ -0,0 +1,51 @@
+package protonats_test
+
+import (
+	"context"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type orderCreated struct {
+	ID string `json:"id"`
+}
+
+func newEvent(t *testing.T, typ string, data interface{}) cloudevents.Event {
+	e := cloudevents.NewEvent()
+	e.SetID("1")
+	e.SetSource("test")
+	e.SetType(typ)
+	require.NoError(t, e.SetData(cloudevents.ApplicationJSON, data))
+
+	return e
+}
+
+func TestRouter(t *testing.T) {
+	r := protonats.NewRouter()
+
+	var exact, glob []string
+
+	protonats.Handle(r, "orders.created", func(ctx context.Context, e cloudevents.Event, data orderCreated) error {
+		exact = append(exact, data.ID)
+		return nil
+	})
+	protonats.Handle(r, "orders.*", func(ctx context.Context, e cloudevents.Event, data *orderCreated) error {
+		glob = append(glob, data.ID)
+		return nil
+	})
+
+	ctx := context.Background()
+
+	assert.True(t, protocol.IsACK(r.Receive(ctx, newEvent(t, "orders.created", orderCreated{ID: "A"}))))
+	assert.True(t, protocol.IsACK(r.Receive(ctx, newEvent(t, "orders.paid", orderCreated{ID: "B"}))))
+	assert.True(t, protocol.IsNACK(r.Receive(ctx, newEvent(t, "payments.created", orderCreated{ID: "C"}))))
+	assert.True(t, protocol.IsNACK(r.Receive(ctx, newEvent(t, "orders.created", "not an object"))))
+
+	assert.Equal(t, []string{"A"}, exact)
+	assert.Equal(t, []string{"B"}, glob)
+}
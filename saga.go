@@ -0,0 +1,728 @@
+package protonats
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/observability"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/tel"
+	"github.com/nats-io/nats.go"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrSagaNotFound  = errors.New("saga: state not found")
+	ErrSagaConflict  = errors.New("saga: state was changed concurrently")
+	ErrSagaTimeout   = errors.New("saga: timeout")
+	ErrSagaDuplicate = errors.New("saga: event type is already registered")
+)
+
+type SagaStatus string
+
+const (
+	SagaRunning      SagaStatus = "running"
+	SagaCompensating SagaStatus = "compensating"
+	SagaCompleted    SagaStatus = "completed"
+	SagaCompensated  SagaStatus = "compensated"
+)
+
+// SagaStep handled saga event
+type SagaStep struct {
+	Type    string    `json:"type"`
+	EventID string    `json:"event_id"`
+	At      time.Time `json:"at"`
+}
+
+// SagaState persisted saga instance
+type SagaState struct {
+	ID     string     `json:"id"`
+	Name   string     `json:"name"`
+	Status SagaStatus `json:"status"`
+
+	// Data is user state, see SagaContext.Get and SagaContext.Set
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// Steps handled events, compensation walks them backwards
+	Steps []SagaStep `json:"steps"`
+	// Compensated number of steps from the end which are already compensated
+	Compensated int    `json:"compensated,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	// Deadline of running saga or the next compensation retry
+	Deadline time.Time `json:"deadline,omitempty"`
+
+	// Trace saga root span, every step span is its child
+	Trace string `json:"trace,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (s *SagaState) handled(eventID string) bool {
+	for _, step := range s.Steps {
+		if step.EventID == eventID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SagaStore persists saga states with optimistic concurrency
+type SagaStore interface {
+	// Load returns state and its revision or ErrSagaNotFound
+	Load(ctx context.Context, name, id string) (SagaState, uint64, error)
+	// Save creates state when rev is zero, otherwise updates it if revision matches or returns ErrSagaConflict
+	Save(ctx context.Context, st SagaState, rev uint64) (uint64, error)
+	// Expired returns up to limit running or compensating sagas which deadline is before now
+	Expired(ctx context.Context, now time.Time, limit int) ([]SagaState, error)
+}
+
+// SagaHandler reacts on saga event, use SagaContext to send commands, keep data and finish saga
+type SagaHandler func(ctx context.Context, sc *SagaContext, e cloudevents.Event) error
+
+// SagaCompensation undoes completed step
+type SagaCompensation func(ctx context.Context, sc *SagaContext, step SagaStep) error
+
+// Saga declares steps and compensations of the workflow by event type
+type Saga struct {
+	Name string
+
+	timeout time.Duration
+
+	start        map[string]SagaHandler
+	steps        map[string]SagaHandler
+	compensation map[string]SagaCompensation
+	onTimeout    SagaHandler
+}
+
+// NewSaga creates saga definition, running saga is compensated after timeout
+func NewSaga(name string, timeout time.Duration) *Saga {
+	return &Saga{
+		Name:         name,
+		timeout:      timeout,
+		start:        make(map[string]SagaHandler),
+		steps:        make(map[string]SagaHandler),
+		compensation: make(map[string]SagaCompensation),
+	}
+}
+
+// StartOn begins new saga on event type, saga id is correlation id of the event or event id
+func (s *Saga) StartOn(typ string, h SagaHandler) *Saga {
+	s.start[typ] = h
+	return s
+}
+
+// On handles event type of running saga
+func (s *Saga) On(typ string, h SagaHandler) *Saga {
+	s.steps[typ] = h
+	return s
+}
+
+// Compensate undoes step handled for event type when saga fails
+func (s *Saga) Compensate(typ string, fn SagaCompensation) *Saga {
+	s.compensation[typ] = fn
+	return s
+}
+
+// OnTimeout replaces default timeout reaction which fails saga with ErrSagaTimeout.
+// Handler receives zero event.
+func (s *Saga) OnTimeout(h SagaHandler) *Saga {
+	s.onTimeout = h
+	return s
+}
+
+// SagaContext is handler view of saga instance
+type SagaContext struct {
+	State SagaState
+
+	engine   *SagaEngine
+	done     bool
+	err      error
+	deadline time.Time
+}
+
+// Get decodes saga data into v
+func (sc *SagaContext) Get(v interface{}) error {
+	if len(sc.State.Data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(sc.State.Data, v)
+}
+
+// Set replaces saga data with v
+func (sc *SagaContext) Set(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	sc.State.Data = data
+	return nil
+}
+
+// Send publishes event correlated with the saga through engine sender, use cecontext.WithTopic for subject
+func (sc *SagaContext) Send(ctx context.Context, e cloudevents.Event) error {
+	e = e.Clone()
+	e.SetExtension(CorrelationIDExtension, sc.State.ID)
+	InjectDistributedTracingExtension(ctx, &e)
+
+	return sc.engine.protocol.Send(ctx, (*binding.EventMessage)(&e))
+}
+
+// Complete finishes saga successfully after handler returns
+func (sc *SagaContext) Complete() {
+	sc.done = true
+}
+
+// Fail compensates handled steps including the current one in reverse order after handler returns
+func (sc *SagaContext) Fail(err error) {
+	sc.err = err
+}
+
+// SetTimeout moves deadline of running saga
+func (sc *SagaContext) SetTimeout(d time.Duration) {
+	sc.deadline = time.Now().Add(d)
+}
+
+type sagaRoute struct {
+	saga  *Saga
+	start bool
+	h     SagaHandler
+}
+
+// SagaEngine runs registered sagas on top of Protocol: events are received by Protocol consumer,
+// commands are sent by Protocol sender and timeouts are checked by polling store.
+// Handlers may run again for the same event after failure, so side effects should be idempotent.
+type SagaEngine struct {
+	protocol *Protocol
+	store    SagaStore
+
+	interval time.Duration
+	retry    time.Duration
+	obs      *TeleObservability
+
+	mx     sync.RWMutex
+	sagas  map[string]*Saga
+	routes map[string][]sagaRoute
+}
+
+type SagaOption func(*SagaEngine)
+
+// WithSagaInterval sets pause between timeout checks
+func WithSagaInterval(d time.Duration) SagaOption {
+	return func(e *SagaEngine) {
+		if d > 0 {
+			e.interval = d
+		}
+	}
+}
+
+// WithSagaCompensationRetry sets delay before failed compensation is retried
+func WithSagaCompensationRetry(d time.Duration) SagaOption {
+	return func(e *SagaEngine) {
+		if d > 0 {
+			e.retry = d
+		}
+	}
+}
+
+// WithSagaObservability records saga events handling by TeleObservability in SagaEngine.Run
+func WithSagaObservability(t *TeleObservability) SagaOption {
+	return func(e *SagaEngine) {
+		e.obs = t
+	}
+}
+
+func NewSagaEngine(p *Protocol, store SagaStore, opts ...SagaOption) *SagaEngine {
+	e := &SagaEngine{
+		protocol: p,
+		store:    store,
+		interval: time.Second,
+		retry:    10 * time.Second,
+		sagas:    make(map[string]*Saga),
+		routes:   make(map[string][]sagaRoute),
+	}
+
+	for _, fn := range opts {
+		fn(e)
+	}
+
+	return e
+}
+
+// Register adds saga, single saga can't handle the same event type twice
+func (e *SagaEngine) Register(s *Saga) error {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	if _, ok := e.sagas[s.Name]; ok {
+		return fmt.Errorf("%w: saga %s", ErrSagaDuplicate, s.Name)
+	}
+
+	for typ := range s.start {
+		if _, ok := s.steps[typ]; ok {
+			return fmt.Errorf("%w: %s %s", ErrSagaDuplicate, s.Name, typ)
+		}
+	}
+
+	e.sagas[s.Name] = s
+
+	for typ, h := range s.start {
+		e.routes[typ] = append(e.routes[typ], sagaRoute{saga: s, start: true, h: h})
+	}
+
+	for typ, h := range s.steps {
+		e.routes[typ] = append(e.routes[typ], sagaRoute{saga: s, h: h})
+	}
+
+	return nil
+}
+
+// Run receives events from protocol and checks timeouts until ctx done
+func (e *SagaEngine) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.runTimeouts(ctx)
+	}()
+
+	h := Handler(e.Receive)
+	if e.obs != nil {
+		h = Chain(h, e.obs.Middleware())
+	}
+
+	err := e.protocol.StartReceiver(ctx, h)
+
+	cancel()
+	<-done
+
+	return err
+}
+
+// Receive implements Handler, events of unknown types or sagas are acknowledged
+func (e *SagaEngine) Receive(ctx context.Context, ev cloudevents.Event) protocol.Result {
+	e.mx.RLock()
+	routes := e.routes[ev.Type()]
+	e.mx.RUnlock()
+
+	for _, r := range routes {
+		if err := e.handle(ctx, r, ev); err != nil {
+			return err
+		}
+	}
+
+	return protocol.ResultACK
+}
+
+func (e *SagaEngine) handle(ctx context.Context, r sagaRoute, ev cloudevents.Event) error {
+	id := EventCorrelation(ev).CorrelationID
+	if id == "" && r.start {
+		id = ev.ID()
+	}
+
+	if id == "" {
+		tel.FromCtx(ctx).Warn("saga event without correlation id", zap.String("saga", r.saga.Name), zap.String("type", ev.Type()))
+		return nil
+	}
+
+	st, rev, err := e.store.Load(ctx, r.saga.Name, id)
+
+	switch {
+	case errors.Is(err, ErrSagaNotFound) && r.start:
+		st = e.begin(ctx, r.saga, id, ev)
+	case errors.Is(err, ErrSagaNotFound):
+		// finished and removed or started by another saga
+		return nil
+	case err != nil:
+		return err
+	case r.start || st.Status != SagaRunning || st.handled(ev.ID()):
+		// duplicate delivery
+		return nil
+	}
+
+	span, ctx := tel.StartSpanFromContext(ctx, "saga "+st.Name+" "+ev.Type(), stepSpanOptions(ctx, st, ev.Type(), &ev)...)
+	defer span.Finish()
+
+	ext.Component.Set(span, componentName)
+
+	sc := &SagaContext{State: st, engine: e}
+
+	if err = safeSaga(ctx, r.h, sc, ev); err != nil {
+		span.Error("saga handler", zap.Error(err))
+		return err
+	}
+
+	sc.State.Steps = append(sc.State.Steps, SagaStep{Type: ev.Type(), EventID: ev.ID(), At: time.Now()})
+
+	return e.finish(ctx, r.saga, sc, rev)
+}
+
+// begin creates state and saga root span
+func (e *SagaEngine) begin(ctx context.Context, s *Saga, id string, ev cloudevents.Event) SagaState {
+	now := time.Now()
+
+	st := SagaState{ID: id, Name: s.Name, Status: SagaRunning, CreatedAt: now, UpdatedAt: now}
+	if s.timeout > 0 {
+		st.Deadline = now.Add(s.timeout)
+	}
+
+	opts := []opentracing.StartSpanOption{opentracing.Tags{"saga.name": s.Name, "saga.id": id}}
+	if spanCtx, err := ExtractDistributedTracingExtension(ctx, &ev); err == nil {
+		opts = append(opts, opentracing.ChildOf(spanCtx))
+	}
+
+	span, ctx := tel.StartSpanFromContext(ctx, "saga "+s.Name, opts...)
+	defer span.Finish()
+
+	ext.Component.Set(span, componentName)
+
+	if trace, err := EncodeSpanContext(ctx, span.Context()); err == nil {
+		st.Trace = trace
+	}
+
+	return st
+}
+
+// stepSpanOptions makes saga step span child of saga root which follows from event trace
+func stepSpanOptions(ctx context.Context, st SagaState, step string, ev *cloudevents.Event) []opentracing.StartSpanOption {
+	opts := []opentracing.StartSpanOption{
+		opentracing.Tags{"saga.name": st.Name, "saga.id": st.ID, observability.TypeAttr: step},
+	}
+
+	if root, err := DecodeSpanContext(ctx, st.Trace); err == nil && st.Trace != "" {
+		opts = append(opts, opentracing.ChildOf(root))
+	}
+
+	if ev != nil {
+		if spanCtx, err := ExtractDistributedTracingExtension(ctx, ev); err == nil {
+			opts = append(opts, opentracing.FollowsFrom(spanCtx))
+		}
+	}
+
+	return opts
+}
+
+// finish applies handler decision and saves state
+func (e *SagaEngine) finish(ctx context.Context, s *Saga, sc *SagaContext, rev uint64) error {
+	st := &sc.State
+
+	switch {
+	case sc.err != nil:
+		st.Status, st.Error = SagaCompensating, sc.err.Error()
+		e.compensate(ctx, s, sc)
+	case sc.done:
+		st.Status, st.Deadline = SagaCompleted, time.Time{}
+	case !sc.deadline.IsZero():
+		st.Deadline = sc.deadline
+	}
+
+	st.UpdatedAt = time.Now()
+
+	_, err := e.store.Save(ctx, *st, rev)
+	return err
+}
+
+// compensate runs compensations of handled steps backwards, failed compensation is retried later
+func (e *SagaEngine) compensate(ctx context.Context, s *Saga, sc *SagaContext) {
+	st := &sc.State
+
+	for st.Compensated < len(st.Steps) {
+		step := st.Steps[len(st.Steps)-1-st.Compensated]
+
+		if fn, ok := s.compensation[step.Type]; ok {
+			if err := safeCompensation(ctx, fn, sc, step); err != nil {
+				tel.FromCtx(ctx).Warn("saga compensation", zap.Error(err),
+					zap.String("saga", s.Name), zap.String("id", st.ID), zap.String("step", step.Type))
+
+				st.Deadline = time.Now().Add(e.retry)
+				return
+			}
+		}
+
+		st.Compensated++
+	}
+
+	st.Status, st.Deadline = SagaCompensated, time.Time{}
+}
+
+func (e *SagaEngine) runTimeouts(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.CheckTimeouts(ctx); err != nil && ctx.Err() == nil {
+			tel.FromCtx(ctx).Warn("saga timeouts", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckTimeouts fails expired running sagas and retries failed compensations
+func (e *SagaEngine) CheckTimeouts(ctx context.Context) error {
+	expired, err := e.store.Expired(ctx, time.Now(), 100)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range expired {
+		if err = e.timeout(ctx, item); err != nil && !errors.Is(err, ErrSagaConflict) {
+			return fmt.Errorf("saga %s %s: %w", item.Name, item.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (e *SagaEngine) timeout(ctx context.Context, item SagaState) error {
+	e.mx.RLock()
+	s, ok := e.sagas[item.Name]
+	e.mx.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	// fresh revision for the update
+	st, rev, err := e.store.Load(ctx, item.Name, item.ID)
+	if err != nil {
+		return err
+	}
+
+	if !isExpired(st, time.Now()) {
+		return nil
+	}
+
+	span, ctx := tel.StartSpanFromContext(ctx, "saga "+st.Name+" timeout", stepSpanOptions(ctx, st, "timeout", nil)...)
+	defer span.Finish()
+
+	ext.Component.Set(span, componentName)
+
+	sc := &SagaContext{State: st, engine: e}
+
+	if st.Status == SagaCompensating {
+		e.compensate(ctx, s, sc)
+		st.UpdatedAt = time.Now()
+
+		_, err = e.store.Save(ctx, sc.State, rev)
+		return err
+	}
+
+	if s.onTimeout == nil {
+		sc.Fail(ErrSagaTimeout)
+	} else if err = safeSaga(ctx, s.onTimeout, sc, cloudevents.Event{}); err != nil {
+		span.Error("saga timeout handler", zap.Error(err))
+		return err
+	}
+
+	// handler neither finished saga nor moved deadline
+	if sc.err == nil && !sc.done && !sc.deadline.After(time.Now()) {
+		sc.Fail(ErrSagaTimeout)
+	}
+
+	return e.finish(ctx, s, sc, rev)
+}
+
+func safeSaga(ctx context.Context, h SagaHandler, sc *SagaContext, e cloudevents.Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewPanicError(r)
+		}
+	}()
+
+	return h(ctx, sc, e)
+}
+
+func safeCompensation(ctx context.Context, fn SagaCompensation, sc *SagaContext, step SagaStep) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewPanicError(r)
+		}
+	}()
+
+	return fn(ctx, sc, step)
+}
+
+// MemorySagaStore local SagaStore, states are lost on restart
+type MemorySagaStore struct {
+	mx    sync.Mutex
+	items map[string]memorySaga
+}
+
+type memorySaga struct {
+	state SagaState
+	rev   uint64
+}
+
+func NewMemorySagaStore() *MemorySagaStore {
+	return &MemorySagaStore{items: make(map[string]memorySaga)}
+}
+
+// Load implements SagaStore.Load
+func (m *MemorySagaStore) Load(_ context.Context, name, id string) (SagaState, uint64, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	item, ok := m.items[name+"\n"+id]
+	if !ok {
+		return SagaState{}, 0, ErrSagaNotFound
+	}
+
+	return item.state, item.rev, nil
+}
+
+// Save implements SagaStore.Save
+func (m *MemorySagaStore) Save(_ context.Context, st SagaState, rev uint64) (uint64, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	key := st.Name + "\n" + st.ID
+	if m.items[key].rev != rev {
+		return 0, ErrSagaConflict
+	}
+
+	m.items[key] = memorySaga{state: st, rev: rev + 1}
+
+	return rev + 1, nil
+}
+
+// Expired implements SagaStore.Expired
+func (m *MemorySagaStore) Expired(_ context.Context, now time.Time, limit int) ([]SagaState, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	res := make([]SagaState, 0)
+	for _, item := range m.items {
+		if isExpired(item.state, now) {
+			res = append(res, item.state)
+		}
+
+		if limit > 0 && len(res) == limit {
+			break
+		}
+	}
+
+	return res, nil
+}
+
+// KVSagaStore durable SagaStore inside JetStream KV bucket, use bucket TTL to clean finished sagas.
+// Expired reads the last entry of every saga, finished ones included, on each poll, so it fits moderate amount of sagas
+// and the TTL bounds the scan. Keys deleted by hand leave markers which are read until KV.PurgeDeletes.
+type KVSagaStore struct {
+	KV nats.KeyValue
+}
+
+func NewKVSagaStore(kv nats.KeyValue) *KVSagaStore {
+	return &KVSagaStore{KV: kv}
+}
+
+// Load implements SagaStore.Load
+func (k *KVSagaStore) Load(_ context.Context, name, id string) (SagaState, uint64, error) {
+	var st SagaState
+
+	entry, err := k.KV.Get(sagaKey(name, id))
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrKeyDeleted) {
+		return st, 0, ErrSagaNotFound
+	}
+
+	if err != nil {
+		return st, 0, err
+	}
+
+	if err = json.Unmarshal(entry.Value(), &st); err != nil {
+		return st, 0, fmt.Errorf("decode saga %s: %w", entry.Key(), err)
+	}
+
+	return st, entry.Revision(), nil
+}
+
+// Save implements SagaStore.Save
+func (k *KVSagaStore) Save(_ context.Context, st SagaState, rev uint64) (uint64, error) {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return 0, err
+	}
+
+	key := sagaKey(st.Name, st.ID)
+
+	var res uint64
+	if rev == 0 {
+		res, err = k.KV.Create(key, data)
+	} else {
+		res, err = k.KV.Update(key, data, rev)
+	}
+
+	if err != nil {
+		// revision check failure isn't typed by nats.go
+		if entry, gErr := k.KV.Get(key); gErr == nil && entry.Revision() != rev {
+			return 0, fmt.Errorf("%w: %s", ErrSagaConflict, err)
+		}
+
+		return 0, err
+	}
+
+	return res, nil
+}
+
+// Expired implements SagaStore.Expired
+func (k *KVSagaStore) Expired(_ context.Context, now time.Time, limit int) ([]SagaState, error) {
+	w, err := k.KV.WatchAll(nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = w.Stop() }()
+
+	res := make([]SagaState, 0)
+	for entry := range w.Updates() {
+		// initial values are done
+		if entry == nil {
+			break
+		}
+
+		var st SagaState
+		if err = json.Unmarshal(entry.Value(), &st); err != nil {
+			return nil, fmt.Errorf("decode saga %s: %w", entry.Key(), err)
+		}
+
+		if isExpired(st, now) && (limit <= 0 || len(res) < limit) {
+			res = append(res, st)
+		}
+	}
+
+	return res, nil
+}
+
+func sagaKey(name, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name)) + "." + base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func isExpired(st SagaState, now time.Time) bool {
+	if st.Status != SagaRunning && st.Status != SagaCompensating {
+		return false
+	}
+
+	return !st.Deadline.IsZero() && !st.Deadline.After(now)
+}
+
+var _ SagaStore = (*MemorySagaStore)(nil)
+var _ SagaStore = (*KVSagaStore)(nil)
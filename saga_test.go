@@ -0,0 +1,204 @@
+package protonats_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/d7561985/tel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sagaSender records types of commands sent by saga steps
+type sagaSender struct {
+	mx   sync.Mutex
+	sent []string
+}
+
+func (f *sagaSender) Send(ctx context.Context, m binding.Message, _ ...binding.Transformer) error {
+	e, err := binding.ToEvent(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.sent = append(f.sent, e.Type())
+
+	return nil
+}
+
+func (f *sagaSender) Close(context.Context) error { return nil }
+
+func (f *sagaSender) types() []string {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	return append([]string(nil), f.sent...)
+}
+
+func command(typ string) cloudevents.Event {
+	e := cloudevents.NewEvent()
+	e.SetID(typ)
+	e.SetSource("saga")
+	e.SetType(typ)
+
+	return e
+}
+
+func newOrderSaga(timeout time.Duration) *protonats.Saga {
+	return protonats.NewSaga("order", timeout).
+		StartOn("orders.created", func(ctx context.Context, sc *protonats.SagaContext, e cloudevents.Event) error {
+			return sc.Send(ctx, command("payments.charge"))
+		}).
+		On("payments.charged", func(ctx context.Context, sc *protonats.SagaContext, e cloudevents.Event) error {
+			sc.Complete()
+			return sc.Send(ctx, command("shipping.ship"))
+		}).
+		On("payments.failed", func(ctx context.Context, sc *protonats.SagaContext, e cloudevents.Event) error {
+			sc.Fail(errors.New("payment declined"))
+			return nil
+		}).
+		Compensate("orders.created", func(ctx context.Context, sc *protonats.SagaContext, _ protonats.SagaStep) error {
+			return sc.Send(ctx, command("orders.cancel"))
+		})
+}
+
+func correlated(t *testing.T, id, typ, correlation string) cloudevents.Event {
+	e := newEvent(t, typ, orderCreated{ID: id})
+	e.SetID(id)
+	e.SetExtension(protonats.CorrelationIDExtension, correlation)
+
+	return e
+}
+
+func TestSagaCompensation(t *testing.T) {
+	ctx := tel.NewNull().Ctx()
+	store := protonats.NewMemorySagaStore()
+	sender := &sagaSender{}
+
+	engine := protonats.NewSagaEngine(&protonats.Protocol{Sender: sender}, store)
+	require.NoError(t, engine.Register(newOrderSaga(time.Hour)))
+
+	start := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	start.SetID("o1")
+
+	require.True(t, protocol.IsACK(engine.Receive(ctx, start)))
+	// duplicate delivery
+	require.True(t, protocol.IsACK(engine.Receive(ctx, start)))
+	require.True(t, protocol.IsACK(engine.Receive(ctx, correlated(t, "p1", "payments.failed", "o1"))))
+
+	st, _, err := store.Load(ctx, "order", "o1")
+	require.NoError(t, err)
+	assert.Equal(t, protonats.SagaCompensated, st.Status)
+	assert.Equal(t, "payment declined", st.Error)
+	assert.Equal(t, []string{"payments.charge", "orders.cancel"}, sender.types())
+
+	// finished saga ignores late events
+	require.True(t, protocol.IsACK(engine.Receive(ctx, correlated(t, "p2", "payments.charged", "o1"))))
+	assert.Len(t, sender.types(), 2)
+}
+
+func TestSagaTimeout(t *testing.T) {
+	ctx := tel.NewNull().Ctx()
+	store := protonats.NewMemorySagaStore()
+	sender := &sagaSender{}
+
+	engine := protonats.NewSagaEngine(&protonats.Protocol{Sender: sender}, store)
+	require.NoError(t, engine.Register(newOrderSaga(time.Millisecond)))
+
+	start := newEvent(t, "orders.created", orderCreated{ID: "o2"})
+	start.SetID("o2")
+	require.True(t, protocol.IsACK(engine.Receive(ctx, start)))
+
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, engine.CheckTimeouts(ctx))
+
+	st, _, err := store.Load(ctx, "order", "o2")
+	require.NoError(t, err)
+	assert.Equal(t, protonats.SagaCompensated, st.Status)
+	assert.Equal(t, protonats.ErrSagaTimeout.Error(), st.Error)
+	assert.Equal(t, []string{"payments.charge", "orders.cancel"}, sender.types())
+}
+
+func TestKVSagaStore(t *testing.T) {
+	ctx := tel.NewNull().Ctx()
+	conn := runServer(t)
+	store := protonats.NewKVSagaStore(newKV(t, conn, "sagas"))
+
+	_, _, err := store.Load(ctx, "order", "o1")
+	assert.ErrorIs(t, err, protonats.ErrSagaNotFound)
+
+	now := time.Now()
+	st := protonats.SagaState{ID: "o1", Name: "order", Status: protonats.SagaRunning, Deadline: now.Add(-time.Second)}
+
+	rev, err := store.Save(ctx, st, 0)
+	require.NoError(t, err)
+
+	// the second start and stale revision conflict with saved state
+	_, err = store.Save(ctx, st, 0)
+	assert.ErrorIs(t, err, protonats.ErrSagaConflict)
+
+	st.Steps = []protonats.SagaStep{{Type: "orders.created", EventID: "o1"}}
+	next, err := store.Save(ctx, st, rev)
+	require.NoError(t, err)
+
+	_, err = store.Save(ctx, st, rev)
+	assert.ErrorIs(t, err, protonats.ErrSagaConflict)
+
+	loaded, loadedRev, err := store.Load(ctx, "order", "o1")
+	require.NoError(t, err)
+	assert.Equal(t, next, loadedRev)
+	assert.Equal(t, st.Steps, loaded.Steps)
+
+	// finished and not yet expired sagas are skipped
+	for id, s := range map[string]protonats.SagaState{
+		"o2": {Status: protonats.SagaCompensating, Deadline: now.Add(-time.Second)},
+		"o3": {Status: protonats.SagaRunning, Deadline: now.Add(time.Hour)},
+		"o4": {Status: protonats.SagaCompleted, Deadline: now.Add(-time.Second)},
+	} {
+		s.ID, s.Name = id, "order"
+		_, err = store.Save(ctx, s, 0)
+		require.NoError(t, err)
+	}
+
+	expired, err := store.Expired(ctx, now, 10)
+	require.NoError(t, err)
+
+	ids := make([]string, 0, len(expired))
+	for _, s := range expired {
+		ids = append(ids, s.ID)
+	}
+
+	assert.ElementsMatch(t, []string{"o1", "o2"}, ids)
+
+	expired, err = store.Expired(ctx, now, 1)
+	require.NoError(t, err)
+	assert.Len(t, expired, 1)
+
+	// engine compensates timed out saga kept in KV
+	store = protonats.NewKVSagaStore(newKV(t, conn, "orders"))
+	sender := &sagaSender{}
+	engine := protonats.NewSagaEngine(&protonats.Protocol{Sender: sender}, store)
+	require.NoError(t, engine.Register(newOrderSaga(time.Millisecond)))
+
+	start := newEvent(t, "orders.created", orderCreated{ID: "o5"})
+	start.SetID("o5")
+	require.True(t, protocol.IsACK(engine.Receive(ctx, start)))
+
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, engine.CheckTimeouts(ctx))
+
+	st, _, err = store.Load(ctx, "order", "o5")
+	require.NoError(t, err)
+	assert.Equal(t, protonats.SagaCompensated, st.Status)
+	assert.Equal(t, []string{"payments.charge", "orders.cancel"}, sender.types())
+}
@@ -0,0 +1,326 @@
+package protonats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/cloudevents/sdk-go/v2/observability"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/tel"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"go.uber.org/zap"
+)
+
+var ErrScheduleNoSubject = errors.New("scheduler: subject is not set neither by context topic nor by default")
+
+// ScheduledEvent event waiting for delivery time
+type ScheduledEvent struct {
+	ID        string    `json:"id"`
+	Subject   string    `json:"subject"`
+	DeliverAt time.Time `json:"deliver_at"`
+	// Data is structured JSON event
+	Data []byte `json:"data"`
+}
+
+// ScheduleStore keeps scheduled events until they are due
+type ScheduleStore interface {
+	Save(ctx context.Context, s ScheduledEvent) error
+	// Due returns up to limit events which delivery time is before now, earliest first
+	Due(ctx context.Context, now time.Time, limit int) ([]ScheduledEvent, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// Scheduler delays events delivery: SendAt/SendAfter put event into store and Run publishes it when due.
+// Durability across restarts depends on store, see KVScheduleStore.
+type Scheduler struct {
+	store  ScheduleStore
+	sender protocol.Sender
+
+	// subject is used when context has no topic, see cecontext.WithTopic
+	subject string
+
+	interval time.Duration
+	batch    int
+}
+
+type SchedulerOption func(*Scheduler)
+
+// WithSchedulerInterval sets pause between store polls, it is also delivery precision
+func WithSchedulerInterval(d time.Duration) SchedulerOption {
+	return func(s *Scheduler) {
+		if d > 0 {
+			s.interval = d
+		}
+	}
+}
+
+// WithSchedulerBatchSize sets max events delivered per poll
+func WithSchedulerBatchSize(n int) SchedulerOption {
+	return func(s *Scheduler) {
+		if n > 0 {
+			s.batch = n
+		}
+	}
+}
+
+func NewScheduler(store ScheduleStore, sender protocol.Sender, subject string, opts ...SchedulerOption) *Scheduler {
+	s := &Scheduler{
+		store:    store,
+		sender:   sender,
+		subject:  subject,
+		interval: time.Second,
+		batch:    100,
+	}
+
+	for _, fn := range opts {
+		fn(s)
+	}
+
+	return s
+}
+
+// SendAfter schedules event delivery after d
+func (s *Scheduler) SendAfter(ctx context.Context, e cloudevents.Event, d time.Duration) (string, error) {
+	return s.SendAt(ctx, e, time.Now().Add(d))
+}
+
+// SendAt schedules event delivery at time and returns schedule id.
+// Trace of the schedule call is carried within event, so delivery span follows from it.
+func (s *Scheduler) SendAt(ctx context.Context, e cloudevents.Event, at time.Time) (string, error) {
+	if err := e.Validate(); err != nil {
+		return "", err
+	}
+
+	subject := s.subject
+	if topic := cecontext.TopicFrom(ctx); topic != "" {
+		subject = topic
+	}
+
+	if subject == "" {
+		return "", ErrScheduleNoSubject
+	}
+
+	span, ctx := tel.StartSpanFromContext(ctx, observability.ClientSpanName+"."+e.Type()+" schedule",
+		opentracing.Tags{observability.IdAttr: e.ID(), "deliver_at": at.Format(time.RFC3339)})
+	defer span.Finish()
+
+	ext.Component.Set(span, componentName)
+	ext.SpanKindProducer.Set(span)
+
+	e = e.Clone()
+	InjectDistributedTracingExtension(ctx, &e)
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("schedule encode event: %w", err)
+	}
+
+	id := uuid.New().String()
+
+	if err = s.store.Save(ctx, ScheduledEvent{ID: id, Subject: subject, DeliverAt: at, Data: data}); err != nil {
+		span.Error("schedule save", zap.Error(err))
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Run delivers due events until ctx done
+func (s *Scheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.Deliver(ctx); err != nil && ctx.Err() == nil {
+			tel.FromCtx(ctx).Warn("scheduler deliver", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Deliver publishes single batch of due events and returns number of delivered ones
+func (s *Scheduler) Deliver(ctx context.Context) (int, error) {
+	due, err := s.store.Due(ctx, time.Now(), s.batch)
+	if err != nil {
+		return 0, fmt.Errorf("scheduler due: %w", err)
+	}
+
+	for i, item := range due {
+		if err = s.deliver(ctx, item); err != nil {
+			return i, fmt.Errorf("scheduler deliver %s: %w", item.ID, err)
+		}
+
+		if err = s.store.Delete(ctx, item.ID); err != nil {
+			// event would be delivered again, JetStream drops it by Nats-Msg-Id
+			return i, fmt.Errorf("scheduler delete %s: %w", item.ID, err)
+		}
+	}
+
+	return len(due), nil
+}
+
+func (s *Scheduler) deliver(ctx context.Context, item ScheduledEvent) error {
+	e := cloudevents.NewEvent()
+	if err := json.Unmarshal(item.Data, &e); err != nil {
+		return fmt.Errorf("decode event: %w", err)
+	}
+
+	opts := []opentracing.StartSpanOption{
+		opentracing.Tags{observability.IdAttr: e.ID(), "delay": time.Since(item.DeliverAt).String()},
+	}
+
+	if spanCtx, err := ExtractDistributedTracingExtension(ctx, &e); err == nil {
+		opts = append(opts, opentracing.FollowsFrom(spanCtx))
+	}
+
+	span, ctx := tel.StartSpanFromContext(ctx, observability.ClientSpanName+"."+e.Type()+" deliver", opts...)
+	defer span.Finish()
+
+	ext.Component.Set(span, componentName)
+	ext.SpanKindProducer.Set(span)
+
+	// consumer continues delivery span
+	InjectDistributedTracingExtension(ctx, &e)
+
+	ctx = WithMsgID(cecontext.WithTopic(ctx, item.Subject), item.ID)
+
+	if err := s.sender.Send(ctx, (*binding.EventMessage)(&e)); err != nil {
+		span.Error("scheduled send", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// MemoryScheduleStore local ScheduleStore, scheduled events are lost on restart
+type MemoryScheduleStore struct {
+	mx    sync.Mutex
+	items map[string]ScheduledEvent
+}
+
+func NewMemoryScheduleStore() *MemoryScheduleStore {
+	return &MemoryScheduleStore{items: make(map[string]ScheduledEvent)}
+}
+
+// Save implements ScheduleStore.Save
+func (m *MemoryScheduleStore) Save(_ context.Context, s ScheduledEvent) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.items[s.ID] = s
+
+	return nil
+}
+
+// Due implements ScheduleStore.Due
+func (m *MemoryScheduleStore) Due(_ context.Context, now time.Time, limit int) ([]ScheduledEvent, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	res := make([]ScheduledEvent, 0)
+	for _, item := range m.items {
+		if !item.DeliverAt.After(now) {
+			res = append(res, item)
+		}
+	}
+
+	return earliest(res, limit), nil
+}
+
+// Delete implements ScheduleStore.Delete
+func (m *MemoryScheduleStore) Delete(_ context.Context, id string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	delete(m.items, id)
+
+	return nil
+}
+
+// KVScheduleStore durable ScheduleStore inside JetStream KV bucket.
+// Due reads the last entry of every key on each poll, so it fits moderate amount of pending events.
+// Delete leaves purge marker per delivered event which Due keeps reading until KV.PurgeDeletes removes it,
+// call it periodically: schedule ids aren't reused, so it never drops pending events.
+type KVScheduleStore struct {
+	KV nats.KeyValue
+}
+
+func NewKVScheduleStore(kv nats.KeyValue) *KVScheduleStore {
+	return &KVScheduleStore{KV: kv}
+}
+
+// Save implements ScheduleStore.Save
+func (k *KVScheduleStore) Save(_ context.Context, s ScheduledEvent) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	_, err = k.KV.Put(s.ID, data)
+	return err
+}
+
+// Due implements ScheduleStore.Due
+func (k *KVScheduleStore) Due(_ context.Context, now time.Time, limit int) ([]ScheduledEvent, error) {
+	w, err := k.KV.WatchAll(nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = w.Stop() }()
+
+	res := make([]ScheduledEvent, 0)
+	for entry := range w.Updates() {
+		// initial values are done
+		if entry == nil {
+			break
+		}
+
+		var item ScheduledEvent
+		if err = json.Unmarshal(entry.Value(), &item); err != nil {
+			return nil, fmt.Errorf("decode scheduled %s: %w", entry.Key(), err)
+		}
+
+		if !item.DeliverAt.After(now) {
+			res = append(res, item)
+		}
+	}
+
+	return earliest(res, limit), nil
+}
+
+// Delete implements ScheduleStore.Delete
+func (k *KVScheduleStore) Delete(_ context.Context, id string) error {
+	return k.KV.Purge(id)
+}
+
+func earliest(items []ScheduledEvent, limit int) []ScheduledEvent {
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeliverAt.Before(items[j].DeliverAt)
+	})
+
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+
+	return items
+}
+
+var _ ScheduleStore = (*MemoryScheduleStore)(nil)
+var _ ScheduleStore = (*KVScheduleStore)(nil)
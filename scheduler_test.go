@@ -0,0 +1,132 @@
+package protonats_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/d7561985/protonats"
+	"github.com/d7561985/tel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sent struct {
+	subject string
+	msgID   string
+	id      string
+}
+
+// fakeSender records sent messages instead of publishing
+type fakeSender struct {
+	mx   sync.Mutex
+	sent []sent
+}
+
+func (f *fakeSender) Send(ctx context.Context, m binding.Message, _ ...binding.Transformer) error {
+	e, err := binding.ToEvent(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.sent = append(f.sent, sent{subject: cecontext.TopicFrom(ctx), msgID: protonats.MsgIDFrom(ctx), id: e.ID()})
+
+	return nil
+}
+
+func TestScheduler(t *testing.T) {
+	tl := tel.NewNull()
+	ctx := tl.Ctx()
+
+	store := protonats.NewMemoryScheduleStore()
+	sender := &fakeSender{}
+	s := protonats.NewScheduler(store, sender, "orders")
+
+	id, err := s.SendAfter(ctx, newEvent(t, "orders.late", orderCreated{ID: "late"}), time.Hour)
+	require.NoError(t, err)
+	require.NotEmpty(t, id)
+
+	dueID, err := s.SendAt(cecontext.WithTopic(ctx, "payments"), newEvent(t, "orders.now", orderCreated{ID: "now"}), time.Now())
+	require.NoError(t, err)
+
+	n, err := s.Deliver(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	require.Len(t, sender.sent, 1)
+	assert.Equal(t, sent{subject: "payments", msgID: dueID, id: "1"}, sender.sent[0])
+
+	// delivered event is removed from store
+	n, err = s.Deliver(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestKVScheduleStore(t *testing.T) {
+	ctx := context.Background()
+	kv := newKV(t, runServer(t), "schedule")
+	store := protonats.NewKVScheduleStore(kv)
+
+	due, err := store.Due(ctx, time.Now(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+
+	data, err := json.Marshal(newEvent(t, "orders.created", orderCreated{ID: "o1"}))
+	require.NoError(t, err)
+
+	now := time.Now()
+	for id, at := range map[string]time.Time{"late": now.Add(time.Hour), "first": now.Add(-2 * time.Minute), "second": now.Add(-time.Minute)} {
+		require.NoError(t, store.Save(ctx, protonats.ScheduledEvent{ID: id, Subject: "orders", DeliverAt: at, Data: data}))
+	}
+
+	ids := func(items []protonats.ScheduledEvent) []string {
+		res := make([]string, 0, len(items))
+		for _, item := range items {
+			res = append(res, item.ID)
+		}
+
+		return res
+	}
+
+	// earliest due events first, not yet due is skipped
+	due, err = store.Due(ctx, now, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, ids(due))
+	assert.Equal(t, "orders", due[0].Subject)
+
+	due, err = store.Due(ctx, now, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first"}, ids(due))
+
+	// purge markers of deleted events aren't due, neither before nor after PurgeDeletes
+	require.NoError(t, store.Delete(ctx, "first"))
+
+	due, err = store.Due(ctx, now, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"second"}, ids(due))
+
+	require.NoError(t, kv.PurgeDeletes())
+
+	due, err = store.Due(ctx, now.Add(2*time.Hour), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"second", "late"}, ids(due))
+
+	// scheduler delivers from KV store and deletes delivered events
+	sender := &fakeSender{}
+	s := protonats.NewScheduler(store, sender, "orders")
+
+	n, err := s.Deliver(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	due, err = store.Due(ctx, now.Add(2*time.Hour), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"late"}, ids(due))
+}
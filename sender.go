@@ -14,30 +14,90 @@ import (
 
 type Sender struct {
 	*cn.Sender
+
+	middlewares []SendMiddleware
+	handler     SendHandler
+	spool       *Spool
+	js          nats.JetStreamContext
 }
 
+type SenderOption func(*Sender) error
+
 // NewSender creates a new protocol.Sender responsible for opening and closing the STAN connection
 func NewSender(url, subject string, natsOpts []nats.Option, opts ...cn.SenderOption) (protocol.SendCloser, error) {
-	s, err := cn.NewSender(url, subject, natsOpts, opts...)
+	return NewSenderWithOptions(url, subject, natsOpts, WithNatsSenderOptions(opts...))
+}
+
+// NewSenderFromConn creates a new protocol.Sender which leaves responsibility for opening and closing the STAN
+// connection to the caller
+func NewSenderFromConn(conn *nats.Conn, subject string, opts ...cn.SenderOption) (*Sender, error) {
+	return NewSenderFromConnWithOptions(conn, subject, WithNatsSenderOptions(opts...))
+}
+
+// NewSenderWithOptions same as NewSender configured by protonats options, e.g. WithSendMiddleware
+func NewSenderWithOptions(url, subject string, natsOpts []nats.Option, opts ...SenderOption) (protocol.SendCloser, error) {
+	s, err := cn.NewSender(url, subject, natsOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := newSender(s, opts...)
 	if err != nil {
+		_ = s.Close(context.Background())
 		return nil, err
 	}
 
-	return &Sender{Sender: s}, nil
+	return res, nil
 }
 
-// NewSenderFromConn creates a new protocol.Sender which leaves responsibility for opening and closing the STAN
-// connection to the caller
-func NewSenderFromConn(conn *nats.Conn, subject string, opts ...cn.SenderOption) (*Sender, error) {
-	s, err := cn.NewSenderFromConn(conn, subject, opts...)
+// NewSenderFromConnWithOptions same as NewSenderFromConn configured by protonats options, e.g. WithSendMiddleware
+func NewSenderFromConnWithOptions(conn *nats.Conn, subject string, opts ...SenderOption) (*Sender, error) {
+	s, err := cn.NewSenderFromConn(conn, subject)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Sender{Sender: s}, nil
+	return newSender(s, opts...)
 }
 
-func (s *Sender) Send(ctx context.Context, in binding.Message, transformers ...binding.Transformer) (err error) {
+func newSender(s *cn.Sender, opts ...SenderOption) (*Sender, error) {
+	res := &Sender{Sender: s}
+
+	if err := res.applyOptions(opts...); err != nil {
+		return nil, err
+	}
+
+	publish := res.publish
+	if res.spool != nil {
+		publish = res.spooled
+	}
+
+	res.middlewares = append([]SendMiddleware{correlate()}, res.middlewares...)
+	res.handler = ChainSend(publish, res.middlewares...)
+
+	return res, nil
+}
+
+// Send implements Sender.Send passing message through send middlewares
+func (s *Sender) Send(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+	return s.handler(ctx, in, transformers...)
+}
+
+// Close closes spool and the connection when it is owned by sender
+func (s *Sender) Close(ctx context.Context) error {
+	var err error
+	if s.spool != nil {
+		err = s.spool.Close()
+	}
+
+	if cErr := s.Sender.Close(ctx); cErr != nil {
+		return cErr
+	}
+
+	return err
+}
+
+func (s *Sender) publish(ctx context.Context, in binding.Message, transformers ...binding.Transformer) (err error) {
 	defer func() {
 		if err2 := in.Finish(err); err2 != nil {
 			if err == nil {
@@ -48,19 +108,75 @@ func (s *Sender) Send(ctx context.Context, in binding.Message, transformers ...b
 		}
 	}()
 
-	writer := new(bytes.Buffer)
-	if err = cn.WriteMsg(ctx, in, writer, transformers...); err != nil {
+	msg, err := s.natsMsg(ctx, in, transformers...)
+	if err != nil {
 		return err
 	}
 
+	if s.js != nil {
+		return s.publishAck(ctx, msg)
+	}
+
+	return s.Conn.PublishMsg(msg)
+}
+
+// publishAck waits for PubAck within ctx deadline, JetStream context wait time without it
+func (s *Sender) publishAck(ctx context.Context, msg *nats.Msg) error {
+	var opts []nats.PubOpt
+	if _, ok := ctx.Deadline(); ok {
+		opts = append(opts, nats.Context(ctx))
+	}
+
+	_, err := s.js.PublishMsg(msg, opts...)
+	return err
+}
+
+// natsMsg encodes message for subject from context topic or the default one
+func (s *Sender) natsMsg(ctx context.Context, in binding.Message, transformers ...binding.Transformer) (*nats.Msg, error) {
+	writer := new(bytes.Buffer)
+	if err := cn.WriteMsg(ctx, in, writer, transformers...); err != nil {
+		return nil, err
+	}
+
 	// allow get topic
 	subject := s.Subject
 	if topic := cecontext.TopicFrom(ctx); topic != "" {
 		subject = topic
 	}
 
-	return s.Conn.PublishMsg(&nats.Msg{
+	msg := &nats.Msg{
 		Subject: subject,
 		Data:    writer.Bytes(),
-	})
+	}
+
+	// JetStream de-duplication
+	if id := MsgIDFrom(ctx); id != "" {
+		msg.Header = nats.Header{nats.MsgIdHdr: []string{id}}
+	}
+
+	return msg, nil
+}
+
+type msgIDKey struct{}
+
+// WithMsgID puts JetStream Nats-Msg-Id header value into context, Sender uses it for publish
+func WithMsgID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, msgIDKey{}, id)
 }
+
+// MsgIDFrom returns Nats-Msg-Id value put by WithMsgID
+func MsgIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(msgIDKey{}).(string)
+	return id
+}
+
+func (s *Sender) applyOptions(opts ...SenderOption) error {
+	for _, fn := range opts {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ protocol.SendCloser = (*Sender)(nil)
@@ -0,0 +1,774 @@
+package protonats
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/d7561985/tel"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrSpoolFull   = errors.New("spool: size limit exceeded")
+	ErrSpoolClosed = errors.New("spool: closed")
+
+	// errSpoolChecksum record fits into segment but its payload is corrupted
+	errSpoolChecksum = errors.New("checksum mismatch")
+	// errSpoolLength record length header is corrupted, the rest of segment can't be read
+	errSpoolLength = errors.New("record length out of segment")
+)
+
+const (
+	spoolSegmentExt = ".seg"
+	spoolCursorFile = "cursor"
+
+	// record header: payload length and crc32 of payload
+	spoolHeaderSize = 8
+	// spoolMaxRecord payload limit, NATS max_payload can't exceed it either
+	spoolMaxRecord = 64 << 20
+)
+
+// SpoolFsync defines when spool appends are flushed to disk
+type SpoolFsync int
+
+const (
+	// SpoolFsyncInterval syncs on append if the previous sync is older than sync interval
+	SpoolFsyncInterval SpoolFsync = iota
+	// SpoolFsyncAlways syncs every append
+	SpoolFsyncAlways
+	// SpoolFsyncNever leaves flush to OS
+	SpoolFsyncNever
+)
+
+// SpoolOverflow defines what happens with new event when spool reached its size limit
+type SpoolOverflow int
+
+const (
+	// SpoolOverflowReject fails Send with ErrSpoolFull
+	SpoolOverflowReject SpoolOverflow = iota
+	// SpoolOverflowDropOldest drops the oldest segments to free space
+	SpoolOverflowDropOldest
+)
+
+// SpoolRecord event waiting for NATS connection
+type SpoolRecord struct {
+	Subject string `json:"subject"`
+	MsgID   string `json:"msg_id,omitempty"`
+	// Data is structured JSON event
+	Data []byte `json:"data"`
+}
+
+type spoolSegment struct {
+	id     uint64
+	size   int64
+	events int
+}
+
+// Spool append-only on-disk queue split into segments.
+// Records are read in append order, segment file is removed when all its records are drained.
+// Read position is kept in cursor file, so after crash records may be drained once more.
+// Corrupted records are skipped and counted as dropped, torn tail of the last segment is truncated on open.
+type Spool struct {
+	dir string
+
+	name        string
+	segmentSize int64
+	maxBytes    int64
+	fsync       SpoolFsync
+	syncEvery   time.Duration
+	overflow    SpoolOverflow
+	interval    time.Duration
+
+	metrics SpoolMetrics
+
+	mx       sync.Mutex
+	closed   bool
+	segments []spoolSegment
+	w        *os.File
+	r        *os.File
+	readOff  int64
+	cursor   *os.File
+	lastSync time.Time
+}
+
+type SpoolOption func(*Spool)
+
+// WithSpoolName sets name used as metrics label, spool dir base name by default
+func WithSpoolName(name string) SpoolOption {
+	return func(s *Spool) {
+		s.name = name
+	}
+}
+
+// WithSpoolSegmentSize sets size in bytes after which new segment file is started
+func WithSpoolSegmentSize(n int64) SpoolOption {
+	return func(s *Spool) {
+		if n > 0 {
+			s.segmentSize = n
+		}
+	}
+}
+
+// WithSpoolMaxBytes limits total size of not drained records, zero means unlimited
+func WithSpoolMaxBytes(n int64, policy SpoolOverflow) SpoolOption {
+	return func(s *Spool) {
+		s.maxBytes = n
+		s.overflow = policy
+	}
+}
+
+// WithSpoolFsync sets fsync policy, d is used only by SpoolFsyncInterval
+func WithSpoolFsync(policy SpoolFsync, d time.Duration) SpoolOption {
+	return func(s *Spool) {
+		s.fsync = policy
+		if d > 0 {
+			s.syncEvery = d
+		}
+	}
+}
+
+// WithSpoolDrainInterval sets pause between connection checks of Sender.RunSpool
+func WithSpoolDrainInterval(d time.Duration) SpoolOption {
+	return func(s *Spool) {
+		if d > 0 {
+			s.interval = d
+		}
+	}
+}
+
+// WithSpoolMetrics exports spool depth and dropped events into m
+func WithSpoolMetrics(m SpoolMetrics) SpoolOption {
+	return func(s *Spool) {
+		if m != nil {
+			s.metrics = m
+		}
+	}
+}
+
+// OpenSpool opens or creates spool inside dir and restores not drained records
+func OpenSpool(dir string, opts ...SpoolOption) (*Spool, error) {
+	s := &Spool{
+		dir:         dir,
+		name:        filepath.Base(dir),
+		segmentSize: 64 << 20,
+		fsync:       SpoolFsyncInterval,
+		syncEvery:   time.Second,
+		interval:    time.Second,
+		metrics:     nullMetrics{},
+	}
+
+	for _, fn := range opts {
+		fn(s)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	if err := s.restore(); err != nil {
+		s.closeFiles()
+		return nil, fmt.Errorf("spool restore: %w", err)
+	}
+
+	s.report()
+
+	return s, nil
+}
+
+// Len returns number of not drained records
+func (s *Spool) Len() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.events()
+}
+
+// Size returns bytes of not drained records
+func (s *Spool) Size() int64 {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.bytes()
+}
+
+// Append writes record at the end of spool according to size limit and fsync policy
+func (s *Spool) Append(r SpoolRecord) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if len(payload) > spoolMaxRecord {
+		s.metrics.AddSpoolDropped(s.name, 1)
+		return fmt.Errorf("spool record of %d bytes: %w", len(payload), ErrSpoolFull)
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.closed {
+		return ErrSpoolClosed
+	}
+
+	size := int64(spoolHeaderSize + len(payload))
+
+	if s.maxBytes > 0 && s.bytes()+size > s.maxBytes {
+		if s.overflow == SpoolOverflowReject || size > s.maxBytes {
+			s.metrics.AddSpoolDropped(s.name, 1)
+			return ErrSpoolFull
+		}
+
+		if err = s.dropOldest(s.bytes() + size - s.maxBytes); err != nil {
+			return err
+		}
+	}
+
+	if s.current().size >= s.segmentSize {
+		if err = s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[spoolHeaderSize:], payload)
+
+	if _, err = s.w.Write(buf); err != nil {
+		return err
+	}
+
+	seg := s.current()
+	seg.size += size
+	seg.events++
+
+	if s.fsync == SpoolFsyncAlways || s.fsync == SpoolFsyncInterval && time.Since(s.lastSync) >= s.syncEvery {
+		if err = s.w.Sync(); err != nil {
+			return err
+		}
+
+		s.lastSync = time.Now()
+	}
+
+	s.report()
+
+	return nil
+}
+
+// Drain passes records to fn in append order until spool is empty or fn fails.
+// Record is removed from spool only after fn success.
+func (s *Spool) Drain(ctx context.Context, fn func(context.Context, SpoolRecord) error) (int, error) {
+	var n int
+
+	for ctx.Err() == nil {
+		s.mx.Lock()
+		rec, seg, next, err := s.peek()
+		s.mx.Unlock()
+
+		if err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+
+			return n, err
+		}
+
+		if err = fn(ctx, rec); err != nil {
+			return n, err
+		}
+
+		s.mx.Lock()
+		err = s.advance(seg, next)
+		s.mx.Unlock()
+
+		if err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, ctx.Err()
+}
+
+// Close syncs and closes spool files
+func (s *Spool) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+
+	var err error
+	if s.w != nil {
+		err = s.w.Sync()
+	}
+
+	s.closeFiles()
+
+	return err
+}
+
+// peek reads the next not drained record, it returns io.EOF when spool is empty
+func (s *Spool) peek() (SpoolRecord, uint64, int64, error) {
+	var rec SpoolRecord
+
+	if s.closed {
+		return rec, 0, 0, ErrSpoolClosed
+	}
+
+	// skip drained segments
+	for s.segments[0].events == 0 {
+		if len(s.segments) == 1 {
+			return rec, 0, 0, io.EOF
+		}
+
+		if err := s.removeHead(); err != nil {
+			return rec, 0, 0, err
+		}
+	}
+
+	seg := s.segments[0].id
+
+	payload, err := readSpoolRecord(s.r, s.readOff)
+	switch {
+	case errors.Is(err, errSpoolChecksum):
+		// corrupted record isn't counted in segment events, see scan
+		s.readOff += int64(spoolHeaderSize + len(payload))
+		return s.peek()
+	case err != nil:
+		// rest of the segment can't be read
+		if err = s.dropHead(); err != nil {
+			return rec, 0, 0, fmt.Errorf("spool read segment %d at %d: %w", seg, s.readOff, err)
+		}
+
+		return s.peek()
+	}
+
+	next := s.readOff + int64(spoolHeaderSize+len(payload))
+
+	if err = json.Unmarshal(payload, &rec); err != nil {
+		s.metrics.AddSpoolDropped(s.name, 1)
+
+		if err = s.advance(seg, next); err != nil {
+			return rec, 0, 0, err
+		}
+
+		return s.peek()
+	}
+
+	return rec, seg, next, nil
+}
+
+// dropHead drops not drained records of the first segment, the last segment is rotated first
+func (s *Spool) dropHead() error {
+	if len(s.segments) == 1 {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	s.metrics.AddSpoolDropped(s.name, s.segments[0].events)
+	s.segments[0].events = 0
+
+	return s.removeHead()
+}
+
+// advance moves read position after drained record unless its segment was dropped meanwhile
+func (s *Spool) advance(seg uint64, next int64) error {
+	if s.closed || s.segments[0].id != seg {
+		return nil
+	}
+
+	s.segments[0].events--
+	s.readOff = next
+
+	s.report()
+
+	return s.saveCursor()
+}
+
+func (s *Spool) current() *spoolSegment {
+	return &s.segments[len(s.segments)-1]
+}
+
+func (s *Spool) events() int {
+	var n int
+	for _, seg := range s.segments {
+		n += seg.events
+	}
+
+	return n
+}
+
+func (s *Spool) bytes() int64 {
+	var n int64
+	for _, seg := range s.segments {
+		n += seg.size
+	}
+
+	return n - s.readOff
+}
+
+func (s *Spool) rotate() error {
+	id := s.current().id + 1
+
+	w, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if s.fsync != SpoolFsyncNever {
+		_ = s.w.Sync()
+	}
+
+	_ = s.w.Close()
+	s.w = w
+	s.segments = append(s.segments, spoolSegment{id: id})
+
+	return nil
+}
+
+// dropOldest removes head segments until at least n bytes are freed
+func (s *Spool) dropOldest(n int64) error {
+	var dropped int
+
+	for n > 0 && s.events() > 0 {
+		if len(s.segments) == 1 {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+
+		n -= s.segments[0].size - s.readOff
+		dropped += s.segments[0].events
+
+		if err := s.removeHead(); err != nil {
+			return err
+		}
+	}
+
+	s.metrics.AddSpoolDropped(s.name, dropped)
+
+	return nil
+}
+
+// removeHead deletes the first segment and moves read position to the next one
+func (s *Spool) removeHead() error {
+	r, err := os.Open(s.segmentPath(s.segments[1].id))
+	if err != nil {
+		return err
+	}
+
+	_ = s.r.Close()
+
+	if err = os.Remove(s.segmentPath(s.segments[0].id)); err != nil {
+		_ = r.Close()
+		return err
+	}
+
+	s.r = r
+	s.readOff = 0
+	s.segments = s.segments[1:]
+
+	return s.saveCursor()
+}
+
+func (s *Spool) saveCursor() error {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[0:8], s.segments[0].id)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(s.readOff))
+
+	_, err := s.cursor.WriteAt(buf, 0)
+	return err
+}
+
+func (s *Spool) restore() error {
+	ids, err := s.segmentIDs()
+	if err != nil {
+		return err
+	}
+
+	if s.cursor, err = os.OpenFile(filepath.Join(s.dir, spoolCursorFile), os.O_CREATE|os.O_RDWR, 0o644); err != nil {
+		return err
+	}
+
+	var (
+		buf     = make([]byte, 16)
+		readSeg uint64
+	)
+
+	if _, err = s.cursor.ReadAt(buf, 0); err == nil {
+		readSeg = binary.BigEndian.Uint64(buf[0:8])
+		s.readOff = int64(binary.BigEndian.Uint64(buf[8:16]))
+	}
+
+	for i, id := range ids {
+		// drained before crash
+		if id < readSeg {
+			if err = os.Remove(s.segmentPath(id)); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		seg, err := s.scan(id, id == readSeg, i == len(ids)-1)
+		if err != nil {
+			return err
+		}
+
+		s.segments = append(s.segments, seg)
+	}
+
+	if len(s.segments) == 0 || s.segments[0].id != readSeg {
+		s.readOff = 0
+	}
+
+	if len(s.segments) == 0 {
+		s.segments = append(s.segments, spoolSegment{id: 1})
+	}
+
+	if s.w, err = os.OpenFile(s.segmentPath(s.current().id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return err
+	}
+
+	if s.r, err = os.Open(s.segmentPath(s.segments[0].id)); err != nil {
+		return err
+	}
+
+	return s.saveCursor()
+}
+
+// scan counts not drained records of the segment. Corrupted records are skipped and counted as dropped,
+// torn record at the end of the last segment is truncated, so appends continue after the last valid record.
+func (s *Spool) scan(id uint64, head, last bool) (spoolSegment, error) {
+	seg := spoolSegment{id: id}
+
+	f, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0o644)
+	if err != nil {
+		return seg, err
+	}
+
+	defer f.Close()
+
+	var (
+		off     int64
+		corrupt int
+	)
+
+	for {
+		payload, err := readSpoolRecord(f, off)
+		if err != nil && !errors.Is(err, errSpoolChecksum) {
+			break
+		}
+
+		notDrained := !head || off >= s.readOff
+
+		switch {
+		case err != nil && notDrained:
+			corrupt++
+		case notDrained:
+			seg.events++
+		}
+
+		off += int64(spoolHeaderSize + len(payload))
+	}
+
+	if last {
+		if err = f.Truncate(off); err != nil {
+			return seg, err
+		}
+	} else if info, err := f.Stat(); err != nil {
+		return seg, err
+	} else if info.Size() > off {
+		// unreadable rest of sealed segment
+		corrupt++
+		off = info.Size()
+	}
+
+	if corrupt > 0 {
+		s.metrics.AddSpoolDropped(s.name, corrupt)
+	}
+
+	seg.size = off
+
+	return seg, nil
+}
+
+func (s *Spool) segmentIDs() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), spoolSegmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), spoolSegmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x%s", id, spoolSegmentExt))
+}
+
+func (s *Spool) report() {
+	s.metrics.SetSpoolDepth(s.name, s.events(), s.bytes())
+}
+
+func (s *Spool) closeFiles() {
+	for _, f := range []*os.File{s.w, s.r, s.cursor} {
+		if f != nil {
+			_ = f.Close()
+		}
+	}
+}
+
+// readSpoolRecord reads record at off, length header isn't trusted before it's checked against segment size
+func readSpoolRecord(f *os.File, off int64) ([]byte, error) {
+	header := make([]byte, spoolHeaderSize)
+	if _, err := f.ReadAt(header, off); err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > spoolMaxRecord || length > info.Size()-off-spoolHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes at %d", errSpoolLength, length, off)
+	}
+
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, off+spoolHeaderSize); err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return payload, errSpoolChecksum
+	}
+
+	return payload, nil
+}
+
+// spooled publishes directly while connected and spool is empty, otherwise event is queued into spool
+func (s *Sender) spooled(ctx context.Context, in binding.Message, transformers ...binding.Transformer) (err error) {
+	e, err := binding.ToEvent(ctx, in, transformers...)
+	if err != nil {
+		_ = in.Finish(err)
+		return err
+	}
+
+	defer func() { _ = in.Finish(err) }()
+
+	if s.spool.Len() == 0 && s.Conn.IsConnected() {
+		err = s.publish(ctx, (*binding.EventMessage)(e))
+		if err == nil || !isConnectionError(err) {
+			return err
+		}
+	}
+
+	subject := s.Subject
+	if topic := cecontext.TopicFrom(ctx); topic != "" {
+		subject = topic
+	}
+
+	// spool may be drained more than once, JetStream drops duplicates by Nats-Msg-Id
+	msgID := MsgIDFrom(ctx)
+	if msgID == "" {
+		msgID = e.Source() + "/" + e.ID()
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("spool encode event: %w", err)
+	}
+
+	return s.spool.Append(SpoolRecord{Subject: subject, MsgID: msgID, Data: data})
+}
+
+// RunSpool drains spool whenever connection is up until ctx done
+func (s *Sender) RunSpool(ctx context.Context) error {
+	if s.spool == nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(s.spool.interval)
+	defer ticker.Stop()
+
+	for {
+		if s.Conn.IsConnected() {
+			if _, err := s.spool.Drain(ctx, s.publishSpooled); err != nil && ctx.Err() == nil {
+				tel.FromCtx(ctx).Warn("spool drain", zap.Error(err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Sender) publishSpooled(ctx context.Context, rec SpoolRecord) error {
+	e := cloudevents.NewEvent()
+	if err := json.Unmarshal(rec.Data, &e); err != nil {
+		return fmt.Errorf("decode event: %w", err)
+	}
+
+	ctx = WithMsgID(cecontext.WithTopic(ctx, rec.Subject), rec.MsgID)
+
+	return s.publish(ctx, (*binding.EventMessage)(&e))
+}
+
+func isConnectionError(err error) bool {
+	for _, target := range []error{
+		nats.ErrConnectionClosed,
+		nats.ErrConnectionDraining,
+		nats.ErrConnectionReconnecting,
+		nats.ErrReconnectBufExceeded,
+		nats.ErrNoServers,
+		nats.ErrDisconnected,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,273 @@
+package protonats_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/d7561985/protonats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolRestoreOrder(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	sp, err := protonats.OpenSpool(dir, protonats.WithSpoolSegmentSize(128))
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sp.Append(protonats.SpoolRecord{Subject: "orders", MsgID: fmt.Sprint(i), Data: []byte(`{}`)}))
+	}
+
+	// drain is interrupted by publish failure
+	n, err := sp.Drain(ctx, func(_ context.Context, r protonats.SpoolRecord) error {
+		if r.MsgID == "4" {
+			return errors.New("nats: connection closed")
+		}
+		return nil
+	})
+	require.Error(t, err)
+	assert.Equal(t, 4, n)
+	require.NoError(t, sp.Close())
+
+	sp, err = protonats.OpenSpool(dir, protonats.WithSpoolSegmentSize(128))
+	require.NoError(t, err)
+	defer sp.Close()
+
+	assert.Equal(t, 6, sp.Len())
+
+	var ids []string
+	_, err = sp.Drain(ctx, func(_ context.Context, r protonats.SpoolRecord) error {
+		ids = append(ids, r.MsgID)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"4", "5", "6", "7", "8", "9"}, ids)
+	assert.Equal(t, 0, sp.Len())
+	assert.Equal(t, int64(0), sp.Size())
+}
+
+func TestSpoolOverflow(t *testing.T) {
+	rec := protonats.SpoolRecord{Subject: "orders", Data: []byte(`{}`)}
+
+	sp, err := protonats.OpenSpool(t.TempDir(), protonats.WithSpoolMaxBytes(200, protonats.SpoolOverflowReject))
+	require.NoError(t, err)
+	defer sp.Close()
+
+	for err == nil {
+		err = sp.Append(rec)
+	}
+	assert.ErrorIs(t, err, protonats.ErrSpoolFull)
+
+	sp2, err := protonats.OpenSpool(t.TempDir(),
+		protonats.WithSpoolSegmentSize(100), protonats.WithSpoolMaxBytes(200, protonats.SpoolOverflowDropOldest))
+	require.NoError(t, err)
+	defer sp2.Close()
+
+	for i := 0; i < 20; i++ {
+		rec.MsgID = fmt.Sprint(i)
+		require.NoError(t, sp2.Append(rec))
+	}
+	assert.LessOrEqual(t, sp2.Size(), int64(200))
+
+	var last string
+	_, err = sp2.Drain(context.Background(), func(_ context.Context, r protonats.SpoolRecord) error {
+		last = r.MsgID
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "19", last)
+}
+
+type spoolMetrics struct {
+	mu      sync.Mutex
+	dropped int
+}
+
+func (m *spoolMetrics) SetSpoolDepth(string, int, int64) protonats.SpoolMetrics { return m }
+
+func (m *spoolMetrics) AddSpoolDropped(_ string, n int) protonats.SpoolMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dropped += n
+	return m
+}
+
+func spoolSegments(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	require.NoError(t, err)
+	sort.Strings(files)
+
+	return files
+}
+
+// corruptSpoolRecord flips payload byte of n-th record of the segment file
+func corruptSpoolRecord(t *testing.T, path string, n int) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var off int64
+	header := make([]byte, 8)
+
+	for i := 0; i < n; i++ {
+		_, err = f.ReadAt(header, off)
+		require.NoError(t, err)
+
+		off += 8 + int64(binary.BigEndian.Uint32(header[0:4]))
+	}
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, off+9)
+	require.NoError(t, err)
+
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, off+9)
+	require.NoError(t, err)
+}
+
+func drainIDs(t *testing.T, sp *protonats.Spool) []string {
+	var ids []string
+	_, err := sp.Drain(context.Background(), func(_ context.Context, r protonats.SpoolRecord) error {
+		ids = append(ids, r.MsgID)
+		return nil
+	})
+	require.NoError(t, err)
+
+	return ids
+}
+
+func TestSpoolRestoreCorrupted(t *testing.T) {
+	dir := t.TempDir()
+
+	sp, err := protonats.OpenSpool(dir, protonats.WithSpoolSegmentSize(128))
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sp.Append(protonats.SpoolRecord{Subject: "orders", MsgID: fmt.Sprint(i), Data: []byte(`{}`)}))
+	}
+	require.NoError(t, sp.Close())
+
+	segments := spoolSegments(t, dir)
+	require.True(t, len(segments) > 2, segments)
+
+	// record in the middle of sealed segment
+	corruptSpoolRecord(t, segments[0], 1)
+
+	// torn tail of the last segment
+	last := segments[len(segments)-1]
+	info, err := os.Stat(last)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(last, info.Size()-3))
+
+	m := &spoolMetrics{}
+	sp, err = protonats.OpenSpool(dir, protonats.WithSpoolSegmentSize(128), protonats.WithSpoolMetrics(m))
+	require.NoError(t, err)
+	defer sp.Close()
+
+	assert.Equal(t, 8, sp.Len())
+	assert.Equal(t, 1, m.dropped)
+
+	// appends continue after truncated tail
+	require.NoError(t, sp.Append(protonats.SpoolRecord{Subject: "orders", MsgID: "10", Data: []byte(`{}`)}))
+
+	assert.Equal(t, []string{"0", "2", "3", "4", "5", "6", "7", "8", "10"}, drainIDs(t, sp))
+	assert.Equal(t, 0, sp.Len())
+}
+
+func TestSpoolDrainCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	m := &spoolMetrics{}
+
+	sp, err := protonats.OpenSpool(dir, protonats.WithSpoolMetrics(m), protonats.WithSpoolFsync(protonats.SpoolFsyncAlways, 0))
+	require.NoError(t, err)
+	defer sp.Close()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sp.Append(protonats.SpoolRecord{Subject: "orders", MsgID: fmt.Sprint(i), Data: []byte(`{}`)}))
+	}
+
+	// corrupted while open doesn't stall drain
+	corruptSpoolRecord(t, spoolSegments(t, dir)[0], 1)
+
+	assert.Equal(t, []string{"0", "2"}, drainIDs(t, sp))
+	assert.Equal(t, 0, sp.Len())
+	assert.Equal(t, 1, m.dropped)
+
+	require.NoError(t, sp.Append(protonats.SpoolRecord{Subject: "orders", MsgID: "3", Data: []byte(`{}`)}))
+	assert.Equal(t, []string{"3"}, drainIDs(t, sp))
+}
+
+func TestSpoolBogusLength(t *testing.T) {
+	dir := t.TempDir()
+
+	sp, err := protonats.OpenSpool(dir)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sp.Append(protonats.SpoolRecord{Subject: "orders", MsgID: fmt.Sprint(i), Data: []byte(`{}`)}))
+	}
+	require.NoError(t, sp.Close())
+
+	// torn header claiming almost 4 GiB at the end of the last segment
+	last := spoolSegments(t, dir)[0]
+	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], 0xfffffff0)
+	_, err = f.Write(append(header, `{}`...))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	m := &spoolMetrics{}
+	sp, err = protonats.OpenSpool(dir, protonats.WithSpoolMetrics(m), protonats.WithSpoolFsync(protonats.SpoolFsyncAlways, 0))
+	require.NoError(t, err)
+	defer sp.Close()
+
+	assert.Equal(t, 3, sp.Len())
+
+	require.NoError(t, sp.Append(protonats.SpoolRecord{Subject: "orders", MsgID: "3", Data: []byte(`{}`)}))
+	require.NoError(t, sp.Append(protonats.SpoolRecord{Subject: "orders", MsgID: "4", Data: []byte(`{}`)}))
+
+	// header corrupted while open drops the rest of segment on drain
+	f, err = os.OpenFile(last, os.O_RDWR, 0o644)
+	require.NoError(t, err)
+
+	var off int64
+	for i := 0; i < 4; i++ {
+		_, err = f.ReadAt(header, off)
+		require.NoError(t, err)
+
+		off += 8 + int64(binary.BigEndian.Uint32(header[0:4]))
+	}
+
+	binary.BigEndian.PutUint32(header[0:4], 0xfffffff0)
+	_, err = f.WriteAt(header[0:4], off)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Equal(t, []string{"0", "1", "2", "3"}, drainIDs(t, sp))
+	assert.Equal(t, 0, sp.Len())
+	assert.Equal(t, 1, m.dropped)
+}
+
+func TestSenderCloseSpool(t *testing.T) {
+	sp, err := protonats.OpenSpool(t.TempDir())
+	require.NoError(t, err)
+
+	s, err := protonats.NewSenderFromConnWithOptions(runServer(t), "orders", protonats.WithSpool(sp))
+	require.NoError(t, err)
+
+	require.NoError(t, s.Close(context.Background()))
+	assert.ErrorIs(t, sp.Append(protonats.SpoolRecord{Subject: "orders", Data: []byte(`{}`)}), protonats.ErrSpoolClosed)
+}
@@ -77,3 +77,30 @@ func (d DrainList) Drain() error {
 }
 
 var _ Dryer = (DrainList)(nil)
+
+// JetStreamSubscriber creates JetStream push subscriptions with manual acknowledgement,
+// messages are acked or settled by Consumer failure handler according to handler result
+type JetStreamSubscriber struct {
+	Queue string
+
+	SubOptions []nats.SubOpt
+	JSOptions  []nats.JSOpt
+}
+
+// Subscribe implements Subscriber.Subscribe
+func (s *JetStreamSubscriber) Subscribe(conn *nats.Conn, subject string, cn chan *nats.Msg) (Dryer, error) {
+	js, err := conn.JetStream(s.JSOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := append([]nats.SubOpt{nats.ManualAck()}, s.SubOptions...)
+
+	if s.Queue != "" {
+		return js.ChanQueueSubscribe(subject, s.Queue, cn, opts...)
+	}
+
+	return js.ChanSubscribe(subject, cn, opts...)
+}
+
+var _ Subscriber = (*JetStreamSubscriber)(nil)
@@ -0,0 +1,277 @@
+package protonats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/binding/transformer"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/tel"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+// TenantExtension CloudEvents extension with tenant id
+const TenantExtension = "tenant"
+
+// TenantAttr span attribute and metrics label of tenant
+const TenantAttr = "tenant"
+
+var (
+	ErrTenantRequired = errors.New("tenant: event has no tenant")
+	ErrTenantInvalid  = errors.New("tenant: invalid tenant id")
+	ErrTenantUnknown  = errors.New("tenant: unknown tenant")
+	ErrTenantMismatch = errors.New("tenant: cross-tenant event")
+)
+
+type tenantKey struct{}
+
+// WithTenant puts tenant into context, TenantSender routes events sent with ctx to it
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFrom returns tenant put by WithTenant or TenantGuard
+func TenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// EventTenant reads tenant extension of e
+func EventTenant(e cloudevents.Event) string {
+	return stringExtension(e, TenantExtension)
+}
+
+// TenantRoute place of tenant events
+type TenantRoute struct {
+	// Prefix is prepended to every subject, e.g. "tenants.acme."
+	Prefix string
+	// Conn is connected to tenant NATS account, nil means the shared connection
+	Conn *nats.Conn
+}
+
+// TenantResolver maps tenant to its route
+type TenantResolver func(tenant string) (TenantRoute, error)
+
+// TenantSubjectPrefix keeps tenants in one account isolated by subject prefix made of format, e.g. "tenants.%s."
+func TenantSubjectPrefix(format string) TenantResolver {
+	return func(tenant string) (TenantRoute, error) {
+		if err := validTenant(tenant); err != nil {
+			return TenantRoute{}, err
+		}
+
+		return TenantRoute{Prefix: fmt.Sprintf(format, tenant)}, nil
+	}
+}
+
+// TenantAccounts routes only known tenants, e.g. to connections of their own NATS accounts
+func TenantAccounts(routes map[string]TenantRoute) TenantResolver {
+	return func(tenant string) (TenantRoute, error) {
+		route, ok := routes[tenant]
+		if !ok {
+			return TenantRoute{}, fmt.Errorf("%w: %q", ErrTenantUnknown, tenant)
+		}
+
+		return route, nil
+	}
+}
+
+// validTenant tenant becomes a subject token, so it can't contain separators or wildcards
+func validTenant(tenant string) error {
+	if tenant == "" || strings.ContainsAny(tenant, ".*> \t\r\n") {
+		return fmt.Errorf("%w: %q", ErrTenantInvalid, tenant)
+	}
+
+	return nil
+}
+
+// TenantSender publishes events into subjects of their tenant.
+// Tenant is taken from context or event tenant extension, they must not differ.
+// Sent event always gets tenant extension.
+type TenantSender struct {
+	Conn    *nats.Conn
+	Subject string
+
+	resolve TenantResolver
+	opts    []SenderOption
+
+	mx      sync.Mutex
+	senders map[*nats.Conn]*Sender
+}
+
+// NewTenantSender creates sender which subject (or context topic) is prefixed by tenant route.
+// One Sender with opts is created per route connection.
+func NewTenantSender(conn *nats.Conn, subject string, resolve TenantResolver, opts ...SenderOption) *TenantSender {
+	return &TenantSender{
+		Conn:    conn,
+		Subject: subject,
+		resolve: resolve,
+		opts:    opts,
+		senders: make(map[*nats.Conn]*Sender),
+	}
+}
+
+// Send implements protocol.Sender, message rejected before publish is finished with the error
+func (s *TenantSender) Send(ctx context.Context, in binding.Message, transformers ...binding.Transformer) error {
+	sender, ctx, err := s.route(ctx, in)
+	if err != nil {
+		_ = in.Finish(err)
+		return err
+	}
+
+	tenant := TenantFrom(ctx)
+	transformers = append(transformers, transformer.SetExtension(TenantExtension, func(interface{}) (interface{}, error) {
+		return tenant, nil
+	}))
+
+	return sender.Send(ctx, in, transformers...)
+}
+
+// route resolves tenant of the message and returns its sender with context of tenant and its subject
+func (s *TenantSender) route(ctx context.Context, in binding.Message) (*Sender, context.Context, error) {
+	tenant := TenantFrom(ctx)
+
+	if mr, ok := in.(binding.MessageMetadataReader); ok {
+		if own, _ := mr.GetExtension(TenantExtension).(string); own != "" {
+			if tenant != "" && own != tenant {
+				return nil, ctx, fmt.Errorf("%w: event of %q sent by %q", ErrTenantMismatch, own, tenant)
+			}
+
+			tenant = own
+		}
+	}
+
+	if tenant == "" {
+		return nil, ctx, ErrTenantRequired
+	}
+
+	route, err := s.resolve(tenant)
+	if err != nil {
+		return nil, ctx, err
+	}
+
+	sender, err := s.sender(route.Conn)
+	if err != nil {
+		return nil, ctx, err
+	}
+
+	subject := s.Subject
+	if topic := cecontext.TopicFrom(ctx); topic != "" {
+		subject = topic
+	}
+
+	return sender, cecontext.WithTopic(WithTenant(ctx, tenant), route.Prefix+subject), nil
+}
+
+// Close closes senders of every route, connections aren't closed
+func (s *TenantSender) Close(ctx context.Context) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	var errs []string
+	for conn, sender := range s.senders {
+		if err := sender.Close(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		delete(s.senders, conn)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("tenant sender close: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (s *TenantSender) sender(conn *nats.Conn) (*Sender, error) {
+	if conn == nil {
+		conn = s.Conn
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if sender, ok := s.senders[conn]; ok {
+		return sender, nil
+	}
+
+	sender, err := NewSenderFromConnWithOptions(conn, s.Subject, s.opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s.senders[conn] = sender
+
+	return sender, nil
+}
+
+// TenantGuard rejects events with tenant extension of another tenant
+// and puts tenant into handler context, so events sent by handler stay within the tenant.
+// Events without extension are accepted as their subject already belongs to the tenant.
+func TenantGuard(tenant string) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, e cloudevents.Event) protocol.Result {
+			if own := EventTenant(e); own != "" && own != tenant {
+				err := fmt.Errorf("%w: event %s of %q received by %q", ErrTenantMismatch, e.ID(), own, tenant)
+				tel.FromCtx(ctx).Warn("tenant guard", zap.Error(err))
+
+				return err
+			}
+
+			return next(WithTenant(ctx, tenant), e)
+		}
+	}
+}
+
+// NewTenantConsumer creates consumer of tenant subject resolved the same way as TenantSender does.
+// TenantGuard is the outermost middleware, rejected JetStream messages are terminated.
+func NewTenantConsumer(conn *nats.Conn, tenant, subject string, resolve TenantResolver, opts ...ConsumerOption) (*Consumer, error) {
+	route, err := resolve(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	if route.Conn != nil {
+		conn = route.Conn
+	}
+
+	opts = append(opts, func(c *Consumer) error {
+		c.middlewares = append([]Middleware{TenantGuard(tenant)}, c.middlewares...)
+		c.onFailure = termTenantMismatch(c.onFailure)
+
+		return nil
+	})
+
+	return NewConsumerFromConn(conn, route.Prefix+subject, opts...)
+}
+
+// termTenantMismatch redelivery of cross-tenant event won't change anything
+func termTenantMismatch(next FailureHandler) FailureHandler {
+	term := TermOnFailure()
+
+	return func(msg *nats.Msg, result error) error {
+		if errors.Is(result, ErrTenantMismatch) {
+			return term(msg, result)
+		}
+
+		return next(msg, result)
+	}
+}
+
+// tenantOf event tenant extension or context tenant for not sent yet events
+func tenantOf(ctx context.Context, e cloudevents.Event) string {
+	if tenant := EventTenant(e); tenant != "" {
+		return tenant
+	}
+
+	return TenantFrom(ctx)
+}
+
+var _ protocol.SendCloser = (*TenantSender)(nil)
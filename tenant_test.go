@@ -0,0 +1,104 @@
+package protonats_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/d7561985/protonats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantSubjectPrefix(t *testing.T) {
+	resolve := protonats.TenantSubjectPrefix("tenants.%s.")
+
+	route, err := resolve("acme")
+	require.NoError(t, err)
+	assert.Equal(t, "tenants.acme.", route.Prefix)
+
+	for _, tenant := range []string{"", "a.b", "*", ">", "a b"} {
+		_, err = resolve(tenant)
+		assert.True(t, errors.Is(err, protonats.ErrTenantInvalid), tenant)
+	}
+
+	_, err = protonats.TenantAccounts(map[string]protonats.TenantRoute{"acme": {}})("other")
+	assert.True(t, errors.Is(err, protonats.ErrTenantUnknown))
+}
+
+func TestTenantGuard(t *testing.T) {
+	var tenant string
+
+	h := protonats.Chain(func(ctx context.Context, e cloudevents.Event) protocol.Result {
+		tenant = protonats.TenantFrom(ctx)
+		return nil
+	}, protonats.TenantGuard("acme"))
+
+	own := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+	own.SetExtension(protonats.TenantExtension, "acme")
+	require.NoError(t, h(context.Background(), own))
+	assert.Equal(t, "acme", tenant)
+
+	// subject already belongs to the tenant
+	require.NoError(t, h(context.Background(), newEvent(t, "orders.created", orderCreated{ID: "o2"})))
+
+	tenant = ""
+	foreign := newEvent(t, "orders.created", orderCreated{ID: "o3"})
+	foreign.SetExtension(protonats.TenantExtension, "other")
+
+	res := h(context.Background(), foreign)
+	assert.True(t, errors.Is(res, protonats.ErrTenantMismatch))
+	assert.Empty(t, tenant)
+}
+
+func TestTenantSenderFinish(t *testing.T) {
+	conn := runServer(t)
+
+	sub, err := conn.SubscribeSync("tenants.acme.orders")
+	require.NoError(t, err)
+
+	s := protonats.NewTenantSender(conn, "orders", protonats.TenantSubjectPrefix("tenants.%s."))
+	defer s.Close(context.Background())
+
+	send := func(ctx context.Context, tenant string) (error, error) {
+		e := newEvent(t, "orders.created", orderCreated{ID: "o1"})
+		if tenant != "" {
+			e.SetExtension(protonats.TenantExtension, tenant)
+		}
+
+		in := &finishMsg{EventMessage: (*binding.EventMessage)(&e), finished: make(chan error, 1)}
+		err := s.Send(ctx, in)
+
+		select {
+		case res := <-in.finished:
+			return err, res
+		default:
+			t.Fatal("message isn't finished")
+			return err, nil
+		}
+	}
+
+	// rejected messages are finished with the error
+	err, res := send(context.Background(), "")
+	assert.True(t, errors.Is(err, protonats.ErrTenantRequired))
+	assert.Equal(t, err, res)
+
+	err, res = send(protonats.WithTenant(context.Background(), "acme"), "other")
+	assert.True(t, errors.Is(err, protonats.ErrTenantMismatch))
+	assert.Equal(t, err, res)
+
+	err, res = send(context.Background(), "a.b")
+	assert.True(t, errors.Is(err, protonats.ErrTenantInvalid))
+	assert.Equal(t, err, res)
+
+	err, res = send(context.Background(), "acme")
+	require.NoError(t, err)
+	assert.NoError(t, res)
+
+	_, err = sub.NextMsg(time.Second)
+	require.NoError(t, err)
+}